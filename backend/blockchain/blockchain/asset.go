@@ -0,0 +1,88 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrIssuanceDenied 发行方无权发行资产
+var ErrIssuanceDenied = errors.New("无权发行该资产")
+
+// checkAmounts 按资产分别检查交易的金额，spent为各输入花费的输出，返回以原生商品支付的手续费
+// 原生商品的输出总额不能超过输入总额，差额为手续费；其他资产的输出总额不能少于输入总额，
+// 超出的部分为新发行的数量，发行方必须是交易的签名者且已登记为原料厂或生产商
+// 金额无效时返回ErrTradeInvalid，无权发行时同时包含ErrIssuanceDenied，查询身份失败时返回原始错误
+func checkAmounts(t *trade.Trade, spent []trade.TradeOut, lookup identityLookup) (int, error) {
+	inputs := make(map[string]int)
+	for _, out := range spent {
+		inputs[out.Asset] += out.Num
+	}
+	outputs := make(map[string]int)
+	for _, out := range t.Outputs {
+		if out.Num < 0 {
+			return 0, fmt.Errorf("%w: 交易%x的输出金额%d为负数", ErrTradeInvalid, t.ID, out.Num)
+		}
+		if err := trade.ValidateAsset(out.Asset); err != nil {
+			return 0, fmt.Errorf("%w: 交易%x的%w", ErrTradeInvalid, t.ID, err)
+		}
+		outputs[out.Asset] += out.Num
+	}
+
+	if inputs[trade.NativeAsset] < outputs[trade.NativeAsset] {
+		return 0, fmt.Errorf("%w: 交易%x输入总额%d小于输出总额%d", ErrTradeInvalid, t.ID, inputs[trade.NativeAsset], outputs[trade.NativeAsset])
+	}
+	for _, asset := range sortedAssets(inputs) {
+		if asset != trade.NativeAsset && outputs[asset] < inputs[asset] {
+			return 0, fmt.Errorf("%w: 交易%x中资产%s的输出总额%d小于输入总额%d", ErrTradeInvalid, t.ID, asset, outputs[asset], inputs[asset])
+		}
+	}
+	for _, asset := range sortedAssets(outputs) {
+		if asset == trade.NativeAsset || outputs[asset] == inputs[asset] {
+			continue
+		}
+		if err := checkIssuer(t, asset, lookup); err != nil {
+			return 0, err
+		}
+	}
+	return inputs[trade.NativeAsset] - outputs[trade.NativeAsset], nil
+}
+
+// checkIssuer 检查交易是否有权发行资产asset
+func checkIssuer(t *trade.Trade, asset string, lookup identityLookup) error {
+	issuer, _, err := trade.ParseAssetID(asset)
+	if err != nil {
+		return fmt.Errorf("%w: 交易%x的%w", ErrTradeInvalid, t.ID, err)
+	}
+	signed := false
+	for _, in := range t.Inputs {
+		if bytes.Equal(util.PublicKeyHash(in.PublicKey), issuer) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("%w: 交易%x没有资产%s的发行方签名: %w", ErrTradeInvalid, t.ID, asset, ErrIssuanceDenied)
+	}
+	identity, ok, err := lookup(issuer)
+	if err != nil {
+		return err
+	}
+	if !ok || (identity != util.Raw && identity != util.Producer) {
+		return fmt.Errorf("%w: 交易%x的%w: 资产%s的发行方不是已登记的原料厂或生产商", ErrTradeInvalid, t.ID, ErrIssuanceDenied, asset)
+	}
+	return nil
+}
+
+// sortedAssets 按资产编号排序，使错误信息与检查顺序确定
+func sortedAssets(amounts map[string]int) []string {
+	assets := make([]string, 0, len(amounts))
+	for asset := range amounts {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+	return assets
+}
@@ -0,0 +1,118 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// assetFixture 发行方与其他付款方的公钥，以及身份查询
+type assetFixture struct {
+	issuerPub, otherPub []byte
+	tea, coffee         string // 发行方的两种资产
+	lookup              identityLookup
+}
+
+// newAssetFixture 创建发行方已登记为identity的测试数据，identity为空时发行方没有登记
+func newAssetFixture(identity util.Identity) *assetFixture {
+	_, issuerPub := util.GenNeKeyPair()
+	_, otherPub := util.GenNeKeyPair()
+	issuer := util.PublicKeyHash(issuerPub)
+	return &assetFixture{
+		issuerPub: issuerPub,
+		otherPub:  otherPub,
+		tea:       trade.AssetID(issuer, "tea"),
+		coffee:    trade.AssetID(issuer, "coffee"),
+		lookup: func(pubKeyHash []byte) (util.Identity, bool, error) {
+			if identity != "" && bytes.Equal(pubKeyHash, issuer) {
+				return identity, true, nil
+			}
+			return "", false, nil
+		},
+	}
+}
+
+// signedTrade 构造由publicKey签名、花费spent并产生outputs的交易
+func signedTrade(publicKey []byte, spent []trade.TradeOut, outputs ...trade.TradeOut) *trade.Trade {
+	tx := &trade.Trade{ID: []byte{0x01}, Outputs: outputs}
+	for range spent {
+		tx.Inputs = append(tx.Inputs, trade.TradeIn{TradeID: []byte{0x02}, PublicKey: publicKey})
+	}
+	return tx
+}
+
+func TestCheckAmountsPerAsset(t *testing.T) {
+	f := newAssetFixture(util.Producer)
+	to := bytes.Repeat([]byte{0x03}, 20)
+	native := trade.TradeOut{Num: 100, HashPublicKey: to}
+	tests := []struct {
+		name    string
+		payer   []byte
+		spent   []trade.TradeOut
+		outputs []trade.TradeOut
+		denied  bool // 期望ErrIssuanceDenied
+		ok      bool
+	}{
+		{"资产拆分转出", f.otherPub,
+			[]trade.TradeOut{{Num: 10, Asset: f.tea}},
+			[]trade.TradeOut{{Num: 6, Asset: f.tea, HashPublicKey: to}, {Num: 4, Asset: f.tea, HashPublicKey: to}}, false, true},
+		{"资产被销毁", f.otherPub,
+			[]trade.TradeOut{{Num: 10, Asset: f.tea}},
+			[]trade.TradeOut{{Num: 9, Asset: f.tea, HashPublicKey: to}}, false, false},
+		{"一种资产多出另一种资产减少", f.otherPub,
+			[]trade.TradeOut{{Num: 10, Asset: f.tea}, {Num: 5, Asset: f.coffee}},
+			[]trade.TradeOut{{Num: 15, Asset: f.tea, HashPublicKey: to}}, false, false},
+		{"原生商品不能换成资产", f.otherPub,
+			[]trade.TradeOut{native},
+			[]trade.TradeOut{{Num: 90, HashPublicKey: to}, {Num: 10, Asset: f.tea, HashPublicKey: to}}, true, false},
+		{"发行方增发", f.issuerPub,
+			[]trade.TradeOut{native},
+			[]trade.TradeOut{native, {Num: 10, Asset: f.tea, HashPublicKey: to}}, false, true},
+		{"非发行方增发", f.otherPub,
+			[]trade.TradeOut{native, {Num: 10, Asset: f.tea}},
+			[]trade.TradeOut{native, {Num: 11, Asset: f.tea, HashPublicKey: to}}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := checkAmounts(signedTrade(tt.payer, tt.spent, tt.outputs...), tt.spent, f.lookup)
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望通过=%v，得到%v", tt.ok, err)
+			}
+			if !tt.ok && !errors.Is(err, ErrTradeInvalid) {
+				t.Fatalf("期望ErrTradeInvalid，得到%v", err)
+			}
+			if errors.Is(err, ErrIssuanceDenied) != tt.denied {
+				t.Fatalf("期望ErrIssuanceDenied=%v，得到%v", tt.denied, err)
+			}
+		})
+	}
+}
+
+func TestCheckIssuerIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity util.Identity
+		ok       bool
+	}{
+		{"原料厂", util.Raw, true},
+		{"生产商", util.Producer, true},
+		{"经销商", util.Dealer, false},
+		{"消费者", util.User, false},
+		{"未登记", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newAssetFixture(tt.identity)
+			tx := signedTrade(f.issuerPub, []trade.TradeOut{{Num: 1}}, trade.TradeOut{Num: 10, Asset: f.tea})
+			err := checkIssuer(tx, f.tea, f.lookup)
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望通过=%v，得到%v", tt.ok, err)
+			}
+			if !tt.ok && !errors.Is(err, ErrIssuanceDenied) {
+				t.Fatalf("期望ErrIssuanceDenied，得到%v", err)
+			}
+		})
+	}
+}
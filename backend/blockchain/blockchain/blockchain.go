@@ -1,29 +1,39 @@
 package blockchain
 
 import (
+	"blockchain/codec"
+	"blockchain/merkle"
 	"blockchain/trade"
 	"blockchain/util"
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"encoding/binary"
-	"encoding/gob"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/dgraph-io/badger"
-	"io/ioutil"
-	"os"
-	"runtime"
 	"time"
 )
 
+// BlockHeader 区块头
+// 单独保存一份，查询区块信息时无需解码整个交易列表
+type BlockHeader struct {
+	Time       time.Time // 时间戳，精确到秒
+	Hash       []byte    // 哈希值
+	PrevHash   []byte    // 上一个区块的哈希值
+	MerkleRoot []byte    // 交易ID构成的默克尔树的根哈希
+	Target     []byte    // 难度值，PoA区块为空
+	Nonce      int64     // 是否进行获取
+	Height     int64     // 区块高度，创世区块为0
+	Signer     []byte    // PoA区块签名者的公钥，PoW区块为空
+	Signature  []byte    // 签名者对区块哈希的签名，不参与哈希计算
+}
+
 // Block 区块结构体
 type Block struct {
-	Time      time.Time // 时间戳
-	Hash      []byte    // 哈希值
-	PrevHash  []byte    // 上一个区块的哈希值
-	Target    []byte    // 难度值
-	Nonce     int64     // 是否进行获取
+	BlockHeader
 	TradeList []*trade.Trade
 }
 
@@ -40,65 +50,6 @@ type BlockChainIterator struct {
 	Database    *badger.DB
 }
 
-// TradePool 交易池
-type TradePool struct {
-	TradeInfo []*trade.Trade // 收集到的交易信息
-}
-
-func (tp *TradePool) AddTrade(trade *trade.Trade) {
-	tp.TradeInfo = append(tp.TradeInfo, trade)
-}
-
-// SaveFile 保存交易信息
-func (tp *TradePool) SaveFile() {
-	var content bytes.Buffer
-	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(tp)
-	util.Err(err)
-	err = ioutil.WriteFile(util.TradePool, content.Bytes(), 0644)
-	util.Err(err)
-}
-
-// LoadFile 读取交易信息
-func (tp *TradePool) LoadFile() error {
-	if !util.FileExists(util.TradePool) {
-		return nil
-	}
-
-	var tradePool TradePool
-
-	fileContent, err := ioutil.ReadFile(util.TradePool)
-	if err != nil {
-		util.Err(err)
-		return err
-	}
-
-	decoder := gob.NewDecoder(bytes.NewBuffer(fileContent))
-	err = decoder.Decode(&tradePool)
-	if err != nil {
-		util.Err(err)
-		return err
-	}
-
-	tp.TradeInfo = tradePool.TradeInfo
-	return nil
-}
-
-// CreateTradePool 创建或加载交易池
-func CreateTradePool() *TradePool {
-	tradePool := TradePool{}
-	err := tradePool.LoadFile()
-	util.Err(err)
-
-	return &tradePool
-}
-
-// RemoveTradePoolFile 移除交易池
-func RemoveTradePoolFile() error {
-	err := os.Remove(util.TradePool)
-	return err
-}
-
 // InitIterator 初始化迭代器
 func (blockChain *BlockChain) InitIterator() *BlockChainIterator {
 	iterator := BlockChainIterator{blockChain.LastHash, blockChain.Database}
@@ -106,323 +57,661 @@ func (blockChain *BlockChain) InitIterator() *BlockChainIterator {
 }
 
 // GetOGPrevHash 获取OGPrevHash
-func (chain *BlockChain) GetOGPrevHash() []byte {
+func (chain *BlockChain) GetOGPrevHash() ([]byte, error) {
 	var ogprevhash []byte
 	err := chain.Database.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("ogprevhash"))
-		util.Err(err)
-
-		err = item.Value(func(val []byte) error {
-			ogprevhash = val
-			return nil
-		})
-
-		util.Err(err)
+		if err != nil {
+			return notFound(err, ErrChainNotFound)
+		}
+		ogprevhash, err = item.ValueCopy(nil)
 		return err
 	})
-	util.Err(err)
-
-	return ogprevhash
+	return ogprevhash, err
 }
 
 // Next 迭代器的迭代函数
-func (iterator *BlockChainIterator) Next() *Block {
+func (iterator *BlockChainIterator) Next() (*Block, error) {
 	var tempBlock *Block
 
 	err := iterator.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iterator.CurrentHash)
-		util.Err(err)
-
-		err = item.Value(func(val []byte) error {
-			tempBlock = DeSerializeBlock(val)
-			return nil
-		})
-		util.Err(err)
+		var err error
+		tempBlock, err = getBlock(txn, iterator.CurrentHash)
 		return err
 	})
-	util.Err(err)
+	if err != nil {
+		return nil, err
+	}
 
 	iterator.CurrentHash = tempBlock.PrevHash
 
-	return tempBlock
+	return tempBlock, nil
+}
+
+// IsGenesis 判断是否为创世区块
+func (b *Block) IsGenesis() bool {
+	return b.Height == 0 && len(b.TradeList) == 1 && b.TradeList[0].IsFirstTrade()
 }
 
 // SetHash 构建区块哈希值
 func (b *Block) SetHash() {
 	// 创建一个buf用于存放要生成哈希的数据
+	// 写入bytes.Buffer不会失败
 	var buf bytes.Buffer
-	timeErr := binary.Write(&buf, binary.BigEndian, b.Time.Unix())
-	if timeErr != nil {
-		return
-	}
+	binary.Write(&buf, binary.BigEndian, b.Time.Unix())
 	buf.Write(b.PrevHash)
 	buf.Write(b.Target)
-	nonceErr := binary.Write(&buf, binary.BigEndian, b.Nonce)
-	if nonceErr != nil {
-		return
-	}
-	//buf.Write(b.Data)
-	// 还要加入交易
-	tradeIDs := make([][]byte, 0)
-	for _, t := range b.TradeList {
-		tradeIDs = append(tradeIDs, t.ID)
-	}
-	for _, tradeID := range tradeIDs {
-		buf.Write(tradeID)
-	}
+	binary.Write(&buf, binary.BigEndian, b.Nonce)
+	binary.Write(&buf, binary.BigEndian, b.Height)
+	// 交易通过默克尔根加入
+	buf.Write(b.MerkleRoot)
+	// PoW区块没有签名者，哈希与加入该字段之前相同
+	buf.Write(b.Signer)
 	// 计算哈希值
 	hash := sha256.Sum256(buf.Bytes())
 	b.Hash = hash[:]
 }
 
-// CreateBlock 创建区块
-func CreateBlock(prevHash []byte, trades []*trade.Trade) *Block {
-	block := Block{time.Now(), []byte{}, prevHash, []byte{}, 0, trades}
-	block.Target = block.GetTarget()
-	block.Nonce = block.FindNonce()
-	block.SetHash()
-	return &block
+// hashMatches 判断区块保存的哈希是否与按区块头重新计算的哈希一致
+func (b *Block) hashMatches() bool {
+	recomputed := Block{BlockHeader: b.BlockHeader}
+	recomputed.SetHash()
+	return bytes.Equal(recomputed.Hash, b.Hash)
 }
 
-// InitBlockChain 通过创世区块生成区块链
-func InitBlockChain(address []byte) *BlockChain {
+// MerkleTree 根据交易ID构建默克尔树
+func (b *Block) MerkleTree() *merkle.MerkleTree {
+	tradeIDs := make([][]byte, 0, len(b.TradeList))
+	for _, t := range b.TradeList {
+		tradeIDs = append(tradeIDs, t.ID)
+	}
+	return merkle.NewMerkleTree(tradeIDs)
+}
 
-	var lastHash []byte
-	if util.FileExists(util.BCFile) {
-		util.Info("区块链已存在...")
-		return ContinueBlockChain()
+// GetMerkleRoot 计算交易的默克尔根
+func (b *Block) GetMerkleRoot() []byte {
+	return b.MerkleTree().Root()
+}
+
+// MerkleProof 生成交易包含在该区块中的默克尔证明
+func (b *Block) MerkleProof(tradeID []byte) (*merkle.Proof, bool) {
+	for i, t := range b.TradeList {
+		if bytes.Equal(t.ID, tradeID) {
+			return b.MerkleTree().Proof(i)
+		}
 	}
+	return nil, false
+}
 
-	opts := badger.DefaultOptions(util.BCPath)
-	opts.Logger = nil
+// prepareBlock 创建接在prevHash之后的候选区块，由共识引擎填写目标值等字段，尚未封装
+func (blockChain *BlockChain) prepareBlock(prevHash []byte, height int64, trades []*trade.Trade) (*Block, error) {
+	block := Block{BlockHeader: BlockHeader{Time: time.Unix(time.Now().Unix(), 0), PrevHash: prevHash, Height: height}, TradeList: trades}
+	block.MerkleRoot = block.GetMerkleRoot()
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		// 前一个区块的时间戳可能略超前本地时间，候选区块的时间不能早于它
+		if height > 0 {
+			prev, err := getBlockHeader(txn, prevHash)
+			if err != nil {
+				return err
+			}
+			if block.Time.Before(prev.Time) {
+				block.Time = prev.Time
+			}
+		}
+		return GetConsensus().Prepare(txn, &block)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
 
-	db, err := badger.Open(opts)
-	util.Err(err)
+// CreateBlock 创建区块并由共识引擎封装，ctx被取消时放弃
+func (blockChain *BlockChain) CreateBlock(ctx context.Context, prevHash []byte, height int64, trades []*trade.Trade) (*Block, *SealResult, error) {
+	block, err := blockChain.prepareBlock(prevHash, height, trades)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := GetConsensus().Seal(ctx, block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, result, nil
+}
 
-	err = db.Update(func(txn *badger.Txn) error {
+// InitBlockChain 通过创世区块生成区块链，区块链已存在时返回ErrChainExists
+func InitBlockChain(address []byte) (*BlockChain, error) {
+	if util.FileExists(util.BCFile) {
+		return nil, ErrChainExists
+	}
 
-		firstTrade := trade.FirstTrade(address)
-		firstBlock := CreateBlock([]byte("无prevHash..."), []*trade.Trade{firstTrade})
-		firstBlock.SetHash()
+	db, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	blockChain := BlockChain{nil, db}
+	if err := blockChain.CreateGenesis(address); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &blockChain, nil
+}
 
-		util.Info("创世区块成功创建！")
+// CreateGenesis 在已打开的空链上生成创世区块，奖励转入address，链上已有区块时返回ErrChainExists
+func (blockChain *BlockChain) CreateGenesis(address []byte) error {
+	if !blockChain.IsEmpty() {
+		return ErrChainExists
+	}
 
-		if err = txn.Set(firstBlock.Hash, firstBlock.Serialize()); err != nil {
-			util.Err(err)
-		}
-		if err = txn.Set([]byte("lh"), firstBlock.Hash); err != nil {
-			util.Err(err)
-		}
-		if err = txn.Set([]byte("ogprevhash"), firstBlock.PrevHash); err != nil {
-			util.Err(err)
-		}
-		lastHash = firstBlock.Hash
+	firstTrade := trade.FirstTrade(address)
+	firstBlock, _, err := blockChain.CreateBlock(context.Background(), []byte("无prevHash..."), 0, []*trade.Trade{firstTrade})
+	if err != nil {
 		return err
-	})
+	}
 
-	util.Err(err)
+	err = blockChain.Database.Update(func(txn *badger.Txn) error {
+		return blockChain.connectGenesis(txn, firstBlock)
+	})
+	if err != nil {
+		return err
+	}
+	util.Info(fmt.Sprintf("创世区块成功创建！哈希为%x，其他节点通过-genesis指定该哈希后同步", firstBlock.Hash))
 
-	blockChain := BlockChain{lastHash, db}
-	return &blockChain
+	blockChain.LastHash = firstBlock.Hash
+	return nil
 }
 
-// ContinueBlockChain 加载区块链
-func ContinueBlockChain() *BlockChain {
-	if util.FileExists(util.BCFile) == false {
-		util.Err(errors.New("没有找到区块链..."))
-		runtime.Goexit()
-	}
-	var lastHash []byte
-
+// openDatabase 打开区块数据库
+func openDatabase() (*badger.DB, error) {
 	opts := badger.DefaultOptions(util.BCPath)
 	opts.Logger = nil
-	db, err := badger.Open(opts)
-	util.Err(err)
+	return badger.Open(opts)
+}
 
-	err = db.View(func(txn *badger.Txn) error {
+// readLastHash 读取主链末端的区块哈希，空链返回nil
+func readLastHash(db *badger.DB) ([]byte, error) {
+	var lastHash []byte
+	err := db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
-		util.Err(err)
-		err = item.Value(func(val []byte) error {
-			lastHash = val
+		if err == badger.ErrKeyNotFound {
 			return nil
-		})
-		util.Err(err)
+		}
+		if err != nil {
+			return err
+		}
+		lastHash, err = item.ValueCopy(nil)
 		return err
 	})
-	util.Err(err)
+	return lastHash, err
+}
+
+// ContinueBlockChain 加载区块链，本地没有区块链时返回ErrChainNotFound
+func ContinueBlockChain() (*BlockChain, error) {
+	if !util.FileExists(util.BCFile) {
+		return nil, ErrChainNotFound
+	}
+	chain, err := OpenBlockChain()
+	if err != nil {
+		return nil, err
+	}
+	if chain.IsEmpty() {
+		chain.Database.Close()
+		return nil, ErrChainNotFound
+	}
+	return chain, nil
+}
+
+// syncUTXOSet 旧版本的数据库或异常退出后，区块元数据和UTXO集合可能与区块不一致，此时重建
+// 更早版本用gob保存的区块元数据无法解析，删除后按主链重建，侧链区块的元数据不再保留
+func (blockChain *BlockChain) syncUTXOSet() error {
+	_, err := blockChain.GetBlockMeta(blockChain.LastHash)
+	if errors.Is(err, ErrCorruptData) {
+		util.Info("区块元数据的格式已过时，正在重建...")
+		if err := blockChain.Database.DropPrefix(blockMetaPrefix); err != nil {
+			return err
+		}
+		err = ErrBlockNotFound
+	}
+	if errors.Is(err, ErrBlockNotFound) {
+		util.Info("缺少区块元数据，正在重建...")
+		if err := blockChain.reindexBlockMeta(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if utxoSet := blockChain.UTXOSet(); !utxoSet.IsSynced() {
+		util.Info("UTXO集合与区块链不一致，正在重建...")
+		return utxoSet.Reindex()
+	}
+	return nil
+}
+
+// OpenBlockChain 打开本地区块链，不存在时创建一个空链
+// 供网络节点使用，空链通过同步获得包括创世区块在内的全部区块
+func OpenBlockChain() (*BlockChain, error) {
+	db, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	lastHash, err := readLastHash(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	chain := BlockChain{lastHash, db}
-	return &chain
+	if !chain.IsEmpty() {
+		if err := chain.syncUTXOSet(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &chain, nil
 }
 
-// AddBlock 添加新区块
-func (blockChain *BlockChain) AddBlock(newBlock *Block) {
-	var lastHash []byte
+// IsEmpty 判断区块链是否还没有任何区块
+func (blockChain *BlockChain) IsEmpty() bool {
+	return len(blockChain.LastHash) == 0
+}
 
+// HasBlock 判断区块是否已保存在本地
+func (blockChain *BlockChain) HasBlock(hash []byte) bool {
 	err := blockChain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		util.Err(err)
-		err = item.Value(func(val []byte) error {
-			lastHash = val
-			return nil
-		})
-		util.Err(err)
-
+		_, err := txn.Get(hash)
 		return err
 	})
-	util.Err(err)
-	// 检查一下新区块的前向hash和区块链的末尾hash是否一致
-	if !bytes.Equal(newBlock.PrevHash, lastHash) {
-		util.Err(errors.New("哈希检查不一致！"))
-		runtime.Goexit()
-	}
-
-	err = blockChain.Database.Update(func(transaction *badger.Txn) error {
-		err := transaction.Set(newBlock.Hash, newBlock.Serialize())
-		util.Err(err)
-		err = transaction.Set([]byte("lh"), newBlock.Hash)
-		blockChain.LastHash = newBlock.Hash
+	return err == nil
+}
+
+// GetBlock 根据哈希获取区块
+func (blockChain *BlockChain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
+
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		block, err = getBlock(txn, hash)
 		return err
 	})
-	util.Err(err)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
 }
 
-// FindUnspentTrades 寻找可用交易信息
-func (blockChain *BlockChain) FindUnspentTrades(address []byte) []trade.Trade {
-	// 存放可用交易信息
-	var unSpentTrades []trade.Trade
-	// 存放已使用交易信息
-	spentTrades := make(map[string][]int)
-	iterator := blockChain.InitIterator()
+// GetBlockHashes 获取从末端到创世区块的全部区块哈希
+func (blockChain *BlockChain) GetBlockHashes() ([][]byte, error) {
+	var hashes [][]byte
+	if blockChain.IsEmpty() {
+		return hashes, nil
+	}
 
-all:
+	iterator := blockChain.InitIterator()
+	ogPrevHash, err := blockChain.GetOGPrevHash()
+	if err != nil {
+		return nil, err
+	}
 	for {
-		block := iterator.Next()
-
-		for _, trade := range block.TradeList {
-			txID := hex.EncodeToString(trade.ID)
-
-		IterOutputs:
-			for outIdx, out := range trade.Outputs {
-				if spentTrades[txID] != nil {
-					for _, spentOut := range spentTrades[txID] {
-						if spentOut == outIdx {
-							continue IterOutputs
-						}
+		block, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, block.Hash)
+		if bytes.Equal(block.PrevHash, ogPrevHash) {
+			break
+		}
+	}
+	return hashes, nil
+}
+
+// GetBestHeight 获取区块链高度，创世区块高度为0，空链返回-1
+func (blockChain *BlockChain) GetBestHeight() (int64, error) {
+	if blockChain.IsEmpty() {
+		return -1, nil
+	}
+	meta, err := blockChain.GetBlockMeta(blockChain.LastHash)
+	if err != nil {
+		return -1, err
+	}
+	return meta.Height, nil
+}
+
+// FindUTXOs 找到一个地址的全部UTXO，按资产编号返回余额，原生商品的余额以空字符串为键
+// address为公钥，通过UTXO集合按公钥哈希直接查询
+func (blockChain *BlockChain) FindUTXOs(address []byte) (map[string]int, map[string][]int, error) {
+	unspentOuts := make(map[string][]int)
+	balances := make(map[string]int)
+
+	utxos, err := blockChain.UTXOSet().FindUTXOs(util.PublicKeyHash(address))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, utxo := range utxos {
+		txID := hex.EncodeToString(utxo.TradeID)
+		balances[utxo.Out.Asset] += utxo.Out.Num
+		unspentOuts[txID] = append(unspentOuts[txID], utxo.OutID)
+	}
+	return balances, unspentOuts, nil
+}
+
+// FindSpendableOutputs 找到资产asset的可用UTXO
+// 即资产量大于转账额，已被交易池中的交易花费的输出不计入
+func (blockChain *BlockChain) FindSpendableOutputs(address []byte, asset string, amount int) (int, map[string][]int, error) {
+	return blockChain.UTXOSet().FindSpendableOutputs(util.PublicKeyHash(address), asset, amount, GetMempool().IsSpent)
+}
+
+// hasPositive 判断是否有需要支付的资产
+func hasPositive(needs map[string]int) bool {
+	for _, need := range needs {
+		if need > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Transfer 交易中的一笔转出
+type Transfer struct {
+	To     []byte // 收款方的公钥哈希
+	Asset  string // 资产编号，为空时为原生商品；转出单品时可以为空，按单品所属的资产处理
+	Amount int    // 转出单品时忽略，单品的数量总是1
+	Serial string // 单品序列号，为空时转出可分割的数量
+}
+
+// OutPoint 一个交易输出的引用
+type OutPoint struct {
+	TradeID []byte
+	OutID   int
+}
+
+// TradeLeg 交易中一方的付款
+// 一笔交易可以包含多方的付款，如以商品交换货款，各方分别签名自己的输入
+// 一方可以有多笔转出，如将一批原料拆分为多个生产批次；也可以用Lots指定花费的批次，如将多个供应商的原料合并为一批
+type TradeLeg struct {
+	From      []byte            // 付款方公钥
+	Change    []byte            // 找零地址的公钥哈希，为空时找零给付款方
+	Transfers []Transfer        // 付款方转出的资产
+	Lots      []OutPoint        // 指定花费的输出，不足的部分再自动选择，超出的部分找零
+	Fee       int               // 付款方承担的手续费，以原生商品支付
+	Issue     map[string]int    // 付款方新发行的资产数量，按资产编号计，只能发行自己为发行方的资产
+	Mint      []Transfer        // 付款方新铸造的单品，序列号在链上必须唯一，只能铸造自己为发行方的资产
+	Key       *ecdsa.PrivateKey // 付款方私钥，为nil时由付款方之后调用Trade.Sign签名
+	Sources   []TradeSource     // 付款方的其他地址，如分层确定性钱包派生的地址；From的输出不足时依次从中选择，单品也在其中查找
+}
+
+// TradeSource 付款方的一个其他付款地址
+type TradeSource struct {
+	PublicKey []byte            // 公钥
+	Key       *ecdsa.PrivateKey // 私钥，为nil时由付款方之后调用Trade.Sign签名
+}
+
+// CreateTrade 创建交易，输出依次为各方的转出、铸造的单品和找零，总数不超过util.MaxTradeOutputs
+// 各方先花费指定的输出，再按资产选择足额的未花费输出，转出后剩余的部分和多发行的部分找零；手续费不出现在输出中，由原生商品的输入总额与输出总额之差隐式表示
+// 单品按序列号花费付款方持有的输出，原样转给收款方
+// 只发行资产或铸造单品、不需要花费任何输出的一方也会花费一个原生商品的输出并全额找零，以便对交易签名
+// des为交易描述，payload为交易携带的产品信息，可以为nil
+func (blockChain *BlockChain) CreateTrade(legs []TradeLeg, des string, payload *trade.Payload) (*trade.Trade, error) {
+	if len(legs) == 0 {
+		return nil, ErrInvalidAmount
+	}
+	var inputs []trade.TradeIn
+	var outputs, changes []trade.TradeOut
+	utxos := blockChain.UTXOSet()
+	pool := GetMempool()
+
+	// used 本交易已花费的输出，自动选择时跳过这些输出和交易池中的交易已花费的输出
+	used := make(map[string]bool)
+	skip := func(tradeID []byte, outID int) bool {
+		return used[outPointKey(tradeID, outID)] || pool.IsSpent(tradeID, outID)
+	}
+	spend := func(tradeID []byte, outID int, publicKey []byte) {
+		used[outPointKey(tradeID, outID)] = true
+		inputs = append(inputs, trade.TradeIn{TradeID: tradeID, OutID: outID, PublicKey: publicKey})
+	}
+
+	payers := make(map[string]bool)
+	for _, leg := range legs {
+		from := util.PublicKeyHash(leg.From)
+		if payers[string(from)] {
+			return nil, fmt.Errorf("%w: 同一付款方只能有一段付款", ErrInvalidAmount)
+		}
+		payers[string(from)] = true
+		sources := []TradeSource{{PublicKey: leg.From, Key: leg.Key}}
+		for _, source := range leg.Sources {
+			hash := util.PublicKeyHash(source.PublicKey)
+			if payers[string(hash)] {
+				return nil, fmt.Errorf("%w: 地址%s在多段付款中出现", ErrInvalidAmount, util.PublicHashToAddress(hash))
+			}
+			payers[string(hash)] = true
+			sources = append(sources, source)
+		}
+
+		// needs 付款方需要从已有输出中支付的各资产数量，held 指定的输出中各资产的数量
+		needs := make(map[string]int)
+		held := make(map[string]int)
+		if leg.Fee < 0 {
+			return nil, ErrInvalidAmount
+		}
+		needs[trade.NativeAsset] = leg.Fee
+		signed := len(inputs)
+		for _, lot := range leg.Lots {
+			if used[outPointKey(lot.TradeID, lot.OutID)] {
+				return nil, fmt.Errorf("%w: 输出%x:%d被重复指定", ErrInvalidAmount, lot.TradeID, lot.OutID)
+			}
+			out, ok, err := utxos.FindUTXO(from, lot.TradeID, lot.OutID)
+			if err != nil {
+				return nil, err
+			}
+			if !ok || pool.IsSpent(lot.TradeID, lot.OutID) {
+				return nil, fmt.Errorf("%w: 输出%x:%d不存在、已被花费或不属于%s", ErrInsufficientFunds, lot.TradeID, lot.OutID, util.PublicHashToAddress(from))
+			}
+			if out.IsItem() {
+				return nil, fmt.Errorf("%w: 输出%x:%d是单品%s，应按序列号转出", ErrInvalidAmount, lot.TradeID, lot.OutID, out.Serial)
+			}
+			spend(lot.TradeID, lot.OutID, leg.From)
+			held[out.Asset] += out.Num
+		}
+		for _, transfer := range leg.Transfers {
+			if transfer.Serial != "" {
+				var utxo UTXO
+				var owner []byte
+				for _, source := range sources {
+					found, ok, err := utxos.FindItem(util.PublicKeyHash(source.PublicKey), transfer.Serial, pool)
+					if err != nil {
+						return nil, err
+					}
+					if ok {
+						utxo, owner = found, source.PublicKey
+						break
 					}
 				}
-
-				if out.IsToAddressRight(address) {
-					unSpentTrades = append(unSpentTrades, *trade)
+				if owner == nil {
+					return nil, fmt.Errorf("%w: %s没有可转出的单品%s", ErrItemNotFound, util.PublicHashToAddress(from), transfer.Serial)
 				}
+				if transfer.Asset != trade.NativeAsset && transfer.Asset != utxo.Out.Asset {
+					return nil, fmt.Errorf("%w: 单品%s属于%s", trade.ErrInvalidAsset, transfer.Serial, assetName(utxo.Out.Asset))
+				}
+				spend(utxo.TradeID, utxo.OutID, owner)
+				outputs = append(outputs, trade.TradeOut{Num: 1, HashPublicKey: transfer.To, Asset: utxo.Out.Asset, Serial: transfer.Serial})
+				continue
+			}
+			if transfer.Amount <= 0 {
+				return nil, ErrInvalidAmount
+			}
+			if err := trade.ValidateAsset(transfer.Asset); err != nil {
+				return nil, err
+			}
+			needs[transfer.Asset] += transfer.Amount
+			outputs = append(outputs, trade.TradeOut{Num: transfer.Amount, HashPublicKey: transfer.To, Asset: transfer.Asset})
+		}
+		for asset, amount := range leg.Issue {
+			issuer, _, err := trade.ParseAssetID(asset)
+			if err != nil {
+				return nil, err
+			}
+			if amount <= 0 {
+				return nil, ErrInvalidAmount
 			}
-			if !trade.IsFirstTrade() {
-				for _, in := range trade.Inputs {
-					if in.IsFromAddressRight(address) {
-						inTradeID := hex.EncodeToString(in.TradeID)
-						spentTrades[inTradeID] = append(spentTrades[inTradeID], in.OutID)
+			if !bytes.Equal(issuer, from) {
+				return nil, fmt.Errorf("%w: %s不是资产%s的发行方", ErrIssuanceDenied, util.PublicHashToAddress(from), asset)
+			}
+			needs[asset] -= amount
+		}
+		for _, item := range leg.Mint {
+			if err := trade.ValidateSerial(item.Serial); err != nil {
+				return nil, err
+			}
+			issuer, _, err := trade.ParseAssetID(item.Asset)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(issuer, from) {
+				return nil, fmt.Errorf("%w: %s不是资产%s的发行方", ErrIssuanceDenied, util.PublicHashToAddress(from), item.Asset)
+			}
+			outputs = append(outputs, trade.TradeOut{Num: 1, HashPublicKey: item.To, Asset: item.Asset, Serial: item.Serial})
+		}
+		for asset := range held {
+			if _, ok := needs[asset]; !ok {
+				needs[asset] = 0
+			}
+		}
+
+		change := leg.Change
+		if len(change) == 0 {
+			change = from
+		}
+		// 付款方没有需要花费的输出时仍花费一个原生商品的输出，least为选择输出的下限
+		for _, asset := range sortedAssets(needs) {
+			need, least := needs[asset], needs[asset]
+			if asset == trade.NativeAsset && least <= 0 && len(inputs) == signed && !hasPositive(needs) {
+				least = 1
+			}
+			acc := held[asset]
+			// 只为签名而花费的输出必须属于付款方自己，发行和铸造由其签名授权
+			candidates := sources
+			if need <= 0 {
+				candidates = sources[:1]
+			}
+			for _, source := range candidates {
+				if acc >= least {
+					break
+				}
+				found, validOutputs, err := utxos.FindSpendableOutputs(util.PublicKeyHash(source.PublicKey), asset, least-acc, skip)
+				if err != nil {
+					return nil, err
+				}
+				for tradeID, outIDs := range validOutputs {
+					tID, err := hex.DecodeString(tradeID)
+					if err != nil {
+						return nil, err
+					}
+					for _, outID := range outIDs {
+						spend(tID, outID, source.PublicKey)
 					}
 				}
+				acc += found
+			}
+			if acc < least {
+				return nil, fmt.Errorf("%w: %s可用%d，需要%d", ErrInsufficientFunds, assetName(asset), acc, least)
+			}
+			// 发行量超过转出量时，多发行的部分与找零一起留给付款方
+			if acc > need {
+				changes = append(changes, trade.TradeOut{Num: acc - need, HashPublicKey: change, Asset: asset})
 			}
 		}
-		if bytes.Equal(block.PrevHash, blockChain.GetOGPrevHash()) {
-			break all
+		if len(inputs) == signed {
+			return nil, fmt.Errorf("%w: %s没有需要支付的资产", ErrInvalidAmount, util.PublicHashToAddress(from))
 		}
 	}
-	return unSpentTrades
-
-}
-
-// FindUTXOs 找到一个地址的全部UTXO
-func (blockChain *BlockChain) FindUTXOs(address []byte) (int, map[string]int) {
-	unspentOuts := make(map[string]int)
-	unspentTrades := blockChain.FindUnspentTrades(address)
-	accumulated := 0
 
-Work:
-	for _, trade := range unspentTrades {
-		txID := hex.EncodeToString(trade.ID)
-		for outIdx, out := range trade.Outputs {
-			if out.IsToAddressRight(address) {
-				accumulated += out.Num
-				unspentOuts[txID] = outIdx
-				continue Work
-			}
-		}
+	outputs = append(outputs, changes...)
+	if len(outputs) > util.MaxTradeOutputs {
+		return nil, fmt.Errorf("%w: 输出共%d个，超过%d个", ErrInvalidAmount, len(outputs), util.MaxTradeOutputs)
 	}
-	return accumulated, unspentOuts
-}
-
-// FindSpendableOutputs 找到可用的UTXO
-// 即资产量大于转账额
-func (blockChain *BlockChain) FindSpendableOutputs(address []byte, amount int) (int, map[string]int) {
-	unspentOuts := make(map[string]int)
-	unspentTxs := blockChain.FindUnspentTrades(address)
-	accumulated := 0
-
-Work:
-	for _, trade := range unspentTxs {
-		tradeID := hex.EncodeToString(trade.ID)
-		for outId, out := range trade.Outputs {
-			if out.IsToAddressRight(address) && accumulated < amount {
-				accumulated += out.Num
-				unspentOuts[tradeID] = outId
-				if accumulated >= amount {
-					break Work
-				}
-				continue Work
+	t := trade.Trade{Inputs: inputs, Outputs: outputs, Description: des, Payload: payload}
+	t.SetID()
+	for _, leg := range legs {
+		for _, source := range append([]TradeSource{{PublicKey: leg.From, Key: leg.Key}}, leg.Sources...) {
+			if source.Key == nil {
+				continue
+			}
+			if err := t.Sign(*source.Key); err != nil {
+				return nil, err
 			}
 		}
 	}
-	return accumulated, unspentOuts
+	return &t, nil
 }
 
-// CreateTrade 创建交易
-func (blockChain *BlockChain) CreateTrade(fromPublicKey, toHashPublicKey []byte, amount int, privateKey ecdsa.PrivateKey, des string) (*trade.Trade, bool) {
-
-	var inputs []trade.TradeIn
-	var outputs []trade.TradeOut
+// BlockVersion 区块编码的版本号，编码格式变化时递增
+// 区块哈希仍按SetHash中的字段拼接计算，与存储编码无关
+// 版本2在区块头末尾增加了签名者和签名，版本1的区块仍可解析
+const BlockVersion byte = 2
+
+// minTradeSize 交易编码的最小字节数，用于校验交易个数
+const minTradeSize = 1 + 4*8
+
+// encode 写入区块头的规范编码，不含版本号
+// 区块哈希只包含秒级时间，编码仍以纳秒为单位但只保存到秒，转发者无法改动不参与哈希的部分
+func (h *BlockHeader) encode(w *codec.Writer) {
+	w.WriteInt(h.Time.Unix() * int64(time.Second))
+	w.WriteBytes(h.Hash)
+	w.WriteBytes(h.PrevHash)
+	w.WriteBytes(h.MerkleRoot)
+	w.WriteBytes(h.Target)
+	w.WriteInt(h.Nonce)
+	w.WriteInt(h.Height)
+	w.WriteBytes(h.Signer)
+	w.WriteBytes(h.Signature)
+}
 
-	acc, validOutputs := blockChain.FindSpendableOutputs(fromPublicKey, amount)
-	if acc < amount {
-		util.Info("余额不足")
-		return &trade.Trade{}, false
+// decodeBlockHeader 读取区块头，version为编码的版本号
+func decodeBlockHeader(r *codec.Reader, version byte) BlockHeader {
+	header := BlockHeader{
+		Time:       time.Unix(r.ReadInt()/int64(time.Second), 0),
+		Hash:       r.ReadBytes(),
+		PrevHash:   r.ReadBytes(),
+		MerkleRoot: r.ReadBytes(),
+		Target:     r.ReadBytes(),
+		Nonce:      r.ReadInt(),
+		Height:     r.ReadInt(),
 	}
-	for tradeID, outID := range validOutputs {
-		tID, err := hex.DecodeString(tradeID)
-		util.Err(err)
-		input := trade.TradeIn{tID, outID, fromPublicKey, nil}
-		inputs = append(inputs, input)
-	}
-
-	outputs = append(outputs, trade.TradeOut{amount, toHashPublicKey})
-	if acc > amount {
-		outputs = append(outputs, trade.TradeOut{acc - amount, util.PublicKeyHash(fromPublicKey)})
+	if version >= 2 {
+		header.Signer = r.ReadBytes()
+		header.Signature = r.ReadBytes()
 	}
-	t := trade.Trade{nil, inputs, outputs, des}
-	t.SetID()
-	t.Sign(privateKey)
-	return &t, true
+	return header
 }
 
 // Serialize 序列化区块
+// 版本号 | 区块头 | 交易数 | 各交易的规范编码
 func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-	if err := encoder.Encode(b); err != nil {
-		util.Err(err)
+	var w codec.Writer
+	w.WriteVersion(BlockVersion)
+	b.BlockHeader.encode(&w)
+	w.WriteInt(int64(len(b.TradeList)))
+	for _, t := range b.TradeList {
+		t.Encode(&w)
 	}
-	return res.Bytes()
+	return w.Bytes()
 }
 
-// DeSerializeBlock 反序列化区块
-func DeSerializeBlock(data []byte) *Block {
-	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	if err := decoder.Decode(&block); err != nil {
-		util.Err(err)
+// ParseBlock 解析序列化的区块，数据不完整或格式错误时返回ErrCorruptData
+// 旧版本的数据库需要先运行migratedb命令迁移
+func ParseBlock(data []byte) (*Block, error) {
+	r := codec.NewReader(data)
+	version := r.ReadVersionUpTo(BlockVersion)
+	block := Block{BlockHeader: decodeBlockHeader(r, version)}
+	if n := r.ReadCount(minTradeSize); n > 0 {
+		block.TradeList = make([]*trade.Trade, n)
+		for i := range block.TradeList {
+			block.TradeList[i] = trade.DecodeTrade(r)
+		}
 	}
-	return &block
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("%w: 区块%v", ErrCorruptData, err)
+	}
+	return &block, nil
 }
 
 type TradeInfo struct {
@@ -448,11 +737,15 @@ func (chain *BlockChain) TraceCurrency(address []byte) ([]TradeInfo, error) {
 	var trades []TradeInfo
 	visited := make(map[string]bool) // 防止重复处理同一个交易
 
+	ogPrevHash, err := chain.GetOGPrevHash()
+	if err != nil {
+		return nil, err
+	}
 	iterator := chain.InitIterator()
-	for {
-		block := iterator.Next()
-		if block == nil || len(block.PrevHash) == 0 {
-			break
+	for !chain.IsEmpty() {
+		block, err := iterator.Next()
+		if err != nil {
+			return nil, err
 		}
 
 		for _, t := range block.TradeList {
@@ -478,6 +771,9 @@ func (chain *BlockChain) TraceCurrency(address []byte) ([]TradeInfo, error) {
 				}
 			}
 		}
+		if bytes.Equal(block.PrevHash, ogPrevHash) {
+			break
+		}
 	}
 
 	return trades, nil
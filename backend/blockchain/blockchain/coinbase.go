@@ -0,0 +1,77 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"fmt"
+)
+
+// BlockReward 获取高度为height的区块的挖矿奖励
+func BlockReward(height int64) int {
+	halvings := height / util.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return util.BlockReward >> uint(halvings)
+}
+
+// verifyCoinbase 校验区块中凭空产生输出的交易
+// 创世区块之后只允许第一笔交易是挖矿奖励交易，其高度与区块一致，金额不超过该高度的奖励与手续费之和
+// 奖励交易的ID必须与其内容一致，否则可能覆盖已有交易的输出和索引
+// 奖励交易不经过checkAmounts，每个输出都必须为正数且有收款地址，否则正负相抵可以凭空产生商品
+// 奖励交易可以省略，此时区块不产生新的商品，手续费也随之销毁
+func verifyCoinbase(block *Block, fees int) error {
+	for i, t := range block.TradeList {
+		if !t.IsFirstTrade() {
+			continue
+		}
+		if i != 0 {
+			return fmt.Errorf("区块%x的第%d笔交易%x不引用任何输出", block.Hash, i, t.ID)
+		}
+		if !bytes.Equal(t.ID, t.ComputeID()) {
+			return fmt.Errorf("区块%x的奖励交易%x的ID与内容不一致", block.Hash, t.ID)
+		}
+		height, ok := t.CoinbaseHeight()
+		if !ok || height != block.Height {
+			return fmt.Errorf("区块%x的奖励交易%x记录的高度与区块高度%d不一致", block.Hash, t.ID, block.Height)
+		}
+		amount := 0
+		for _, out := range t.Outputs {
+			if out.Asset != trade.NativeAsset || out.IsItem() {
+				return fmt.Errorf("区块%x的奖励交易%x只能包含原生商品", block.Hash, t.ID)
+			}
+			if out.Num <= 0 {
+				return fmt.Errorf("区块%x的奖励交易%x的输出金额%d不是正数", block.Hash, t.ID, out.Num)
+			}
+			if len(out.HashPublicKey) == 0 {
+				return fmt.Errorf("区块%x的奖励交易%x的输出没有收款地址", block.Hash, t.ID)
+			}
+			amount += out.Num
+		}
+		if reward := BlockReward(block.Height); amount > reward+fees {
+			return fmt.Errorf("区块%x的奖励交易金额%d超过奖励%d与手续费%d之和", block.Hash, amount, reward, fees)
+		}
+	}
+	return nil
+}
+
+// regularTrades 获取区块中除挖矿奖励交易以外的交易
+func regularTrades(block *Block) []*trade.Trade {
+	if len(block.TradeList) > 0 && block.TradeList[0].IsFirstTrade() {
+		return block.TradeList[1:]
+	}
+	return block.TradeList
+}
+
+// verifyBlockSize 检查区块中除挖矿奖励交易以外的交易总字节数不超过util.MaxBlockSize，计算方式与打包时相同
+func verifyBlockSize(block *Block) error {
+	size := 0
+	for _, t := range regularTrades(block) {
+		size += len(t.Serialize())
+	}
+	if size > util.MaxBlockSize {
+		return fmt.Errorf("区块%x的交易共%d字节，超过%d字节", block.Hash, size, util.MaxBlockSize)
+	}
+	return nil
+}
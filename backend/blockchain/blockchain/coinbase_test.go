@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// coinbaseBlock 创建高度为height、只包含一笔奖励交易的区块，奖励交易的输出为outs
+func coinbaseBlock(height int64, outs ...trade.TradeOut) *Block {
+	coinbase := trade.Coinbase(bytes.Repeat([]byte{0x01}, 20), height, 0)
+	coinbase.Outputs = outs
+	coinbase.ID = coinbase.ComputeID()
+	return &Block{BlockHeader: BlockHeader{Height: height}, TradeList: []*trade.Trade{coinbase}}
+}
+
+func TestVerifyCoinbaseOutputs(t *testing.T) {
+	miner := bytes.Repeat([]byte{0x02}, 20)
+	tests := []struct {
+		name string
+		outs []trade.TradeOut
+		ok   bool
+	}{
+		{"全部奖励", []trade.TradeOut{{Num: 50, HashPublicKey: miner}}, true},
+		{"拆成两个输出", []trade.TradeOut{{Num: 20, HashPublicKey: miner}, {Num: 30, HashPublicKey: miner}}, true},
+		{"正负相抵", []trade.TradeOut{{Num: 1000000, HashPublicKey: miner}, {Num: -999950, HashPublicKey: miner}}, false},
+		{"零金额输出", []trade.TradeOut{{Num: 50, HashPublicKey: miner}, {Num: 0, HashPublicKey: miner}}, false},
+		{"没有收款地址", []trade.TradeOut{{Num: 50}}, false},
+		{"非原生资产", []trade.TradeOut{{Num: 50, HashPublicKey: miner, Asset: "tea"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyCoinbase(coinbaseBlock(1, tt.outs...), 0)
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望通过=%v，得到%v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestVerifyBlockSize(t *testing.T) {
+	// sized 生成编码后恰好为size字节的交易
+	sized := func(size int) *trade.Trade {
+		tx := &trade.Trade{}
+		tx.Description = strings.Repeat("x", size-len(tx.Serialize()))
+		return tx
+	}
+	tests := []struct {
+		name   string
+		trades []*trade.Trade
+		ok     bool
+	}{
+		{"只有奖励交易", nil, true},
+		{"恰好达到上限", []*trade.Trade{sized(util.MaxBlockSize / 2), sized(util.MaxBlockSize / 2)}, true},
+		{"超过上限", []*trade.Trade{sized(util.MaxBlockSize / 2), sized(util.MaxBlockSize/2 + 1)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := coinbaseBlock(1, trade.TradeOut{Num: 50, HashPublicKey: bytes.Repeat([]byte{0x02}, 20)})
+			block.TradeList = append(block.TradeList, tt.trades...)
+			err := verifyBlockSize(block)
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望通过=%v，得到%v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestBlockRewardHalving(t *testing.T) {
+	tests := []struct {
+		height int64
+		want   int
+	}{
+		{0, util.BlockReward},
+		{util.HalvingInterval - 1, util.BlockReward},
+		{util.HalvingInterval, util.BlockReward / 2},
+		{2 * util.HalvingInterval, util.BlockReward / 4},
+		{63 * util.HalvingInterval, 0},
+	}
+	for _, tt := range tests {
+		if got := BlockReward(tt.height); got != tt.want {
+			t.Errorf("高度%d的奖励为%d，期望%d", tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyCoinbaseRewardAndFees(t *testing.T) {
+	miner := bytes.Repeat([]byte{0x02}, 20)
+	reward := BlockReward(1)
+	tests := []struct {
+		name  string
+		block func() *Block
+		fees  int
+		ok    bool
+	}{
+		{"奖励加手续费", func() *Block { return coinbaseBlock(1, trade.TradeOut{Num: reward + 7, HashPublicKey: miner}) }, 7, true},
+		{"少领奖励", func() *Block { return coinbaseBlock(1, trade.TradeOut{Num: 1, HashPublicKey: miner}) }, 0, true},
+		{"超过奖励与手续费之和", func() *Block { return coinbaseBlock(1, trade.TradeOut{Num: reward + 8, HashPublicKey: miner}) }, 7, false},
+		{"没有手续费时超过奖励", func() *Block { return coinbaseBlock(1, trade.TradeOut{Num: reward + 1, HashPublicKey: miner}) }, 0, false},
+		{"高度与区块不一致", func() *Block {
+			b := coinbaseBlock(1, trade.TradeOut{Num: reward, HashPublicKey: miner})
+			b.Height = 2
+			return b
+		}, 0, false},
+		{"奖励交易不在第一笔", func() *Block {
+			b := coinbaseBlock(1, trade.TradeOut{Num: reward, HashPublicKey: miner})
+			b.TradeList = append([]*trade.Trade{{ID: []byte{0x01}, Inputs: []trade.TradeIn{{TradeID: []byte{0x02}}}}}, b.TradeList...)
+			return b
+		}, 0, false},
+		{"ID与内容不一致", func() *Block {
+			b := coinbaseBlock(1, trade.TradeOut{Num: reward, HashPublicKey: miner})
+			b.TradeList[0].ID = bytes.Repeat([]byte{0xff}, 32)
+			return b
+		}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyCoinbase(tt.block(), tt.fees)
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望通过=%v，得到%v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestCheckAmountsFee(t *testing.T) {
+	payer := bytes.Repeat([]byte{0x02}, 20)
+	noIdentity := func([]byte) (util.Identity, bool, error) { return "", false, nil }
+	tests := []struct {
+		name    string
+		spent   int
+		outputs []int
+		fee     int
+		ok      bool
+	}{
+		{"输入等于输出", 100, []int{60, 40}, 0, true},
+		{"差额为手续费", 100, []int{60, 30}, 10, true},
+		{"全部作为手续费", 100, nil, 100, true},
+		{"输出超过输入", 100, []int{60, 41}, 0, false},
+		{"负数输出", 100, []int{110, -10}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &trade.Trade{ID: []byte{0x01}}
+			for _, num := range tt.outputs {
+				tx.Outputs = append(tx.Outputs, trade.TradeOut{Num: num, HashPublicKey: payer})
+			}
+			fee, err := checkAmounts(tx, []trade.TradeOut{{Num: tt.spent, HashPublicKey: payer}}, noIdentity)
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望通过=%v，得到%v", tt.ok, err)
+			}
+			if tt.ok && fee != tt.fee {
+				t.Fatalf("手续费为%d，期望%d", fee, tt.fee)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/dgraph-io/badger"
+	"sync"
+	"time"
+)
+
+// Consensus 共识引擎，决定区块如何产生以及如何证明其有效
+// 挖矿时先由Prepare填写候选区块的共识字段，再由Seal封装；收到或校验区块时由VerifySeal验证
+type Consensus interface {
+	// Name 共识引擎的名称
+	Name() string
+	// Prepare 在事务中为接在b.PrevHash之后的候选区块填写共识相关的字段，如目标值
+	Prepare(txn *badger.Txn, b *Block) error
+	// Seal 为候选区块生成共识证明并计算区块哈希，ctx被取消时放弃并返回ctx的错误
+	Seal(ctx context.Context, b *Block) (*SealResult, error)
+	// VerifySeal 在事务中验证区块的共识证明，区块的前序区块必须已经保存，无效时返回ErrInvalidSeal
+	VerifySeal(txn *badger.Txn, b *Block) error
+}
+
+// SealResult 一次封装的结果
+type SealResult struct {
+	Hashes   uint64        // 封装过程中计算的哈希次数，PoA为0
+	Duration time.Duration // 封装用时
+}
+
+// HashRate 封装期间每秒计算的哈希次数
+func (r *SealResult) HashRate() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Hashes) / r.Duration.Seconds()
+}
+
+var (
+	consensusMu sync.RWMutex
+	consensus   Consensus = &PoW{}
+)
+
+// SetConsensus 设置进程内使用的共识引擎，需在打开区块链前调用，默认使用PoW
+func SetConsensus(engine Consensus) {
+	consensusMu.Lock()
+	defer consensusMu.Unlock()
+	consensus = engine
+}
+
+// GetConsensus 获取进程内使用的共识引擎
+func GetConsensus() Consensus {
+	consensusMu.RLock()
+	defer consensusMu.RUnlock()
+	return consensus
+}
+
+// verifySeal 在事务中用当前的共识引擎验证区块
+func verifySeal(txn *badger.Txn, b *Block) error {
+	return GetConsensus().VerifySeal(txn, b)
+}
+
+// VerifySeal 验证区块的共识证明，区块的前序区块必须已经保存在链中，无效时返回ErrInvalidSeal
+func (blockChain *BlockChain) VerifySeal(b *Block) error {
+	return blockChain.Database.View(func(txn *badger.Txn) error {
+		return verifySeal(txn, b)
+	})
+}
@@ -0,0 +1,94 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// 以下编码是规范编码的固定样例，编码格式或哈希规则变化时这些测试会失败
+// 确需修改格式时应递增对应的版本号，并在迁移说明中注明
+
+const (
+	blockGolden     = "0217979cfe362a0000000000000000002055c51a71df4577ce83c2ce31733ccce8967827ef7b6a5f51605ed0500fa10c91000000000000002011111111111111111111111111111111111111111111111111111111111111110000000000000020222222222222222222222222222222222222222222222222222222222222222200000000000000203333333333333333333333333333333333333333333333333333333333333333000000000000002a0000000000000007000000000000004044444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444444000000000000004055555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555555000000000000000105000000000000002005068dc178ab14b4288302d61d861d88b83b83e9616615eb3a5e8acfee58c7b100000000000000010000000000000000ffffffffffffffff00000000000000080000000000000007000000000000000000000000000000010000000000000032000000000000001466666666666666666666666666666666666666660000000000000008636f696e6261736500000000"
+	blockHashGolden = "55c51a71df4577ce83c2ce31733ccce8967827ef7b6a5f51605ed0500fa10c91"
+	blockMetaGolden = "0100000000000000070000000000000006010000000000"
+)
+
+func testBlock() *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Time:       time.Unix(1700000000, 123456789),
+			PrevHash:   bytes.Repeat([]byte{0x11}, 32),
+			MerkleRoot: bytes.Repeat([]byte{0x22}, 32),
+			Target:     bytes.Repeat([]byte{0x33}, 32),
+			Nonce:      42,
+			Height:     7,
+			Signer:     bytes.Repeat([]byte{0x44}, 64),
+			Signature:  bytes.Repeat([]byte{0x55}, 64),
+		},
+		TradeList: []*trade.Trade{trade.Coinbase(bytes.Repeat([]byte{0x66}, 20), 7, 50)},
+	}
+	block.SetHash()
+	return block
+}
+
+func checkGolden(t *testing.T, name string, got []byte, golden string) {
+	t.Helper()
+	if hex.EncodeToString(got) != golden {
+		t.Fatalf("%s的编码与固定样例不一致:\n得到 %x\n期望 %s", name, got, golden)
+	}
+}
+
+func TestBlockEncoding(t *testing.T) {
+	block := testBlock()
+	checkGolden(t, "区块哈希", block.Hash, blockHashGolden)
+	data := block.Serialize()
+	checkGolden(t, "Block", data, blockGolden)
+
+	parsed, err := ParseBlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "解析后的Block", parsed.Serialize(), blockGolden)
+	// 时间只保存到秒
+	if !parsed.Time.Equal(time.Unix(1700000000, 0)) || !parsed.hashMatches() {
+		t.Fatalf("解析后的区块头与原区块不一致: %+v", parsed.BlockHeader)
+	}
+}
+
+func TestBlockTimeSubSecondIgnored(t *testing.T) {
+	block, shifted := testBlock(), testBlock()
+	shifted.Time = shifted.Time.Add(500 * time.Millisecond)
+	if !bytes.Equal(block.Serialize(), shifted.Serialize()) {
+		t.Fatal("不参与哈希的亚秒时间不应改变区块编码")
+	}
+}
+
+func TestParseBlockRejectsTruncated(t *testing.T) {
+	data := testBlock().Serialize()
+	if _, err := ParseBlock(data[:len(data)-1]); err == nil {
+		t.Fatal("截断的区块应当解析失败")
+	}
+}
+
+func TestBlockMetaEncoding(t *testing.T) {
+	meta := &BlockMeta{Height: 7, Work: big.NewInt(1 << 40).Bytes()}
+	data := meta.Serialize()
+	checkGolden(t, "BlockMeta", data, blockMetaGolden)
+
+	parsed, err := ParseBlockMeta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Height != meta.Height || !bytes.Equal(parsed.Work, meta.Work) {
+		t.Fatalf("解析结果%+v与原元数据%+v不一致", parsed, meta)
+	}
+	if _, err := ParseBlockMeta(data[:len(data)-1]); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("截断的元数据应返回ErrCorruptData，得到%v", err)
+	}
+}
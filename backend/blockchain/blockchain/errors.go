@@ -0,0 +1,31 @@
+package blockchain
+
+import (
+	"errors"
+	"github.com/dgraph-io/badger"
+)
+
+// 区块链操作返回的错误
+// 具体原因通过fmt.Errorf("%w: ...")附加在这些错误之后，调用方用errors.Is判断错误类型
+var (
+	ErrChainNotFound     = errors.New("没有找到区块链")
+	ErrChainExists       = errors.New("区块链已存在")
+	ErrBlockNotFound     = errors.New("区块不存在")
+	ErrTradeNotFound     = errors.New("主链上没有找到该交易")
+	ErrCorruptData       = errors.New("数据无法解析")
+	ErrInvalidAmount     = errors.New("转账金额或手续费无效")
+	ErrInsufficientFunds = errors.New("余额不足")
+	ErrPrevHashMismatch  = errors.New("前一个区块不存在")
+	ErrInvalidHeight     = errors.New("区块高度与前一个区块不连续")
+	ErrInvalidSeal       = errors.New("区块的共识证明无效")
+	ErrInvalidBlock      = errors.New("区块内容无效")
+	ErrNonceExhausted    = errors.New("没有找到满足目标值的nonce")
+)
+
+// notFound 将数据库中键不存在的错误转换为对应的类型化错误
+func notFound(err, target error) error {
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return target
+	}
+	return err
+}
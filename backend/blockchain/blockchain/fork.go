@@ -0,0 +1,384 @@
+package blockchain
+
+import (
+	"blockchain/codec"
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"math/big"
+	"time"
+)
+
+var blockMetaPrefix = []byte("bm-") // 区块元数据的键前缀
+
+// BlockMeta 区块在链中的位置信息，与区块本身分开保存
+// 主链与侧链上的区块都会记录，用于比较各分支的累计工作量
+type BlockMeta struct {
+	Height int64  // 区块高度，创世区块为0
+	Work   []byte // 从创世区块到该区块的累计工作量
+}
+
+// CumulativeWork 获取累计工作量
+func (meta *BlockMeta) CumulativeWork() *big.Int {
+	return new(big.Int).SetBytes(meta.Work)
+}
+
+// BlockMetaVersion 区块元数据编码的版本号
+const BlockMetaVersion byte = 1
+
+// Serialize 序列化区块元数据
+// 版本号 | 高度 | 累计工作量
+func (meta *BlockMeta) Serialize() []byte {
+	var w codec.Writer
+	w.WriteVersion(BlockMetaVersion)
+	w.WriteInt(meta.Height)
+	w.WriteBytes(meta.Work)
+	return w.Bytes()
+}
+
+// ParseBlockMeta 解析序列化的区块元数据，数据不完整或格式错误时返回ErrCorruptData
+func ParseBlockMeta(data []byte) (*BlockMeta, error) {
+	r := codec.NewReader(data)
+	r.ReadVersion(BlockMetaVersion)
+	meta := BlockMeta{Height: r.ReadInt(), Work: r.ReadBytes()}
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("%w: 区块元数据%v", ErrCorruptData, err)
+	}
+	return &meta, nil
+}
+
+// GetWork 计算区块的工作量，即找到该区块平均需要尝试的哈希次数
+// PoA区块没有目标值，工作量记为1
+func (b *Block) GetWork() *big.Int {
+	if len(b.Target) == 0 {
+		return big.NewInt(1)
+	}
+	target := new(big.Int).SetBytes(b.Target)
+	target.Add(target, big.NewInt(1))
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target)
+}
+
+func blockMetaKey(hash []byte) []byte {
+	return append(append([]byte{}, blockMetaPrefix...), hash...)
+}
+
+// getBlockMeta 在事务中读取区块元数据
+func getBlockMeta(txn *badger.Txn, hash []byte) (*BlockMeta, error) {
+	item, err := txn.Get(blockMetaKey(hash))
+	if err != nil {
+		return nil, notFound(err, ErrBlockNotFound)
+	}
+	var meta *BlockMeta
+	err = item.Value(func(val []byte) error {
+		meta, err = ParseBlockMeta(val)
+		return err
+	})
+	return meta, err
+}
+
+// getBlock 在事务中读取区块
+func getBlock(txn *badger.Txn, hash []byte) (*Block, error) {
+	item, err := txn.Get(hash)
+	if err != nil {
+		return nil, notFound(err, ErrBlockNotFound)
+	}
+	var block *Block
+	err = item.Value(func(val []byte) error {
+		block, err = ParseBlock(val)
+		return err
+	})
+	return block, err
+}
+
+// GetBlockMeta 获取区块元数据
+func (blockChain *BlockChain) GetBlockMeta(hash []byte) (*BlockMeta, error) {
+	var meta *BlockMeta
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		meta, err = getBlockMeta(txn, hash)
+		return err
+	})
+	return meta, err
+}
+
+// storeBlock 保存区块、区块头及元数据，不改变主链
+func storeBlock(txn *badger.Txn, block *Block, meta *BlockMeta) error {
+	if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+		return err
+	}
+	if err := txn.Set(headerKey(block.Hash), block.BlockHeader.Serialize()); err != nil {
+		return err
+	}
+	return txn.Set(blockMetaKey(block.Hash), meta.Serialize())
+}
+
+// connectGenesis 保存创世区块并将其作为主链的起点
+func (blockChain *BlockChain) connectGenesis(txn *badger.Txn, genesis *Block) error {
+	meta := BlockMeta{0, genesis.GetWork().Bytes()}
+	if err := storeBlock(txn, genesis, &meta); err != nil {
+		return err
+	}
+	if err := txn.Set([]byte("ogprevhash"), genesis.PrevHash); err != nil {
+		return err
+	}
+	if err := blockChain.UTXOSet().Update(txn, genesis); err != nil {
+		return err
+	}
+	if err := updateRegistry(txn, genesis); err != nil {
+		return err
+	}
+	if err := indexBlock(txn, genesis); err != nil {
+		return err
+	}
+	return txn.Set([]byte("lh"), genesis.Hash)
+}
+
+// connectBlock 校验区块中的交易并将区块接到主链末端
+func (blockChain *BlockChain) connectBlock(txn *badger.Txn, block *Block) error {
+	if err := verifyBlockSize(block); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+	fees, err := blockChain.verifyTrades(txn, regularTrades(block))
+	if err != nil {
+		return fmt.Errorf("%w: 区块%x包含无效交易: %v", ErrInvalidBlock, block.Hash, err)
+	}
+	if err := verifyCoinbase(block, fees); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+	if err := blockChain.UTXOSet().Update(txn, block); err != nil {
+		return err
+	}
+	if err := updateRegistry(txn, block); err != nil {
+		return err
+	}
+	if err := indexBlock(txn, block); err != nil {
+		return err
+	}
+	return txn.Set([]byte("lh"), block.Hash)
+}
+
+// disconnectBlock 将主链末端的区块撤下
+func (blockChain *BlockChain) disconnectBlock(txn *badger.Txn, block *Block) error {
+	if err := blockChain.UTXOSet().Rollback(txn, block); err != nil {
+		return err
+	}
+	if err := rollbackRegistry(txn, block); err != nil {
+		return err
+	}
+	if err := unindexBlock(txn, block); err != nil {
+		return err
+	}
+	return txn.Set([]byte("lh"), block.PrevHash)
+}
+
+// reorganize 将主链切换到以newTip为末端的分支
+// 返回被撤下而未被新分支包含的交易，以及新分支中接入主链的交易
+func (blockChain *BlockChain) reorganize(txn *badger.Txn, newTip *Block) ([]*trade.Trade, []*trade.Trade, error) {
+	oldHash, newHash := blockChain.LastHash, newTip.Hash
+	oldMeta, err := getBlockMeta(txn, oldHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	newMeta, err := getBlockMeta(txn, newHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 两条分支分别回退到相同高度，再一起回退直到分叉点
+	var detach, attach []*Block
+	for !bytes.Equal(oldHash, newHash) {
+		if oldMeta.Height >= newMeta.Height {
+			block, err := getBlock(txn, oldHash)
+			if err != nil {
+				return nil, nil, err
+			}
+			detach = append(detach, block)
+			oldHash = block.PrevHash
+			if oldMeta, err = getBlockMeta(txn, oldHash); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			block, err := getBlock(txn, newHash)
+			if err != nil {
+				return nil, nil, err
+			}
+			attach = append(attach, block)
+			newHash = block.PrevHash
+			if newMeta, err = getBlockMeta(txn, newHash); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	util.Info(fmt.Sprintf("主链重组: 撤下%d个区块，接入%d个区块，分叉点%x", len(detach), len(attach), oldHash))
+
+	for _, block := range detach {
+		if err := blockChain.disconnectBlock(txn, block); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var connected []*trade.Trade
+	included := make(map[string]bool)
+	for i := len(attach) - 1; i >= 0; i-- {
+		if err := blockChain.connectBlock(txn, attach[i]); err != nil {
+			return nil, nil, err
+		}
+		for _, t := range attach[i].TradeList {
+			connected = append(connected, t)
+			included[string(t.ID)] = true
+		}
+	}
+
+	var orphaned []*trade.Trade
+	for _, block := range detach {
+		for _, t := range block.TradeList {
+			if !t.IsFirstTrade() && !included[string(t.ID)] {
+				orphaned = append(orphaned, t)
+			}
+		}
+	}
+	return orphaned, connected, nil
+}
+
+// AddBlock 添加新区块
+// 空链时新区块通过verifyGenesis校验后作为创世区块保存；否则新区块可以接在任意已知区块之后，
+// 当其所在分支的累计工作量超过当前主链时切换主链，被撤下的交易放回交易池
+// 区块以哈希为键保存，哈希必须与区块头一致，否则可能覆盖其他区块或"lh"等键
+func (blockChain *BlockChain) AddBlock(newBlock *Block) error {
+	if !newBlock.hashMatches() {
+		return fmt.Errorf("%w: 区块%x的哈希与区块头不一致", ErrInvalidBlock, newBlock.Hash)
+	}
+	if blockChain.HasBlock(newBlock.Hash) {
+		return nil
+	}
+
+	var orphaned, connected []*trade.Trade
+	isTip, reorganized := false, false
+
+	err := blockChain.Database.Update(func(txn *badger.Txn) error {
+		if blockChain.IsEmpty() {
+			if err := verifyGenesis(newBlock); err != nil {
+				return err
+			}
+			if err := verifySeal(txn, newBlock); err != nil {
+				return err
+			}
+			isTip = true
+			return blockChain.connectGenesis(txn, newBlock)
+		}
+
+		parentMeta, err := getBlockMeta(txn, newBlock.PrevHash)
+		if errors.Is(err, ErrBlockNotFound) {
+			return fmt.Errorf("%w: 区块%x的PrevHash为%x", ErrPrevHashMismatch, newBlock.Hash, newBlock.PrevHash)
+		}
+		if err != nil {
+			return err
+		}
+		if newBlock.Height != parentMeta.Height+1 {
+			return fmt.Errorf("%w: 区块%x高度为%d，应为%d", ErrInvalidHeight, newBlock.Hash, newBlock.Height, parentMeta.Height+1)
+		}
+		if err := checkBlockTime(txn, newBlock); err != nil {
+			return err
+		}
+		if err := verifySeal(txn, newBlock); err != nil {
+			return err
+		}
+		if !bytes.Equal(newBlock.MerkleRoot, newBlock.GetMerkleRoot()) {
+			return fmt.Errorf("%w: 区块%x的交易摘要与交易列表不一致", ErrInvalidBlock, newBlock.Hash)
+		}
+		work := new(big.Int).Add(parentMeta.CumulativeWork(), newBlock.GetWork())
+		meta := BlockMeta{parentMeta.Height + 1, work.Bytes()}
+		if err := storeBlock(txn, newBlock, &meta); err != nil {
+			return err
+		}
+
+		tipMeta, err := getBlockMeta(txn, blockChain.LastHash)
+		if err != nil {
+			return err
+		}
+		if work.Cmp(tipMeta.CumulativeWork()) <= 0 {
+			util.Info(fmt.Sprintf("区块%x位于侧链，高度%d", newBlock.Hash, meta.Height))
+			return nil
+		}
+
+		isTip = true
+		if bytes.Equal(newBlock.PrevHash, blockChain.LastHash) {
+			return blockChain.connectBlock(txn, newBlock)
+		}
+		reorganized = true
+		orphaned, connected, err = blockChain.reorganize(txn, newBlock)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !isTip {
+		return nil
+	}
+	blockChain.LastHash = newBlock.Hash
+
+	// 已接入主链的交易移出交易池，被撤下的交易重新校验后放回
+	pool := GetMempool()
+	if !reorganized {
+		pool.Remove(newBlock.TradeList)
+		return nil
+	}
+	pool.Remove(connected)
+	for _, t := range orphaned {
+		if err := pool.Add(blockChain, t); err != nil && !errors.Is(err, ErrTradeKnown) {
+			util.Info(fmt.Sprintf("被撤下的交易%x未能放回交易池: %v", t.ID, err))
+		}
+	}
+	return nil
+}
+
+// checkBlockTime 检查区块时间戳不早于前一个区块，且不超前本地时间MaxFutureBlockTime秒以上
+// 时间戳决定难度调整，不加限制时可以通过伪造时间戳降低后续区块的难度
+func checkBlockTime(txn *badger.Txn, block *Block) error {
+	prev, err := getBlockHeader(txn, block.PrevHash)
+	if err != nil {
+		return err
+	}
+	if block.Time.Before(prev.Time) {
+		return fmt.Errorf("%w: 区块%x的时间%s早于前一个区块的%s", ErrInvalidBlock, block.Hash, block.Time, prev.Time)
+	}
+	if limit := time.Now().Add(util.MaxFutureBlockTime * time.Second); block.Time.After(limit) {
+		return fmt.Errorf("%w: 区块%x的时间%s超前本地时间", ErrInvalidBlock, block.Hash, block.Time)
+	}
+	return nil
+}
+
+// reindexBlockMeta 为旧版本数据库中的主链区块补充元数据、区块头和索引
+func (blockChain *BlockChain) reindexBlockMeta() error {
+	hashes, err := blockChain.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+	work := new(big.Int)
+
+	return blockChain.Database.Update(func(txn *badger.Txn) error {
+		for i := len(hashes) - 1; i >= 0; i-- {
+			block, err := getBlock(txn, hashes[i])
+			if err != nil {
+				return err
+			}
+			work.Add(work, block.GetWork())
+			meta := BlockMeta{int64(len(hashes) - 1 - i), work.Bytes()}
+			block.Height = meta.Height
+			if err := txn.Set(blockMetaKey(block.Hash), meta.Serialize()); err != nil {
+				return err
+			}
+			if err := txn.Set(headerKey(block.Hash), block.BlockHeader.Serialize()); err != nil {
+				return err
+			}
+			if err := indexBlock(txn, block); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/dgraph-io/badger"
+	"testing"
+)
+
+// testChain 在临时目录中打开空的区块链
+func testChain(t *testing.T) *BlockChain {
+	opts := badger.DefaultOptions(t.TempDir())
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &BlockChain{Database: db}
+}
+
+// mineOn 封装接在prev之后、包含trades的区块并加入区块链，奖励转给miner
+func mineOn(t *testing.T, chain *BlockChain, prev *Block, miner []byte, trades ...*trade.Trade) *Block {
+	t.Helper()
+	height := prev.Height + 1
+	trades = append([]*trade.Trade{trade.Coinbase(miner, height, BlockReward(height))}, trades...)
+	block, _, err := chain.CreateBlock(context.Background(), prev.Hash, height, trades)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestReorganizeRollsBackState(t *testing.T) {
+	chain := testChain(t)
+	registrarKey, registrarPub := util.GenNeKeyPair()
+	registrar := util.PublicKeyHash(registrarPub)
+	dealer := bytes.Repeat([]byte{0x03}, 20)
+	minerA, minerB := bytes.Repeat([]byte{0x0a}, 20), bytes.Repeat([]byte{0x0b}, 20)
+	const serial = "SN-0001"
+
+	if err := chain.CreateGenesis(registrar); err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfReg, err := trade.NewRegistration(registrar, util.Producer, "生产商", registrarKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := mineOn(t, chain, genesis, minerA, selfReg)
+
+	// b2花费创世输出，转账、铸造单品并登记经销商，之后被更长的分支撤下
+	dealerReg, err := trade.NewRegistration(dealer, util.Dealer, "经销商", registrarKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := chain.CreateTrade([]TradeLeg{{
+		From:      registrarPub,
+		Transfers: []Transfer{{To: dealer, Amount: 10}},
+		Mint:      []Transfer{{To: dealer, Asset: trade.AssetID(registrar, "tea"), Serial: serial}},
+		Key:       &registrarKey,
+	}}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b2 *Block
+
+	steps := []struct {
+		name    string
+		extend  func() *Block // 加入区块，返回期望的主链末端
+		applied bool          // b2中的交易是否在主链上
+	}{
+		{"接入主链", func() *Block {
+			b2 = mineOn(t, chain, b1, minerA, dealerReg, tx)
+			return b2
+		}, true},
+		{"更长的分支撤下b2", func() *Block {
+			c2 := mineOn(t, chain, b1, minerB)
+			return mineOn(t, chain, c2, minerB)
+		}, false},
+		{"原分支变长后重新接入b2", func() *Block {
+			b3 := mineOn(t, chain, b2, minerA)
+			return mineOn(t, chain, b3, minerA)
+		}, true},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			tip := step.extend()
+			if !bytes.Equal(chain.LastHash, tip.Hash) {
+				t.Fatalf("主链末端为%x，期望%x", chain.LastHash, tip.Hash)
+			}
+			utxos := chain.UTXOSet()
+
+			_, received, err := utxos.FindUTXO(dealer, tx.ID, 0)
+			if err != nil || received != step.applied {
+				t.Errorf("经销商的输出存在=%v，期望%v，错误%v", received, step.applied, err)
+			}
+			_, unspent, err := utxos.FindUTXO(registrar, genesis.TradeList[0].ID, 0)
+			if err != nil || unspent == step.applied {
+				t.Errorf("创世输出未花费=%v，期望%v，错误%v", unspent, !step.applied, err)
+			}
+			_, err = chain.GetIdentity(dealer)
+			if registered := err == nil; registered != step.applied {
+				t.Errorf("经销商已登记=%v，期望%v，错误%v", registered, step.applied, err)
+			}
+			if _, err := chain.GetIdentity(registrar); err != nil {
+				t.Errorf("b1中的登记不应被撤下: %v", err)
+			}
+			_, err = chain.Item(serial)
+			if minted := err == nil; minted != step.applied || (!minted && !errors.Is(err, ErrItemNotFound)) {
+				t.Errorf("单品已铸造=%v，期望%v，错误%v", minted, step.applied, err)
+			}
+			_, _, err = chain.FindTrade(tx.ID)
+			if indexed := err == nil; indexed != step.applied {
+				t.Errorf("交易索引存在=%v，期望%v，错误%v", indexed, step.applied, err)
+			}
+			err = chain.Database.View(func(txn *badger.Txn) error {
+				for _, key := range [][]byte{undoKey(b2.Hash), identityUndoKey(b2.Hash)} {
+					_, err := txn.Get(key)
+					if exists := err == nil; exists != step.applied {
+						t.Errorf("回滚数据%x存在=%v，期望%v", key, exists, step.applied)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pooled := GetMempool().Has(tx.ID); pooled == step.applied {
+				t.Errorf("交易在交易池中=%v，期望%v", pooled, !step.applied)
+			}
+			if _, err := chain.VerifyChain(); err != nil {
+				t.Errorf("重组后的主链校验失败: %v", err)
+			}
+		})
+	}
+}
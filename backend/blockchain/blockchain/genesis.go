@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+var (
+	genesisMu   sync.RWMutex
+	genesisHash []byte // 期望的创世区块哈希，为空时接受任意有效的创世区块
+)
+
+// SetGenesisHash 设置期望的创世区块哈希，需在打开区块链前调用
+// 创世区块的奖励接收者即登记员，固定创世区块哈希后，空链节点只接受该创世区块
+func SetGenesisHash(hash []byte) {
+	genesisMu.Lock()
+	defer genesisMu.Unlock()
+	genesisHash = hash
+}
+
+// GetGenesisHash 获取期望的创世区块哈希，没有设置时返回nil
+func GetGenesisHash() []byte {
+	genesisMu.RLock()
+	defer genesisMu.RUnlock()
+	return genesisHash
+}
+
+// verifyGenesis 校验创世区块
+// 创世区块只包含一笔初始交易，初始交易只有一个原生商品输出，金额为正且不超过InitNum，
+// 交易ID与内容一致、默克尔根与交易列表一致，因此创世区块哈希确定了登记员；
+// 设置了期望的创世区块哈希时还必须与之相同
+func verifyGenesis(block *Block) error {
+	if expected := GetGenesisHash(); expected != nil && !bytes.Equal(block.Hash, expected) {
+		return fmt.Errorf("%w: 创世区块%x与期望的%x不一致", ErrInvalidBlock, block.Hash, expected)
+	}
+	if !block.IsGenesis() {
+		return fmt.Errorf("%w: 区块%x不是创世区块", ErrInvalidBlock, block.Hash)
+	}
+	if !bytes.Equal(block.MerkleRoot, block.GetMerkleRoot()) {
+		return fmt.Errorf("%w: 区块%x的交易摘要与交易列表不一致", ErrInvalidBlock, block.Hash)
+	}
+	t := block.TradeList[0]
+	if !bytes.Equal(t.ID, t.ComputeID()) {
+		return fmt.Errorf("%w: 创世区块%x的初始交易%x的ID与内容不一致", ErrInvalidBlock, block.Hash, t.ID)
+	}
+	if len(t.Outputs) != 1 {
+		return fmt.Errorf("%w: 创世区块%x的初始交易应只有一个输出", ErrInvalidBlock, block.Hash)
+	}
+	out := t.Outputs[0]
+	if out.Asset != trade.NativeAsset || out.IsItem() {
+		return fmt.Errorf("%w: 创世区块%x的初始交易只能包含原生商品", ErrInvalidBlock, block.Hash)
+	}
+	if out.Num <= 0 || out.Num > util.InitNum {
+		return fmt.Errorf("%w: 创世区块%x的初始金额%d不在1到%d之间", ErrInvalidBlock, block.Hash, out.Num, util.InitNum)
+	}
+	if len(out.HashPublicKey) == 0 {
+		return fmt.Errorf("%w: 创世区块%x的初始交易没有收款地址", ErrInvalidBlock, block.Hash)
+	}
+	return nil
+}
+
+// CheckGenesis 检查本地链的创世区块是否为期望的创世区块，空链或没有设置期望的哈希时不检查
+func (blockChain *BlockChain) CheckGenesis() error {
+	expected := GetGenesisHash()
+	if expected == nil || blockChain.IsEmpty() {
+		return nil
+	}
+	hash, err := blockChain.GetBlockHashByHeight(0)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, expected) {
+		return fmt.Errorf("%w: 本地链的创世区块%x与期望的%x不一致", ErrInvalidBlock, hash, expected)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"testing"
+)
+
+// genesisBlock 创建只包含一笔初始交易的创世区块，初始交易的输出为outs
+func genesisBlock(outs ...trade.TradeOut) *Block {
+	first := trade.FirstTrade(bytes.Repeat([]byte{0x01}, 20))
+	first.Outputs = outs
+	first.ID = first.ComputeID()
+	block := &Block{TradeList: []*trade.Trade{first}}
+	block.MerkleRoot = block.GetMerkleRoot()
+	block.SetHash()
+	return block
+}
+
+func TestVerifyGenesis(t *testing.T) {
+	registrar := bytes.Repeat([]byte{0x02}, 20)
+	valid := genesisBlock(trade.TradeOut{Num: util.InitNum, HashPublicKey: registrar})
+	tests := []struct {
+		name  string
+		block func() *Block
+		ok    bool
+	}{
+		{"有效的创世区块", func() *Block { return valid }, true},
+		{"高度不为0", func() *Block {
+			b := genesisBlock(trade.TradeOut{Num: util.InitNum, HashPublicKey: registrar})
+			b.Height = 1
+			return b
+		}, false},
+		{"默克尔根不一致", func() *Block {
+			b := genesisBlock(trade.TradeOut{Num: util.InitNum, HashPublicKey: registrar})
+			b.MerkleRoot = bytes.Repeat([]byte{0xff}, 32)
+			return b
+		}, false},
+		{"超过初始数量", func() *Block { return genesisBlock(trade.TradeOut{Num: util.InitNum + 1, HashPublicKey: registrar}) }, false},
+		{"初始交易ID与内容不一致", func() *Block {
+			b := genesisBlock(trade.TradeOut{Num: util.InitNum, HashPublicKey: registrar})
+			b.TradeList[0].Outputs[0].HashPublicKey = bytes.Repeat([]byte{0x03}, 20)
+			return b
+		}, false},
+		{"多个输出", func() *Block {
+			return genesisBlock(trade.TradeOut{Num: 1, HashPublicKey: registrar}, trade.TradeOut{Num: 1, HashPublicKey: registrar})
+		}, false},
+		{"没有收款地址", func() *Block { return genesisBlock(trade.TradeOut{Num: util.InitNum}) }, false},
+		{"多笔交易", func() *Block {
+			b := genesisBlock(trade.TradeOut{Num: util.InitNum, HashPublicKey: registrar})
+			b.TradeList = append(b.TradeList, trade.Coinbase(registrar, 0, 50))
+			b.MerkleRoot = b.GetMerkleRoot()
+			return b
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyGenesis(tt.block())
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望通过=%v，得到%v", tt.ok, err)
+			}
+		})
+	}
+
+	SetGenesisHash(valid.Hash)
+	defer SetGenesisHash(nil)
+	if err := verifyGenesis(valid); err != nil {
+		t.Fatalf("期望的创世区块应当通过，得到%v", err)
+	}
+	other := genesisBlock(trade.TradeOut{Num: util.InitNum, HashPublicKey: bytes.Repeat([]byte{0x03}, 20)})
+	if err := verifyGenesis(other); err == nil {
+		t.Fatal("与期望哈希不同的创世区块应当被拒绝")
+	}
+}
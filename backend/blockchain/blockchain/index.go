@@ -0,0 +1,187 @@
+package blockchain
+
+import (
+	"blockchain/codec"
+	"blockchain/trade"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	headerPrefix = []byte("bh-") // 区块头索引，按哈希保存全部已知区块的区块头
+	heightPrefix = []byte("hi-") // 高度索引，仅记录主链上各高度对应的区块哈希
+	tradePrefix  = []byte("ti-") // 交易索引，记录主链上的交易所在的区块哈希
+	spendPrefix  = []byte("sp-") // 花费索引，记录主链上的输出被哪笔交易花费
+)
+
+// Serialize 序列化区块头，格式与区块编码的开头相同
+func (h *BlockHeader) Serialize() []byte {
+	var w codec.Writer
+	w.WriteVersion(BlockVersion)
+	h.encode(&w)
+	return w.Bytes()
+}
+
+// ParseBlockHeader 解析序列化的区块头
+func ParseBlockHeader(data []byte) (*BlockHeader, error) {
+	r := codec.NewReader(data)
+	version := r.ReadVersionUpTo(BlockVersion)
+	header := decodeBlockHeader(r, version)
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("%w: 区块头%v", ErrCorruptData, err)
+	}
+	return &header, nil
+}
+
+func headerKey(hash []byte) []byte {
+	return append(append([]byte{}, headerPrefix...), hash...)
+}
+
+func heightKey(height int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(height))
+	return append(append([]byte{}, heightPrefix...), buf[:]...)
+}
+
+func tradeKey(tradeID []byte) []byte {
+	return append(append([]byte{}, tradePrefix...), tradeID...)
+}
+
+// spendKey 生成花费索引的键: 前缀 + 交易ID + output序号
+func spendKey(tradeID []byte, outID int) []byte {
+	key := append(append([]byte{}, spendPrefix...), tradeID...)
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], uint32(outID))
+	return append(key, idx[:]...)
+}
+
+// indexBlock 在事务中将区块记为主链上该高度的区块，并记录其中交易所在的区块、交易花费的输出和铸造的单品
+func indexBlock(txn *badger.Txn, block *Block) error {
+	for _, t := range block.TradeList {
+		if err := txn.Set(tradeKey(t.ID), block.Hash); err != nil {
+			return err
+		}
+		if err := indexItems(txn, t); err != nil {
+			return err
+		}
+		if t.IsFirstTrade() {
+			continue
+		}
+		for _, in := range t.Inputs {
+			if err := txn.Set(spendKey(in.TradeID, in.OutID), t.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return txn.Set(heightKey(block.Height), block.Hash)
+}
+
+// unindexBlock 在事务中移除区块的高度、交易、花费和单品索引
+func unindexBlock(txn *badger.Txn, block *Block) error {
+	for _, t := range block.TradeList {
+		if err := txn.Delete(tradeKey(t.ID)); err != nil {
+			return err
+		}
+		if err := unindexItems(txn, t); err != nil {
+			return err
+		}
+		if t.IsFirstTrade() {
+			continue
+		}
+		for _, in := range t.Inputs {
+			if err := txn.Delete(spendKey(in.TradeID, in.OutID)); err != nil {
+				return err
+			}
+		}
+	}
+	return txn.Delete(heightKey(block.Height))
+}
+
+// getBlockHeader 在事务中读取区块头
+func getBlockHeader(txn *badger.Txn, hash []byte) (*BlockHeader, error) {
+	item, err := txn.Get(headerKey(hash))
+	if err != nil {
+		return nil, notFound(err, ErrBlockNotFound)
+	}
+	var header *BlockHeader
+	err = item.Value(func(val []byte) error {
+		header, err = ParseBlockHeader(val)
+		return err
+	})
+	return header, err
+}
+
+// GetBlockHeader 根据哈希获取区块头
+func (blockChain *BlockChain) GetBlockHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		header, err = getBlockHeader(txn, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// GetBlockHashByHeight 获取主链上指定高度的区块哈希
+func (blockChain *BlockChain) GetBlockHashByHeight(height int64) ([]byte, error) {
+	var hash []byte
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightKey(height))
+		if err != nil {
+			return notFound(err, ErrBlockNotFound)
+		}
+		hash, err = item.ValueCopy(nil)
+		return err
+	})
+	return hash, err
+}
+
+// GetBlockHeaderByHeight 获取主链上指定高度的区块头
+func (blockChain *BlockChain) GetBlockHeaderByHeight(height int64) (*BlockHeader, error) {
+	hash, err := blockChain.GetBlockHashByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return blockChain.GetBlockHeader(hash)
+}
+
+// GetBlockByHeight 获取主链上指定高度的区块
+func (blockChain *BlockChain) GetBlockByHeight(height int64) (*Block, error) {
+	hash, err := blockChain.GetBlockHashByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return blockChain.GetBlock(hash)
+}
+
+// FindTrade 在主链上查找交易及其所在的区块
+func (blockChain *BlockChain) FindTrade(tradeID []byte) (*trade.Trade, *Block, error) {
+	var blockHash []byte
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(tradeKey(tradeID))
+		if err != nil {
+			return notFound(err, ErrTradeNotFound)
+		}
+		blockHash, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := blockChain.GetBlock(blockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range block.TradeList {
+		if bytes.Equal(t.ID, tradeID) {
+			return t, block, nil
+		}
+	}
+	return nil, nil, ErrTradeNotFound
+}
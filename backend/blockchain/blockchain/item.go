@@ -0,0 +1,223 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"sort"
+)
+
+// ErrItemNotFound 单品不存在
+var ErrItemNotFound = errors.New("单品不存在")
+
+// itemPrefix 单品索引，记录主链上每个序列号被铸造的交易
+var itemPrefix = []byte("it-")
+
+func itemKey(serial string) []byte {
+	return append(append([]byte{}, itemPrefix...), serial...)
+}
+
+// itemExists 判断序列号是否已被铸造
+type itemExists func(serial string) (bool, error)
+
+// checkItems 检查交易中的单品，spent为各输入花费的输出，返回本交易新铸造的序列号
+// 单品的数量为1且属于原生商品以外的资产；输入中的每个单品必须原样转入序列号相同的一个输出，
+// 输入中没有的序列号为新铸造，序列号在链上不能已存在，且交易须由该资产的发行方签名
+func checkItems(t *trade.Trade, spent []trade.TradeOut, lookup identityLookup, exists itemExists) ([]string, error) {
+	held := make(map[string]trade.TradeOut)
+	for _, out := range spent {
+		if out.IsItem() {
+			held[out.Serial] = out
+		}
+	}
+
+	moved := make(map[string]bool)
+	var minted []string
+	for _, out := range t.Outputs {
+		if !out.IsItem() {
+			continue
+		}
+		if err := trade.ValidateSerial(out.Serial); err != nil {
+			return nil, fmt.Errorf("%w: 交易%x的%w", ErrTradeInvalid, t.ID, err)
+		}
+		if out.Num != 1 || out.Asset == trade.NativeAsset {
+			return nil, fmt.Errorf("%w: 交易%x中单品%s的数量须为1且属于原生商品以外的资产", ErrTradeInvalid, t.ID, out.Serial)
+		}
+		if moved[out.Serial] {
+			return nil, fmt.Errorf("%w: 交易%x中单品%s出现在多个输出中", ErrTradeInvalid, t.ID, out.Serial)
+		}
+		moved[out.Serial] = true
+
+		if in, ok := held[out.Serial]; ok {
+			if in.Asset != out.Asset {
+				return nil, fmt.Errorf("%w: 交易%x将单品%s由%s改为%s", ErrTradeInvalid, t.ID, out.Serial, assetName(in.Asset), assetName(out.Asset))
+			}
+			continue
+		}
+		ok, err := exists(out.Serial)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return nil, fmt.Errorf("%w: 交易%x铸造的单品%s已存在", ErrTradeInvalid, t.ID, out.Serial)
+		}
+		if err := checkIssuer(t, out.Asset, lookup); err != nil {
+			return nil, err
+		}
+		minted = append(minted, out.Serial)
+	}
+
+	serials := make([]string, 0, len(held))
+	for serial := range held {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	for _, serial := range serials {
+		if !moved[serial] {
+			return nil, fmt.Errorf("%w: 交易%x花费了单品%s但没有将其转出", ErrTradeInvalid, t.ID, serial)
+		}
+	}
+	return minted, nil
+}
+
+// indexItems 记录交易中首次出现的序列号，主链按顺序连接区块，首次出现即为铸造
+func indexItems(txn *badger.Txn, t *trade.Trade) error {
+	for _, out := range t.Outputs {
+		if !out.IsItem() {
+			continue
+		}
+		_, err := txn.Get(itemKey(out.Serial))
+		if err == nil {
+			continue
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err := txn.Set(itemKey(out.Serial), t.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexItems 移除交易铸造的单品的索引
+func unindexItems(txn *badger.Txn, t *trade.Trade) error {
+	for _, out := range t.Outputs {
+		if !out.IsItem() {
+			continue
+		}
+		item, err := txn.Get(itemKey(out.Serial))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		mintID, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(mintID, t.ID) {
+			if err := txn.Delete(itemKey(out.Serial)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mintedInDB 查询数据库中是否已铸造序列号
+func mintedInDB(txn *badger.Txn) itemExists {
+	return func(serial string) (bool, error) {
+		_, err := txn.Get(itemKey(serial))
+		if err == badger.ErrKeyNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
+
+// ItemCustody 单品的一次经手，即单品所在的交易输出
+type ItemCustody struct {
+	Node  *ProvenanceNode
+	OutID int
+	Out   trade.TradeOut
+}
+
+// ItemHistory 单品从铸造到当前持有方的全部经手记录
+// Custody按时间顺序排列，第一条为铸造，最后一条的收款方为当前持有方
+type ItemHistory struct {
+	Serial  string
+	Asset   string
+	Custody []ItemCustody
+}
+
+// Owner 单品的当前持有方的公钥哈希
+func (h *ItemHistory) Owner() []byte {
+	return h.Custody[len(h.Custody)-1].Out.HashPublicKey
+}
+
+// Item 查询主链上序列号为serial的单品，从铸造交易开始沿花费索引逐次追踪
+// 依赖单品索引和花费索引，之前版本创建的数据库需先执行migratedb重建索引
+func (blockChain *BlockChain) Item(serial string) (*ItemHistory, error) {
+	if err := trade.ValidateSerial(serial); err != nil {
+		return nil, err
+	}
+	var history *ItemHistory
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		history, err = itemHistory(txn, serial)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// itemHistory 在事务中追踪单品的经手记录
+func itemHistory(txn *badger.Txn, serial string) (*ItemHistory, error) {
+	item, err := txn.Get(itemKey(serial))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", notFound(err, ErrItemNotFound), serial)
+	}
+	tradeID, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &ItemHistory{Serial: serial}
+	b := newProvenanceBuilder(txn, &ProvenanceGraph{})
+	for {
+		n, err := b.node(tradeID)
+		if err != nil {
+			return nil, err
+		}
+		outID := -1
+		for i, out := range n.Trade.Outputs {
+			if out.Serial == serial {
+				outID = i
+				break
+			}
+		}
+		if outID < 0 {
+			return nil, fmt.Errorf("%w: 交易%x中没有单品%s", ErrCorruptData, tradeID, serial)
+		}
+		history.Custody = append(history.Custody, ItemCustody{n, outID, n.Trade.Outputs[outID]})
+
+		spender, err := txn.Get(spendKey(tradeID, outID))
+		if err == badger.ErrKeyNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tradeID, err = spender.ValueCopy(nil); err != nil {
+			return nil, err
+		}
+	}
+	history.Asset = history.Custody[0].Out.Asset
+	return history, nil
+}
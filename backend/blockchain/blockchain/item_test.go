@@ -0,0 +1,77 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"errors"
+	"github.com/dgraph-io/badger"
+	"testing"
+)
+
+func TestCheckItems(t *testing.T) {
+	f := newAssetFixture(util.Producer)
+	to := bytes.Repeat([]byte{0x03}, 20)
+	native := trade.TradeOut{Num: 100, HashPublicKey: to}
+	item := func(serial, asset string) trade.TradeOut {
+		return trade.TradeOut{Num: 1, HashPublicKey: to, Asset: asset, Serial: serial}
+	}
+	existing := map[string]bool{"SN-OLD": true}
+	exists := func(serial string) (bool, error) { return existing[serial], nil }
+
+	tests := []struct {
+		name    string
+		payer   []byte
+		spent   []trade.TradeOut
+		outputs []trade.TradeOut
+		minted  []string
+		ok      bool
+	}{
+		{"发行方铸造", f.issuerPub, []trade.TradeOut{native}, []trade.TradeOut{native, item("SN-1", f.tea)}, []string{"SN-1"}, true},
+		{"重复铸造链上已有的序列号", f.issuerPub, []trade.TradeOut{native}, []trade.TradeOut{native, item("SN-OLD", f.tea)}, nil, false},
+		{"同一交易铸造两次", f.issuerPub, []trade.TradeOut{native}, []trade.TradeOut{item("SN-1", f.tea), item("SN-1", f.tea)}, nil, false},
+		{"非发行方铸造", f.otherPub, []trade.TradeOut{native}, []trade.TradeOut{native, item("SN-1", f.tea)}, nil, false},
+		{"转出持有的单品", f.otherPub, []trade.TradeOut{item("SN-OLD", f.tea)}, []trade.TradeOut{item("SN-OLD", f.tea)}, nil, true},
+		{"花费单品但没有转出", f.otherPub, []trade.TradeOut{native, item("SN-OLD", f.tea)}, []trade.TradeOut{native}, nil, false},
+		{"转出时改变资产", f.otherPub, []trade.TradeOut{item("SN-OLD", f.tea)}, []trade.TradeOut{item("SN-OLD", f.coffee)}, nil, false},
+		{"单品数量不为1", f.issuerPub, []trade.TradeOut{native}, []trade.TradeOut{{Num: 2, HashPublicKey: to, Asset: f.tea, Serial: "SN-2"}}, nil, false},
+		{"原生商品不能作为单品", f.issuerPub, []trade.TradeOut{native}, []trade.TradeOut{item("SN-3", trade.NativeAsset)}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minted, err := checkItems(signedTrade(tt.payer, tt.spent, tt.outputs...), tt.spent, f.lookup, exists)
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望通过=%v，得到%v", tt.ok, err)
+			}
+			if !tt.ok && !errors.Is(err, ErrTradeInvalid) {
+				t.Fatalf("期望ErrTradeInvalid，得到%v", err)
+			}
+			if len(minted) != len(tt.minted) || (len(minted) > 0 && minted[0] != tt.minted[0]) {
+				t.Fatalf("铸造了%v，期望%v", minted, tt.minted)
+			}
+		})
+	}
+}
+
+// 同一区块中先后铸造相同序列号的两笔交易，第二笔应被拒绝
+func TestBatchRejectsDoubleMint(t *testing.T) {
+	f := newAssetFixture(util.Producer)
+	batch := newTradeBatch()
+	err := testChain(t).Database.View(func(txn *badger.Txn) error {
+		for i, wantOK := range []bool{true, false} {
+			out := trade.TradeOut{Num: 1, HashPublicKey: bytes.Repeat([]byte{0x03}, 20), Asset: f.tea, Serial: "SN-1"}
+			spent := []trade.TradeOut{{Num: 100}}
+			minted, err := checkItems(signedTrade(f.issuerPub, spent, out), spent, f.lookup, batch.minted(txn))
+			if (err == nil) != wantOK {
+				t.Fatalf("第%d笔铸造期望通过=%v，得到%v", i+1, wantOK, err)
+			}
+			for _, serial := range minted {
+				batch.items[serial] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
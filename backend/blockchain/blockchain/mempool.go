@@ -0,0 +1,277 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 交易未能加入交易池的原因
+var (
+	ErrTradeKnown    = errors.New("交易已在交易池中")
+	ErrTradeInvalid  = errors.New("交易验证失败")
+	ErrTradeConflict = errors.New("交易与交易池中的交易花费了相同的输出")
+	ErrMempoolFull   = errors.New("交易池已满且交易的手续费率过低")
+)
+
+// Mempool 内存交易池
+// 进程内共享同一个交易池，交易在加入时即完成校验，池中的交易互不冲突
+type Mempool struct {
+	mu      sync.RWMutex
+	entries map[string]*mempoolEntry // 以交易ID的十六进制为键
+	spent   map[string]string        // 池中交易花费的输出，值为花费它的交易ID
+	seq     uint64                   // 到达顺序计数
+}
+
+// mempoolEntry 交易池中的一笔交易
+type mempoolEntry struct {
+	trade *trade.Trade
+	added time.Time // 加入交易池的时间，用于过期淘汰
+	fee   int
+	size  int
+	seq   uint64
+}
+
+// mempoolRecord 交易池持久化时保存的记录
+type mempoolRecord struct {
+	Trade *trade.Trade
+	Added time.Time
+}
+
+var mempool = NewMempool()
+
+// NewMempool 创建空的交易池
+func NewMempool() *Mempool {
+	return &Mempool{
+		entries: make(map[string]*mempoolEntry),
+		spent:   make(map[string]string),
+	}
+}
+
+// GetMempool 获取进程内共享的交易池
+func GetMempool() *Mempool {
+	return mempool
+}
+
+// Add 校验交易并加入交易池
+// 交易引用的输出必须在主链的UTXO集合中，且没有被池中的其他交易花费
+func (pool *Mempool) Add(blockChain *BlockChain, t *trade.Trade) error {
+	return pool.add(blockChain, t, time.Now())
+}
+
+func (pool *Mempool) add(blockChain *BlockChain, t *trade.Trade, added time.Time) error {
+	if pool.Has(t.ID) {
+		return ErrTradeKnown
+	}
+	// 奖励交易只能由矿工放入区块，不能进入交易池
+	if t.IsFirstTrade() {
+		return ErrTradeInvalid
+	}
+
+	fee := 0
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		fee, err = verifyTrade(txn, t, newTradeBatch(), GetFlowPolicy())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.insert(&mempoolEntry{trade: t, added: added, fee: fee, size: len(t.Serialize())})
+}
+
+// insert 将已校验的交易放入交易池，调用方需持有写锁
+func (pool *Mempool) insert(entry *mempoolEntry) error {
+	pool.expire(time.Now())
+
+	id := hex.EncodeToString(entry.trade.ID)
+	if _, ok := pool.entries[id]; ok {
+		return ErrTradeKnown
+	}
+	for _, in := range entry.trade.Inputs {
+		if other, ok := pool.spent[outPointKey(in.TradeID, in.OutID)]; ok {
+			return fmt.Errorf("%w: %s", ErrTradeConflict, other)
+		}
+	}
+
+	// 交易池已满时淘汰手续费率最低的交易，新交易的费率不高于它时拒绝
+	if len(pool.entries) >= util.MempoolSize {
+		lowest := pool.lowestFeeRate()
+		if lowest == nil || !higherFeeRate(entry, lowest) {
+			return ErrMempoolFull
+		}
+		pool.remove(hex.EncodeToString(lowest.trade.ID))
+		util.Info(fmt.Sprintf("交易池已满，淘汰交易%x", lowest.trade.ID))
+	}
+
+	pool.seq++
+	entry.seq = pool.seq
+	pool.entries[id] = entry
+	for _, in := range entry.trade.Inputs {
+		pool.spent[outPointKey(in.TradeID, in.OutID)] = id
+	}
+	return nil
+}
+
+// remove 按ID移除交易，调用方需持有写锁
+func (pool *Mempool) remove(id string) {
+	entry, ok := pool.entries[id]
+	if !ok {
+		return
+	}
+	for _, in := range entry.trade.Inputs {
+		delete(pool.spent, outPointKey(in.TradeID, in.OutID))
+	}
+	delete(pool.entries, id)
+}
+
+// expire 移除超过util.MempoolExpiry仍未被打包的交易，调用方需持有写锁
+func (pool *Mempool) expire(now time.Time) {
+	for id, entry := range pool.entries {
+		if now.Sub(entry.added) > util.MempoolExpiry {
+			pool.remove(id)
+			util.Info(fmt.Sprintf("交易%s在交易池中过期", id))
+		}
+	}
+}
+
+// lowestFeeRate 找到手续费率最低的交易，费率相同时取最晚到达的
+func (pool *Mempool) lowestFeeRate() *mempoolEntry {
+	var lowest *mempoolEntry
+	for _, entry := range pool.entries {
+		if lowest == nil || higherFeeRate(lowest, entry) ||
+			(!higherFeeRate(entry, lowest) && entry.seq > lowest.seq) {
+			lowest = entry
+		}
+	}
+	return lowest
+}
+
+// higherFeeRate 判断a的手续费率是否高于b，交叉相乘避免浮点误差
+func higherFeeRate(a, b *mempoolEntry) bool {
+	return a.fee*b.size > b.fee*a.size
+}
+
+// Has 判断交易是否在交易池中
+func (pool *Mempool) Has(tradeID []byte) bool {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	_, ok := pool.entries[hex.EncodeToString(tradeID)]
+	return ok
+}
+
+// Get 根据ID获取交易池中的交易
+func (pool *Mempool) Get(tradeID []byte) (*trade.Trade, bool) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	entry, ok := pool.entries[hex.EncodeToString(tradeID)]
+	if !ok {
+		return nil, false
+	}
+	return entry.trade, true
+}
+
+// IsSpent 判断输出是否已被交易池中的交易花费
+func (pool *Mempool) IsSpent(tradeID []byte, outID int) bool {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	_, ok := pool.spent[outPointKey(tradeID, outID)]
+	return ok
+}
+
+// Count 获取交易池中的交易数
+func (pool *Mempool) Count() int {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	return len(pool.entries)
+}
+
+// Trades 按到达顺序获取交易池中未过期的交易
+func (pool *Mempool) Trades() []*trade.Trade {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.expire(time.Now())
+	return pool.sortedTrades()
+}
+
+func (pool *Mempool) sortedTrades() []*trade.Trade {
+	entries := make([]*mempoolEntry, 0, len(pool.entries))
+	for _, entry := range pool.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	trades := make([]*trade.Trade, len(entries))
+	for i, entry := range entries {
+		trades[i] = entry.trade
+	}
+	return trades
+}
+
+// Remove 移除已被打包进区块的交易，以及与它们花费了相同输出的交易
+func (pool *Mempool) Remove(trades []*trade.Trade) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, t := range trades {
+		pool.remove(hex.EncodeToString(t.ID))
+		for _, in := range t.Inputs {
+			if other, ok := pool.spent[outPointKey(in.TradeID, in.OutID)]; ok {
+				pool.remove(other)
+				util.Info(fmt.Sprintf("交易%s与区块中的交易冲突，已从交易池移除", other))
+			}
+		}
+	}
+}
+
+// SaveFile 将交易池保存到util.TradePool，节点退出时调用
+func (pool *Mempool) SaveFile() error {
+	pool.mu.RLock()
+	var records []mempoolRecord
+	for _, t := range pool.sortedTrades() {
+		records = append(records, mempoolRecord{t, pool.entries[hex.EncodeToString(t.ID)].added})
+	}
+	pool.mu.RUnlock()
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(records); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(util.TradePool, content.Bytes(), 0644)
+}
+
+// LoadFile 载入保存的交易池，逐笔重新校验，已失效的交易被丢弃
+func (pool *Mempool) LoadFile(blockChain *BlockChain) error {
+	if !util.FileExists(util.TradePool) || blockChain.IsEmpty() {
+		return nil
+	}
+	fileContent, err := ioutil.ReadFile(util.TradePool)
+	if err != nil {
+		return err
+	}
+	var records []mempoolRecord
+	if err := gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&records); err != nil {
+		return err
+	}
+
+	loaded := 0
+	for _, record := range records {
+		if err := pool.add(blockChain, record.Trade, record.Added); err == nil {
+			loaded++
+		}
+	}
+	util.Info(fmt.Sprintf("交易池载入%d笔交易，丢弃%d笔", loaded, len(records)-loaded))
+	return nil
+}
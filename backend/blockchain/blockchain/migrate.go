@@ -0,0 +1,111 @@
+package blockchain
+
+import (
+	"blockchain/util"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/dgraph-io/badger"
+)
+
+// 旧版本的数据库用gob保存区块、区块头和UTXO
+// MigrateDatabase 将其中的区块改写为规范编码，再由区块重建区块头、元数据、索引和UTXO集合
+// 迁移只保证旧数据能够被读取，不会重新计算交易ID、签名和区块哈希
+// 旧版本用gob计算交易哈希，区块哈希也不包含签名者等字段，这些链迁移后无法通过verifychain的哈希和签名校验
+// 这样的链只能用-reset重新生成，或从其他节点重新同步
+
+// derivedPrefixes 可以由区块重建的数据
+var derivedPrefixes = [][]byte{headerPrefix, heightPrefix, tradePrefix, spendPrefix, itemPrefix, blockMetaPrefix, utxoPrefix, undoPrefix, identityPrefix, identityUndoPrefix}
+
+// MigrateDatabase 迁移旧版本的区块数据库，返回改写的区块数，已迁移的区块不做修改
+func MigrateDatabase() (int, error) {
+	opts := badger.DefaultOptions(util.BCPath)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	migrated := 0
+	var lastHash []byte
+	err = db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return fmt.Errorf("没有找到区块链末端: %v", err)
+		}
+		if lastHash, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+
+		blocks, err := legacyBlocks(txn)
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			// 哈希与内容不一致的区块照常迁移，只提示需要重新生成区块链
+			if !block.hashMatches() {
+				util.Info(fmt.Sprintf("区块%x的哈希与内容不一致", block.Hash))
+			}
+			for _, t := range block.TradeList {
+				if !bytes.Equal(t.ID, t.ComputeID()) {
+					util.Info(fmt.Sprintf("区块%x中交易%x的ID与内容不一致", block.Hash, t.ID))
+				}
+			}
+			if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return txn.Delete(utxoTipKey)
+	})
+	if err != nil {
+		return migrated, err
+	}
+
+	if err := db.DropPrefix(derivedPrefixes...); err != nil {
+		return migrated, err
+	}
+	blockChain := BlockChain{lastHash, db}
+	if err := blockChain.reindexBlockMeta(); err != nil {
+		return migrated, err
+	}
+	return migrated, blockChain.UTXOSet().Reindex()
+}
+
+// legacyBlocks 找出数据库中仍为gob编码的区块
+// 区块以32字节的哈希为键，其余数据都带有前缀或固定的键名
+func legacyBlocks(txn *badger.Txn) ([]*Block, error) {
+	var blocks []*Block
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.KeyCopy(nil)
+		if len(key) != 32 || hasDerivedPrefix(key) {
+			continue
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := ParseBlock(value); err == nil {
+			continue
+		}
+		var block Block
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&block); err != nil || !bytes.Equal(block.Hash, key) {
+			return nil, fmt.Errorf("无法解析区块%x", key)
+		}
+		blocks = append(blocks, &block)
+	}
+	return blocks, nil
+}
+
+func hasDerivedPrefix(key []byte) bool {
+	for _, prefix := range derivedPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
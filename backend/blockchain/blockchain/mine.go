@@ -4,74 +4,270 @@ import (
 	"blockchain/trade"
 	"blockchain/util"
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"sort"
 )
 
-func isInputRight(trades []trade.Trade, in trade.TradeIn) (bool, int) {
-	for _, tx := range trades {
-		if bytes.Equal(tx.ID, in.TradeID) {
-			return true, tx.Outputs[in.OutID].Num
+// VerifyTrades 按区块的校验规则验证交易信息有效性，不检查流转规则，交易无效时返回ErrTradeInvalid
+func (blockChain *BlockChain) VerifyTrades(trades []*trade.Trade) error {
+	return blockChain.Database.View(func(txn *badger.Txn) error {
+		_, err := blockChain.verifyTrades(txn, trades)
+		return err
+	})
+}
+
+// tradeBatch 一批交易验证过程中尚未写入数据库的状态
+type tradeBatch struct {
+	spent      map[string]bool          // 本批交易中已被花费的输出，防止同一输出被重复使用
+	identities map[string]util.Identity // 本批交易中登记的身份，以公钥哈希的十六进制为键
+	owners     map[string][]byte        // 本批交易中登记的地址所属的一方，以公钥哈希的十六进制为键
+	items      map[string]bool          // 本批交易中铸造的单品序列号，防止同一序列号被重复铸造
+}
+
+func newTradeBatch() *tradeBatch {
+	return &tradeBatch{
+		spent:      make(map[string]bool),
+		identities: make(map[string]util.Identity),
+		owners:     make(map[string][]byte),
+		items:      make(map[string]bool),
+	}
+}
+
+// minted 查询序列号是否已被铸造，本批交易中的铸造优先于数据库中的记录
+func (batch *tradeBatch) minted(txn *badger.Txn) itemExists {
+	inDB := mintedInDB(txn)
+	return func(serial string) (bool, error) {
+		if batch.items[serial] {
+			return true, nil
 		}
+		return inDB(serial)
 	}
-	return false, 0
 }
 
-// 验证交易信息有效性
-func (blockChain *BlockChain) VerifyTrades(trades []*trade.Trade) bool {
-	if len(trades) == 0 {
-		return true
+// lookup 查询地址的身份，本批交易中的登记优先于数据库中的记录
+func (batch *tradeBatch) lookup(txn *badger.Txn) identityLookup {
+	return func(pubKeyHash []byte) (util.Identity, bool, error) {
+		if identity, ok := batch.identities[hex.EncodeToString(pubKeyHash)]; ok {
+			return identity, true, nil
+		}
+		rec, err := getIdentity(txn, pubKeyHash)
+		if errors.Is(err, ErrIdentityNotFound) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return rec.Identity, true, nil
+	}
+}
+
+// owner 查询地址所属的一方，本批交易中的登记优先于数据库中的记录
+func (batch *tradeBatch) owner(txn *badger.Txn) ownerLookup {
+	inDB := ownerInDB(txn)
+	return func(pubKeyHash []byte) ([]byte, error) {
+		if owner, ok := batch.owners[hex.EncodeToString(pubKeyHash)]; ok {
+			return owner, nil
+		}
+		return inDB(pubKeyHash)
 	}
-	spentOutputs := make(map[string]int)
+}
+
+// verifyTrades 在事务中验证区块中的交易并返回手续费总额，主链重组时基于尚未提交的UTXO集合进行验证
+// 流转规则是节点的本地策略，不用于校验区块
+func (blockChain *BlockChain) verifyTrades(txn *badger.Txn, trades []*trade.Trade) (int, error) {
+	batch := newTradeBatch()
+	fees := 0
 	for _, tx := range trades {
-		pubKey := tx.Inputs[0].PublicKey
-		unspentOutputs := blockChain.FindUnspentTrades(pubKey)
-		inputAmount := 0
-		OutputAmount := 0
-
-		for _, input := range tx.Inputs {
-			if outid, ok := spentOutputs[hex.EncodeToString(input.TradeID)]; ok && outid == input.OutID {
-				return false
-			}
-			ok, amount := isInputRight(unspentOutputs, input)
-			if !ok {
-				return false
-			}
-			inputAmount += amount
-			spentOutputs[hex.EncodeToString(input.TradeID)] = input.OutID
+		fee, err := verifyTrade(txn, tx, batch, nil)
+		if err != nil {
+			return 0, err
 		}
+		fees += fee
+	}
+	return fees, nil
+}
+
+// verifyTrade 验证单笔交易并返回手续费，即输入总额超出输出总额的部分
+// 交易有效时将其花费的输出和登记的身份记入batch；交易本身无效时返回ErrTradeInvalid，读取数据库失败时返回原始错误
+// policy不为nil时，交易还需符合付款方与收款方的身份关系，违反时的错误同时包含ErrFlowViolation
+// 只有交易池准入和本节点打包区块时传入流转规则，校验收到的区块时为nil，规则不同的节点因此不会分叉
+func verifyTrade(txn *badger.Txn, tx *trade.Trade, batch *tradeBatch, policy FlowPolicy) (int, error) {
+	// UTXO集合和交易索引以交易ID为键，ID与内容不一致的交易可能覆盖其他交易的记录
+	if !bytes.Equal(tx.ID, tx.ComputeID()) {
+		return 0, fmt.Errorf("%w: 交易%x的ID与内容不一致", ErrTradeInvalid, tx.ID)
+	}
+	if tx.IsRegistration() {
+		owner, err := verifyRegistration(txn, tx, batch.lookup(txn), batch.owner(txn))
+		if err != nil {
+			return 0, err
+		}
+		batch.identities[hex.EncodeToString(tx.Registration.PubKeyHash)] = tx.Registration.Identity
+		batch.owners[hex.EncodeToString(tx.Registration.PubKeyHash)] = owner
+		return 0, nil
+	}
+
+	var spentKeys []string
+	var spent []trade.TradeOut
+	inTrade := make(map[string]bool)
+	for _, input := range tx.Inputs {
+		spentKey := outPointKey(input.TradeID, input.OutID)
+		if batch.spent[spentKey] || inTrade[spentKey] {
+			return 0, fmt.Errorf("%w: 交易%x重复花费输出%s", ErrTradeInvalid, tx.ID, spentKey)
+		}
+		out, ok, err := findUTXO(txn, util.PublicKeyHash(input.PublicKey), input.TradeID, input.OutID)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("%w: 交易%x引用的输出%s不存在或已被花费", ErrTradeInvalid, tx.ID, spentKey)
+		}
+		inTrade[spentKey] = true
+		spentKeys = append(spentKeys, spentKey)
+		spent = append(spent, out)
+	}
 
-		for _, output := range tx.Outputs {
-			OutputAmount += output.Num
+	lookup := batch.lookup(txn)
+	fee, err := checkAmounts(tx, spent, lookup)
+	if err != nil {
+		return 0, err
+	}
+	minted, err := checkItems(tx, spent, lookup, batch.minted(txn))
+	if err != nil {
+		return 0, err
+	}
+
+	if tx.Payload != nil {
+		if err := tx.Payload.Validate(); err != nil {
+			return 0, fmt.Errorf("%w: 交易%x的%w", ErrTradeInvalid, tx.ID, err)
+		}
+	}
+	if !tx.Verify() {
+		return 0, fmt.Errorf("%w: 交易%x的签名无效", ErrTradeInvalid, tx.ID)
+	}
+	if err := policy.checkFlow(tx, spent, lookup, batch.owner(txn)); err != nil {
+		if errors.Is(err, ErrFlowViolation) {
+			return 0, fmt.Errorf("%w: 交易%x: %w", ErrTradeInvalid, tx.ID, err)
 		}
-		if inputAmount != OutputAmount {
-			return false
+		return 0, err
+	}
+	for _, key := range spentKeys {
+		batch.spent[key] = true
+	}
+	for _, serial := range minted {
+		batch.items[serial] = true
+	}
+	return fee, nil
+}
+
+// selectTrades 按手续费率从高到低从交易池中选择交易，总大小不超过util.MaxBlockSize
+// 返回选中的交易及其手续费总额，以及无效的或与已选交易冲突、应从交易池中移除的交易
+// 放不下的交易留在交易池中等待下一个区块
+func (blockChain *BlockChain) selectTrades(pool []*trade.Trade) ([]*trade.Trade, int, []*trade.Trade, error) {
+	type candidate struct {
+		trade *trade.Trade
+		fee   int
+		size  int
+	}
+	var selected, invalid []*trade.Trade
+	fees := 0
+	policy := GetFlowPolicy()
+
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var candidates []candidate
+		for _, t := range pool {
+			fee, err := verifyTrade(txn, t, newTradeBatch(), policy)
+			if errors.Is(err, ErrTradeInvalid) {
+				invalid = append(invalid, t)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, candidate{t, fee, len(t.Serialize())})
 		}
+		// 比较fee/size时交叉相乘，避免浮点误差；费率相同时保持到达顺序
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].fee*candidates[j].size > candidates[j].fee*candidates[i].size
+		})
 
-		if !tx.Verify() {
-			return false
+		batch := newTradeBatch()
+		size := 0
+		for _, c := range candidates {
+			if size+c.size > util.MaxBlockSize {
+				continue
+			}
+			_, err := verifyTrade(txn, c.trade, batch, policy)
+			if errors.Is(err, ErrTradeInvalid) {
+				invalid = append(invalid, c.trade)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			selected = append(selected, c.trade)
+			fees += c.fee
+			size += c.size
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, nil, err
 	}
-	return true
+	return selected, fees, invalid, nil
+}
+
+// PrepareBlock 组装接在主链末端之后的候选区块，共识字段已填写，尚未封装
+// minerAddress为矿工的公钥哈希，区块的第一笔交易将奖励和手续费转入该地址，为空时不产生奖励
+// 按手续费率选择交易，验证失败的交易从交易池中移除
+func (blockchain *BlockChain) PrepareBlock(minerAddress []byte) (*Block, error) {
+	pool := GetMempool()
+	trades, fees, invalid, err := blockchain.selectTrades(pool.Trades())
+	if err != nil {
+		return nil, err
+	}
+	if len(invalid) > 0 {
+		util.Info(fmt.Sprintf("交易池中%d笔交易验证失败，已移除", len(invalid)))
+		pool.Remove(invalid)
+	}
+
+	bestHeight, err := blockchain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+	height := bestHeight + 1
+	if len(minerAddress) > 0 {
+		coinbase := trade.Coinbase(minerAddress, height, BlockReward(height)+fees)
+		trades = append([]*trade.Trade{coinbase}, trades...)
+	}
+	return blockchain.prepareBlock(blockchain.LastHash, height, trades)
 }
 
 // 挖矿函数
-func (blockchain *BlockChain) Mine() {
-	tradePool := CreateTradePool()
-	if !blockchain.VerifyTrades(tradePool.TradeInfo) {
-		util.Info("交易验证失败...")
-		err := RemoveTradePoolFile()
-		util.Err(err)
-		return
-	}
-
-	candidateBlock := CreateBlock(blockchain.LastHash, tradePool.TradeInfo)
-	if candidateBlock.ValidatePoW() {
-		blockchain.AddBlock(candidateBlock)
-		err := RemoveTradePoolFile()
-		util.Err(err)
-		return
-	} else {
-		util.Info("区块nonce无效！")
-		return
+// 组装候选区块并由共识引擎封装，区块接入主链时只有被打包的交易从交易池中移除
+// ctx被取消时放弃挖矿，成功时返回新区块供网络层广播
+func (blockchain *BlockChain) Mine(ctx context.Context, minerAddress []byte) (*Block, *SealResult, error) {
+	candidateBlock, err := blockchain.PrepareBlock(minerAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := GetConsensus().Seal(ctx, candidateBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := blockchain.connectMined(candidateBlock); err != nil {
+		return nil, nil, err
+	}
+	return candidateBlock, result, nil
+}
+
+// connectMined 验证挖出的区块并接入主链
+func (blockchain *BlockChain) connectMined(b *Block) error {
+	if err := blockchain.VerifySeal(b); err != nil {
+		return err
 	}
+	return blockchain.AddBlock(b)
 }
@@ -0,0 +1,115 @@
+package blockchain
+
+import (
+	"blockchain/util"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrMinerRunning 后台挖矿已在运行
+var ErrMinerRunning = errors.New("后台挖矿已在运行")
+
+// MinerStats 后台挖矿的运行状态
+type MinerStats struct {
+	Running  bool
+	Address  string  // 接收挖矿奖励的钱包地址
+	Blocks   int     // 本次启动以来挖出的区块数
+	Hashes   uint64  // 本次启动以来挖出的区块共计算的哈希次数
+	HashRate float64 // 最近一个区块封装期间的算力，单位为H/s，PoA为0
+}
+
+// Miner 后台挖矿
+// 交易池中有交易时持续挖矿，交易池为空时等待，避免产生大量空区块；
+// 主链末端因其他节点的区块变化时当前任务自动基于新的末端重新开始
+type Miner struct {
+	chain   *SharedChain
+	onBlock func(*Block) // 挖出区块后调用，用于向其他节点广播
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	stats  MinerStats
+}
+
+// NewMiner 创建后台挖矿，onBlock可以为nil
+func NewMiner(chain *SharedChain, onBlock func(*Block)) *Miner {
+	return &Miner{chain: chain, onBlock: onBlock}
+}
+
+// Start 开始后台挖矿，address为接收挖矿奖励的钱包地址，为空时不产生奖励
+func (m *Miner) Start(address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		return ErrMinerRunning
+	}
+	var minerAddress []byte
+	if address != "" {
+		minerAddress = util.AddressToPublicHash([]byte(address))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	m.stats = MinerStats{Running: true, Address: address}
+	go m.run(ctx, minerAddress, m.done)
+	util.Info("后台挖矿已启动")
+	return nil
+}
+
+// Stop 停止后台挖矿并等待当前任务退出，没有运行时直接返回
+func (m *Miner) Stop() {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.cancel, m.done = nil, nil
+	m.stats.Running = false
+	m.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+	util.Info("后台挖矿已停止")
+}
+
+// Stats 获取后台挖矿的运行状态
+func (m *Miner) Stats() MinerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+func (m *Miner) run(ctx context.Context, minerAddress []byte, done chan struct{}) {
+	defer close(done)
+	for {
+		if GetMempool().Count() > 0 {
+			block, result, err := m.chain.Mine(ctx, minerAddress)
+			if err == nil {
+				m.mu.Lock()
+				m.stats.Blocks++
+				m.stats.Hashes += result.Hashes
+				m.stats.HashRate = result.HashRate()
+				m.mu.Unlock()
+				util.Info(fmt.Sprintf("挖出区块%x，计算%d次哈希，算力%.0f H/s", block.Hash, result.Hashes, result.HashRate()))
+				if m.onBlock != nil {
+					m.onBlock(block)
+				}
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// PoA未轮到本节点时等待其他节点出块
+			if !errors.Is(err, ErrNotInTurn) {
+				util.Err(err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(util.MinerPollInterval):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"sync"
+	"time"
+)
+
+// PoA未能签名的原因
+var (
+	ErrNotAuthority = errors.New("钱包不在授权列表中")
+	ErrNotInTurn    = errors.New("轮到签名的授权钱包不在本节点")
+)
+
+// PoA 权威证明
+// 联盟中的参与方身份已知，只有授权的钱包可以产生区块，无需计算工作量。
+// 授权钱包按顺序轮流出块，高度为h的区块必须由Authorities[h%len(Authorities)]签名；
+// 每个区块的工作量都记为1，分叉时选择最长的分支
+type PoA struct {
+	Authorities [][]byte // 授权钱包的公钥哈希，按轮换顺序排列
+
+	mu      sync.RWMutex
+	signers map[string]ecdsa.PrivateKey // 本节点持有私钥的授权钱包，以公钥哈希的十六进制为键
+}
+
+// NewPoA 创建权威证明引擎，authorities为按轮换顺序排列的授权钱包地址
+func NewPoA(authorities []string) (*PoA, error) {
+	poa := &PoA{signers: make(map[string]ecdsa.PrivateKey)}
+	for _, address := range authorities {
+		if !util.ValidateAddress([]byte(address)) {
+			return nil, fmt.Errorf("授权钱包地址%s无效", address)
+		}
+		poa.Authorities = append(poa.Authorities, util.AddressToPublicHash([]byte(address)))
+	}
+	return poa, nil
+}
+
+// Name 共识引擎的名称
+func (poa *PoA) Name() string {
+	return "poa"
+}
+
+// AddSigner 加入本节点持有的授权钱包私钥，轮到该钱包时由本节点签名出块
+func (poa *PoA) AddSigner(privKey ecdsa.PrivateKey) error {
+	pubKeyHash := util.PublicKeyHash(util.PublicKeyBytes(&privKey.PublicKey))
+	if !poa.isAuthority(pubKeyHash) {
+		return fmt.Errorf("%w: %s", ErrNotAuthority, util.PublicHashToAddress(pubKeyHash))
+	}
+	poa.mu.Lock()
+	defer poa.mu.Unlock()
+	poa.signers[hex.EncodeToString(pubKeyHash)] = privKey
+	return nil
+}
+
+func (poa *PoA) isAuthority(pubKeyHash []byte) bool {
+	for _, authority := range poa.Authorities {
+		if bytes.Equal(authority, pubKeyHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// InTurn 获取高度为height的区块应当由哪个授权钱包签名，返回其公钥哈希
+func (poa *PoA) InTurn(height int64) []byte {
+	if len(poa.Authorities) == 0 {
+		return nil
+	}
+	return poa.Authorities[height%int64(len(poa.Authorities))]
+}
+
+// Prepare PoA区块不使用目标值和nonce
+func (poa *PoA) Prepare(txn *badger.Txn, b *Block) error {
+	b.Target = nil
+	b.Nonce = 0
+	return nil
+}
+
+// Seal 由轮到的授权钱包对区块哈希签名，该钱包的私钥不在本节点时返回ErrNotInTurn
+func (poa *PoA) Seal(ctx context.Context, b *Block) (*SealResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	inTurn := poa.InTurn(b.Height)
+	poa.mu.RLock()
+	privKey, ok := poa.signers[hex.EncodeToString(inTurn)]
+	poa.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: 高度%d由%s签名", ErrNotInTurn, b.Height, util.PublicHashToAddress(inTurn))
+	}
+
+	b.Signer = util.PublicKeyBytes(&privKey.PublicKey)
+	b.SetHash()
+	signature, err := trade.Sign(b.Hash, privKey)
+	if err != nil {
+		return nil, err
+	}
+	b.Signature = signature
+	return &SealResult{Duration: time.Since(start)}, nil
+}
+
+// VerifySeal 验证区块由轮到的授权钱包签名，且签名覆盖了区块的全部内容
+func (poa *PoA) VerifySeal(txn *badger.Txn, b *Block) error {
+	if len(b.Target) != 0 || b.Nonce != 0 {
+		return fmt.Errorf("%w: PoA区块%x不应包含目标值和nonce", ErrInvalidSeal, b.Hash)
+	}
+	inTurn := poa.InTurn(b.Height)
+	if inTurn == nil {
+		return fmt.Errorf("%w: 没有配置授权钱包", ErrInvalidSeal)
+	}
+	if !bytes.Equal(util.PublicKeyHash(b.Signer), inTurn) {
+		return fmt.Errorf("%w: 区块%x应由%s签名", ErrInvalidSeal, b.Hash, util.PublicHashToAddress(inTurn))
+	}
+	if !b.hashMatches() {
+		return fmt.Errorf("%w: 区块%x的哈希与内容不一致", ErrInvalidSeal, b.Hash)
+	}
+	if !trade.Verify(b.Hash, b.Signer, b.Signature) {
+		return fmt.Errorf("%w: 区块%x的签名无效", ErrInvalidSeal, b.Hash)
+	}
+	return nil
+}
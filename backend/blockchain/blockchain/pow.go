@@ -3,83 +3,244 @@ package blockchain
 import (
 	"blockchain/util"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// GetTarget 获取区块的目标值
-func (b *Block) GetTarget() []byte {
+// difficultyTarget 获取难度对应的目标值，即哈希前difficulty位为0
+func difficultyTarget(difficulty int) *big.Int {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-util.Difficulty))
-	return target.Bytes()
+	return target.Lsh(target, uint(256-difficulty))
 }
 
-// GetBase4Nonce 根据给定nonce生成基础数据用于计算哈希
-func (b *Block) GetBase4Nonce(nonce int64) []byte {
-	// time和nonce应当先转换为字节切片,否则无法join
-	var timeBuf bytes.Buffer
-	var nonceBuf bytes.Buffer
+// InitialTarget 获取创世区块及第一个调整周期使用的目标值
+func InitialTarget() []byte {
+	return difficultyTarget(util.Difficulty).Bytes()
+}
 
-	err := binary.Write(&timeBuf, binary.BigEndian, b.Time.Unix())
+// requiredTarget 在事务中计算接在prevHash之后、高度为height的区块按共识规则必须使用的目标值
+// 高度为RetargetInterval整数倍的区块根据前RetargetInterval个区块的实际出块时间调整目标值，
+// 其余区块沿用前一个区块的目标值。祖先区块沿PrevHash查找，侧链区块按自身所在的分支计算
+func requiredTarget(txn *badger.Txn, prevHash []byte, height int64) ([]byte, error) {
+	if height == 0 {
+		return InitialTarget(), nil
+	}
+	prev, err := getBlockHeader(txn, prevHash)
 	if err != nil {
-		util.Err(errors.New("时间写入失败"))
-		return nil
+		return nil, err
+	}
+	if height%util.RetargetInterval != 0 {
+		return prev.Target, nil
 	}
 
-	err = binary.Write(&nonceBuf, binary.BigEndian, nonce)
-	if err != nil {
-		util.Err(errors.New("nonce写入失败"))
-		return nil
+	// 周期内第一个区块到最后一个区块之间共有RetargetInterval-1个出块间隔
+	first := prev
+	for i := 1; i < util.RetargetInterval; i++ {
+		if first, err = getBlockHeader(txn, first.PrevHash); err != nil {
+			return nil, err
+		}
+	}
+	expected := int64(util.RetargetInterval-1) * util.TargetBlockTime
+	actual := prev.Time.Unix() - first.Time.Unix()
+	if actual < expected/util.MaxRetargetFactor {
+		actual = expected / util.MaxRetargetFactor
+	}
+	if actual > expected*util.MaxRetargetFactor {
+		actual = expected * util.MaxRetargetFactor
 	}
 
-	buf := []byte{}
-	tradeIDs := make([][]byte, 0)
-	for _, t := range b.TradeList {
-		tradeIDs = append(tradeIDs, t.ID)
+	// 出块比预期快时目标值变小，难度上升；反之难度下降
+	target := new(big.Int).SetBytes(prev.Target)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if limit := difficultyTarget(util.MinDifficulty); target.Cmp(limit) > 0 {
+		target = limit
 	}
-	for _, tradeID := range tradeIDs {
-		buf = append(buf, tradeID...)
+	if target.Sign() == 0 {
+		target.SetInt64(1)
 	}
+	return target.Bytes(), nil
+}
+
+// RequiredTarget 计算接在prevHash之后、高度为height的区块必须使用的目标值
+func (blockChain *BlockChain) RequiredTarget(prevHash []byte, height int64) ([]byte, error) {
+	var target []byte
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		target, err = requiredTarget(txn, prevHash, height)
+		return err
+	})
+	return target, err
+}
+
+// GetBase4Nonce 根据给定nonce生成基础数据用于计算哈希
+func (b *Block) GetBase4Nonce(nonce int64) []byte {
+	// time、nonce和高度按8字节大端序写入
+	var timeBuf, nonceBuf, heightBuf [8]byte
+	binary.BigEndian.PutUint64(timeBuf[:], uint64(b.Time.Unix()))
+	binary.BigEndian.PutUint64(nonceBuf[:], uint64(nonce))
+	binary.BigEndian.PutUint64(heightBuf[:], uint64(b.Height))
 
 	data := bytes.Join([][]byte{
-		timeBuf.Bytes(),
+		timeBuf[:],
 		b.PrevHash,
-		nonceBuf.Bytes(),
+		nonceBuf[:],
 		b.Target,
-		buf,
+		heightBuf[:],
+		b.MerkleRoot,
 	},
 		[]byte{},
 	)
 	return data
 }
 
-// FindNonce 寻找有效nonce值
-func (b *Block) FindNonce() int64 {
+// nonceOffset nonce在GetBase4Nonce生成的数据中的位置，位于时间和PrevHash之后
+func (b *Block) nonceOffset() int {
+	return 8 + len(b.PrevHash)
+}
+
+// hashCheckInterval 搜索协程每计算这么多次哈希检查一次是否需要停止
+const hashCheckInterval = 4096
+
+// FindNonce 用workers个协程并行寻找有效nonce
+// nonce空间被均分为workers段，每个协程搜索其中一段，任一协程找到后其余协程随即停止；
+// ctx被取消时放弃搜索并返回ctx的错误
+func (b *Block) FindNonce(ctx context.Context, workers int) (int64, *SealResult, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	var hashes uint64
+	remaining := int32(workers)
+	found := make(chan int64, workers)
+	span := math.MaxInt64 / int64(workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		from, to := int64(i)*span, int64(i+1)*span
+		if i == workers-1 {
+			to = math.MaxInt64
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if nonce, ok := b.searchNonce(ctx, from, to, &hashes); ok {
+				found <- nonce
+			} else if ctx.Err() == nil && atomic.AddInt32(&remaining, -1) == 0 {
+				// 全部区间都已搜索完
+				found <- -1
+			}
+		}()
+	}
+
+	select {
+	case nonce := <-found:
+		cancel()
+		wg.Wait()
+		if nonce < 0 {
+			return 0, nil, ErrNonceExhausted
+		}
+		return nonce, &SealResult{atomic.LoadUint64(&hashes), time.Since(start)}, nil
+	case <-ctx.Done():
+		wg.Wait()
+		return 0, nil, ctx.Err()
+	}
+}
+
+// searchNonce 在[from, to)中寻找有效nonce，计算的哈希次数累加到hashes
+func (b *Block) searchNonce(ctx context.Context, from, to int64, hashes *uint64) (int64, bool) {
 	var intHash big.Int
 	var intTarget big.Int
-	var hash [32]byte
-	var nonce int64
-	nonce = 0
 	intTarget.SetBytes(b.Target)
+	// 只替换数据中的nonce部分，不必每次重新拼接
+	data := b.GetBase4Nonce(from)
+	offset := b.nonceOffset()
 
-	for nonce < math.MaxInt64 {
-		data := b.GetBase4Nonce(nonce)
-		hash = sha256.Sum256(data)
+	count := uint64(0)
+	defer func() { atomic.AddUint64(hashes, count) }()
+	for nonce := from; nonce < to; nonce++ {
+		if count%hashCheckInterval == 0 && ctx.Err() != nil {
+			return 0, false
+		}
+		binary.BigEndian.PutUint64(data[offset:], uint64(nonce))
+		hash := sha256.Sum256(data)
+		count++
 		intHash.SetBytes(hash[:])
 		if intHash.Cmp(&intTarget) == -1 {
-			break
-		} else {
-			nonce++
+			return nonce, true
 		}
 	}
-	return nonce
+	return 0, false
+}
+
+// PoW 工作量证明
+// 区块哈希需小于按难度调整规则计算出的目标值，分叉时选择累计工作量最大的分支
+type PoW struct {
+	Workers int // 寻找nonce的协程数，不大于0时使用GOMAXPROCS
+}
+
+// Name 共识引擎的名称
+func (pow *PoW) Name() string {
+	return "pow"
+}
+
+// Prepare 为候选区块填写按共识规则计算出的目标值
+func (pow *PoW) Prepare(txn *badger.Txn, b *Block) error {
+	target, err := requiredTarget(txn, b.PrevHash, b.Height)
+	if err != nil {
+		return err
+	}
+	b.Target = target
+	return nil
+}
+
+// Seal 寻找有效nonce并据此计算区块哈希
+func (pow *PoW) Seal(ctx context.Context, b *Block) (*SealResult, error) {
+	workers := pow.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	nonce, result, err := b.FindNonce(ctx, workers)
+	if err != nil {
+		return nil, err
+	}
+	b.Nonce = nonce
+	b.SetHash()
+	return result, nil
+}
+
+// VerifySeal 验证区块的PoW
+// 区块自带的目标值必须与按共识规则计算出的目标值一致，哈希还需与区块头一致并小于该目标值
+func (pow *PoW) VerifySeal(txn *badger.Txn, b *Block) error {
+	if !b.hashMatches() {
+		return fmt.Errorf("%w: 区块%x的哈希与内容不一致", ErrInvalidSeal, b.Hash)
+	}
+	required, err := requiredTarget(txn, b.PrevHash, b.Height)
+	if err != nil {
+		return err
+	}
+	if new(big.Int).SetBytes(b.Target).Cmp(new(big.Int).SetBytes(required)) != 0 {
+		return fmt.Errorf("%w: 区块%x的目标值%x与共识规则要求的%x不一致", ErrInvalidSeal, b.Hash, b.Target, required)
+	}
+	if !b.meetsTarget() {
+		return fmt.Errorf("%w: 区块%x的哈希未达到目标值", ErrInvalidSeal, b.Hash)
+	}
+	return nil
 }
 
-// ValidatePoW 验证PoW
-func (b *Block) ValidatePoW() bool {
+// meetsTarget 判断区块的哈希是否小于区块自带的目标值
+func (b *Block) meetsTarget() bool {
 	var intHash big.Int
 	var intTarget big.Int
 	var hash [32]byte
@@ -0,0 +1,75 @@
+package blockchain
+
+import (
+	"blockchain/util"
+	"github.com/dgraph-io/badger"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// storeHeaders 保存一个难度调整周期的区块头，目标值均为target，第一个与最后一个区块的时间相差span秒
+// 返回最后一个区块的哈希，其后的区块高度为RetargetInterval
+func storeHeaders(t *testing.T, chain *BlockChain, target *big.Int, span int64) []byte {
+	start := time.Unix(1700000000, 0)
+	var prevHash []byte
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		for i := int64(0); i < util.RetargetInterval; i++ {
+			h := BlockHeader{Time: start, Hash: []byte{0xbb, byte(i)}, PrevHash: prevHash, Target: target.Bytes(), Height: i}
+			if i == util.RetargetInterval-1 {
+				h.Time = start.Add(time.Duration(span) * time.Second)
+			}
+			if err := txn.Set(headerKey(h.Hash), h.Serialize()); err != nil {
+				return err
+			}
+			prevHash = h.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prevHash
+}
+
+func TestRequiredTargetClamping(t *testing.T) {
+	expected := int64(util.RetargetInterval-1) * util.TargetBlockTime
+	base := difficultyTarget(util.Difficulty)
+	scaled := func(num, den int64) *big.Int {
+		target := new(big.Int).Mul(base, big.NewInt(num))
+		return target.Div(target, big.NewInt(den))
+	}
+	tests := []struct {
+		name   string
+		prev   *big.Int // 周期内区块的目标值
+		span   int64    // 周期内的实际出块时间
+		height int64
+		want   *big.Int
+	}{
+		{"创世区块", base, expected, 0, base},
+		{"周期中间沿用前一个区块", base, 0, util.RetargetInterval - 1, base},
+		{"按期出块不调整", base, expected, util.RetargetInterval, base},
+		{"快一倍时目标值减半", base, expected / 2, util.RetargetInterval, scaled(1, 2)},
+		{"过快时最多缩小到四分之一", base, 0, util.RetargetInterval, scaled(expected/util.MaxRetargetFactor, expected)},
+		{"时间戳倒退按最快处理", base, -expected, util.RetargetInterval, scaled(expected/util.MaxRetargetFactor, expected)},
+		{"过慢时最多放大四倍", base, expected * 100, util.RetargetInterval, scaled(util.MaxRetargetFactor, 1)},
+		{"不超过最低难度", difficultyTarget(util.MinDifficulty + 1), expected * 100, util.RetargetInterval, difficultyTarget(util.MinDifficulty)},
+		{"目标值至少为1", big.NewInt(1), 0, util.RetargetInterval, big.NewInt(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := testChain(t)
+			prevHash := storeHeaders(t, chain, tt.prev, tt.span)
+			if tt.height < util.RetargetInterval {
+				prevHash = []byte{0xbb, byte(tt.height - 1)}
+			}
+			got, err := chain.RequiredTarget(prevHash, tt.height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if new(big.Int).SetBytes(got).Cmp(tt.want) != 0 {
+				t.Fatalf("目标值为%x，期望%x", got, tt.want.Bytes())
+			}
+		})
+	}
+}
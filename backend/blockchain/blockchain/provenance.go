@@ -0,0 +1,272 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"encoding/hex"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"time"
+)
+
+// ProvenanceNode 溯源图中的一笔交易及其所在的区块
+type ProvenanceNode struct {
+	Trade     *trade.Trade
+	BlockHash []byte
+	Height    int64
+	Time      time.Time
+}
+
+// ProvenanceEdge 溯源图中的一条边，From交易的第OutID个输出被To交易花费
+type ProvenanceEdge struct {
+	From  []byte
+	OutID int
+	To    []byte
+	Out   trade.TradeOut
+}
+
+// ProvenanceGraph 以一笔交易为起点的溯源图
+// 上游为起点交易的输入逐级追溯到的全部来源交易，下游为起点交易的输出逐级被花费的交易
+// 经过拆分和合并时按资产追踪：某一资产的批次只追溯同一资产的输入，只追踪同一资产的输出，
+// 交易中新发行的资产没有同资产的输入，改为追溯该交易的全部输入，即发行方投入的原料
+// 节点数达到util.MaxProvenanceNodes时停止扩展，Truncated为true
+type ProvenanceGraph struct {
+	Root      []byte
+	Nodes     []*ProvenanceNode
+	Edges     []ProvenanceEdge
+	Truncated bool
+}
+
+// provenanceBuilder 在同一事务中构建溯源图，读取过的交易和区块按哈希缓存
+type provenanceBuilder struct {
+	txn     *badger.Txn
+	graph   *ProvenanceGraph
+	nodes   map[string]*ProvenanceNode // 已读取的交易，不一定在溯源图中
+	inGraph map[string]bool
+	edges   map[string]bool
+	blocks  map[string]*Block
+}
+
+func newProvenanceBuilder(txn *badger.Txn, graph *ProvenanceGraph) *provenanceBuilder {
+	return &provenanceBuilder{
+		txn:     txn,
+		graph:   graph,
+		nodes:   make(map[string]*ProvenanceNode),
+		inGraph: make(map[string]bool),
+		edges:   make(map[string]bool),
+		blocks:  make(map[string]*Block),
+	}
+}
+
+// lineage 沿某一资产追踪的一笔交易，all为true时追踪交易涉及的全部资产
+type lineage struct {
+	node  *ProvenanceNode
+	asset string
+	all   bool
+}
+
+func (l lineage) key() string {
+	if l.all {
+		return hex.EncodeToString(l.node.Trade.ID) + "*"
+	}
+	return hex.EncodeToString(l.node.Trade.ID) + ":" + l.asset
+}
+
+// Provenance 构建主链上交易tradeID的溯源图
+// outID不小于0时只追踪该输出的资产，下游只追踪该输出；outID小于0时追踪整笔交易；downstream为false时只构建上游
+// 下游依赖花费索引，之前版本创建的数据库需先执行migratedb重建索引
+func (blockChain *BlockChain) Provenance(tradeID []byte, outID int, downstream bool) (*ProvenanceGraph, error) {
+	graph := &ProvenanceGraph{Root: tradeID}
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		b := newProvenanceBuilder(txn, graph)
+		root, err := b.node(tradeID)
+		if err != nil {
+			return err
+		}
+		if outID >= len(root.Trade.Outputs) {
+			return fmt.Errorf("%w: 交易%x没有第%d个输出", ErrTradeNotFound, tradeID, outID)
+		}
+		start := lineage{node: root, all: true}
+		if outID >= 0 {
+			start = lineage{node: root, asset: root.Trade.Outputs[outID].Asset}
+		}
+		if err := b.upstream(start); err != nil {
+			return err
+		}
+		if downstream {
+			return b.downstream(root, outID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return graph, nil
+}
+
+// load 读取交易及其所在的区块，不加入溯源图
+func (b *provenanceBuilder) load(tradeID []byte) (*ProvenanceNode, error) {
+	id := hex.EncodeToString(tradeID)
+	if n, ok := b.nodes[id]; ok {
+		return n, nil
+	}
+
+	item, err := b.txn.Get(tradeKey(tradeID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %x", notFound(err, ErrTradeNotFound), tradeID)
+	}
+	blockHash, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	block, ok := b.blocks[string(blockHash)]
+	if !ok {
+		if block, err = getBlock(b.txn, blockHash); err != nil {
+			return nil, err
+		}
+		b.blocks[string(blockHash)] = block
+	}
+	for _, t := range block.TradeList {
+		if hex.EncodeToString(t.ID) == id {
+			n := &ProvenanceNode{Trade: t, BlockHash: block.Hash, Height: block.Height, Time: block.Time}
+			b.nodes[id] = n
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: 区块%x中没有交易%x", ErrCorruptData, blockHash, tradeID)
+}
+
+// node 读取交易对应的节点，首次读取时加入溯源图
+func (b *provenanceBuilder) node(tradeID []byte) (*ProvenanceNode, error) {
+	n, err := b.load(tradeID)
+	if err != nil {
+		return nil, err
+	}
+	if id := hex.EncodeToString(tradeID); !b.inGraph[id] {
+		b.inGraph[id] = true
+		b.graph.Nodes = append(b.graph.Nodes, n)
+	}
+	return n, nil
+}
+
+// full 判断溯源图是否已达到节点数上限
+func (b *provenanceBuilder) full() bool {
+	if len(b.graph.Nodes) >= util.MaxProvenanceNodes {
+		b.graph.Truncated = true
+		return true
+	}
+	return false
+}
+
+// add 将交易加入溯源图，达到节点数上限时返回false
+func (b *provenanceBuilder) add(tradeID []byte) (*ProvenanceNode, bool, error) {
+	if !b.inGraph[hex.EncodeToString(tradeID)] && b.full() {
+		return nil, false, nil
+	}
+	n, err := b.node(tradeID)
+	return n, err == nil, err
+}
+
+// edge 记录一条边，同一输出被同一交易花费只记录一次
+func (b *provenanceBuilder) edge(from []byte, outID int, to []byte, out trade.TradeOut) {
+	key := fmt.Sprintf("%x:%d>%x", from, outID, to)
+	if !b.edges[key] {
+		b.edges[key] = true
+		b.graph.Edges = append(b.graph.Edges, ProvenanceEdge{from, outID, to, out})
+	}
+}
+
+// upstream 按广度优先逐级追溯交易的输入来源，直到初始订单或挖矿奖励交易
+// 每个来源交易沿被花费的输出的资产继续追溯
+func (b *provenanceBuilder) upstream(root lineage) error {
+	queue := []lineage{root}
+	visited := map[string]bool{root.key(): true}
+	for len(queue) > 0 {
+		l := queue[0]
+		queue = queue[1:]
+		t := l.node.Trade
+		if t.IsFirstTrade() {
+			continue
+		}
+
+		sources := make([]*ProvenanceNode, len(t.Inputs))
+		var follow []int
+		for i, in := range t.Inputs {
+			src, err := b.load(in.TradeID)
+			if err != nil {
+				return err
+			}
+			if in.OutID < 0 || in.OutID >= len(src.Trade.Outputs) {
+				return fmt.Errorf("%w: 交易%x引用的输出%x:%d不存在", ErrCorruptData, t.ID, in.TradeID, in.OutID)
+			}
+			sources[i] = src
+			if l.all || src.Trade.Outputs[in.OutID].Asset == l.asset {
+				follow = append(follow, i)
+			}
+		}
+		// 资产在该交易中发行，追溯发行方投入的全部输入
+		if len(follow) == 0 {
+			for i := range t.Inputs {
+				follow = append(follow, i)
+			}
+		}
+
+		for _, i := range follow {
+			in := t.Inputs[i]
+			src, ok, err := b.add(in.TradeID)
+			if err != nil || !ok {
+				return err
+			}
+			out := sources[i].Trade.Outputs[in.OutID]
+			b.edge(in.TradeID, in.OutID, t.ID, out)
+			next := lineage{node: src, asset: out.Asset}
+			if !visited[next.key()] {
+				visited[next.key()] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+// downstream 按广度优先逐级查找花费交易输出的交易，起点交易只追踪第outID个输出，outID小于0时追踪全部输出
+// 之后的交易只追踪与被花费的输出同一资产的输出
+func (b *provenanceBuilder) downstream(root *ProvenanceNode, outID int) error {
+	type pending struct {
+		lineage
+		outID int
+	}
+	queue := []pending{{lineage{node: root, all: true}, outID}}
+	visited := make(map[string]bool)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for i, out := range p.node.Trade.Outputs {
+			if (p.outID >= 0 && i != p.outID) || (!p.all && out.Asset != p.asset) {
+				continue
+			}
+			item, err := b.txn.Get(spendKey(p.node.Trade.ID, i))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			spenderID, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			spender, ok, err := b.add(spenderID)
+			if err != nil || !ok {
+				return err
+			}
+			b.edge(p.node.Trade.ID, i, spenderID, out)
+			next := lineage{node: spender, asset: out.Asset}
+			if !visited[next.key()] {
+				visited[next.key()] = true
+				queue = append(queue, pending{next, -1})
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,482 @@
+package blockchain
+
+import (
+	"blockchain/codec"
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"strings"
+	"sync"
+)
+
+var (
+	identityPrefix     = []byte("id-")     // 身份登记的键前缀，以公钥哈希为键
+	identityUndoPrefix = []byte("idundo-") // 区块回滚身份登记所需数据的键前缀
+)
+
+// 身份登记与流转规则相关的错误
+var (
+	ErrIdentityNotFound = errors.New("地址没有在链上登记身份")
+	ErrFlowViolation    = errors.New("交易违反供应链流转规则")
+	ErrNotRegistrar     = errors.New("签名者无权登记该地址")
+)
+
+// IdentityRecord 链上登记的身份
+type IdentityRecord struct {
+	Identity util.Identity
+	Name     string
+	TradeID  []byte // 最近一次登记交易的ID
+	Owner    []byte // 地址所属一方的公钥哈希，继承身份的地址与签名者属于同一方；为空时属于地址自身
+}
+
+// identityVersion 身份记录编码的版本号，版本2增加了Owner，版本1的记录仍可解析
+const identityVersion byte = 2
+
+func (rec *IdentityRecord) encode(w *codec.Writer) {
+	w.WriteString(string(rec.Identity))
+	w.WriteString(rec.Name)
+	w.WriteBytes(rec.TradeID)
+	w.WriteBytes(rec.Owner)
+}
+
+func decodeIdentityRecord(r *codec.Reader, version byte) *IdentityRecord {
+	rec := &IdentityRecord{
+		Identity: util.Identity(r.ReadString()),
+		Name:     r.ReadString(),
+		TradeID:  r.ReadBytes(),
+	}
+	if version >= 2 {
+		rec.Owner = r.ReadBytes()
+	}
+	return rec
+}
+
+// Serialize 序列化身份记录
+func (rec *IdentityRecord) Serialize() []byte {
+	var w codec.Writer
+	w.WriteVersion(identityVersion)
+	rec.encode(&w)
+	return w.Bytes()
+}
+
+// ParseIdentityRecord 解析序列化的身份记录
+func ParseIdentityRecord(data []byte) (*IdentityRecord, error) {
+	r := codec.NewReader(data)
+	version := r.ReadVersionUpTo(identityVersion)
+	rec := decodeIdentityRecord(r, version)
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("%w: 身份记录%v", ErrCorruptData, err)
+	}
+	return rec, nil
+}
+
+func identityKey(pubKeyHash []byte) []byte {
+	return append(append([]byte{}, identityPrefix...), pubKeyHash...)
+}
+
+func identityUndoKey(hash []byte) []byte {
+	return append(append([]byte{}, identityUndoPrefix...), hash...)
+}
+
+// getIdentity 在事务中读取地址登记的身份，未登记时返回ErrIdentityNotFound
+func getIdentity(txn *badger.Txn, pubKeyHash []byte) (*IdentityRecord, error) {
+	item, err := txn.Get(identityKey(pubKeyHash))
+	if err != nil {
+		return nil, notFound(err, ErrIdentityNotFound)
+	}
+	var rec *IdentityRecord
+	err = item.Value(func(val []byte) error {
+		rec, err = ParseIdentityRecord(val)
+		return err
+	})
+	return rec, err
+}
+
+// GetIdentity 获取地址在主链上登记的身份，未登记时返回ErrIdentityNotFound
+func (blockChain *BlockChain) GetIdentity(pubKeyHash []byte) (*IdentityRecord, error) {
+	var rec *IdentityRecord
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		rec, err = getIdentity(txn, pubKeyHash)
+		return err
+	})
+	return rec, err
+}
+
+// registrar 在事务中获取登记员的公钥哈希
+// 创建区块链的一方即联盟的登记员，也就是创世区块奖励的接收者
+func registrar(txn *badger.Txn) ([]byte, error) {
+	item, err := txn.Get(heightKey(0))
+	if err != nil {
+		return nil, notFound(err, ErrChainNotFound)
+	}
+	hash, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	genesis, err := getBlock(txn, hash)
+	if err != nil {
+		return nil, err
+	}
+	return genesisRegistrar(genesis), nil
+}
+
+// genesisRegistrar 从创世区块中取出登记员的公钥哈希
+func genesisRegistrar(genesis *Block) []byte {
+	if len(genesis.TradeList) == 0 || len(genesis.TradeList[0].Outputs) == 0 {
+		return nil
+	}
+	return genesis.TradeList[0].Outputs[0].HashPublicKey
+}
+
+// Registrar 获取登记员的公钥哈希
+func (blockChain *BlockChain) Registrar() ([]byte, error) {
+	var hash []byte
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		hash, err = registrar(txn)
+		return err
+	})
+	return hash, err
+}
+
+// verifyRegistration 在事务中验证登记交易，返回登记后地址所属的一方
+func verifyRegistration(txn *badger.Txn, t *trade.Trade, lookup identityLookup, owner ownerLookup) ([]byte, error) {
+	if err := t.VerifyRegistration(); err != nil {
+		return nil, fmt.Errorf("%w: 交易%x的%w", ErrTradeInvalid, t.ID, err)
+	}
+	registrarHash, err := registrar(txn)
+	if err != nil {
+		return nil, err
+	}
+	err = checkRegistrar(t.Registration, registrarHash, lookup)
+	if errors.Is(err, ErrNotRegistrar) {
+		return nil, fmt.Errorf("%w: 交易%x的%w", ErrTradeInvalid, t.ID, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return registrationOwner(t.Registration, registrarHash, owner)
+}
+
+// registrationOwner 登记后地址所属的一方：登记员登记的地址属于其自身，继承身份的地址与签名者属于同一方
+func registrationOwner(reg *trade.Registration, registrarHash []byte, owner ownerLookup) ([]byte, error) {
+	signer := util.PublicKeyHash(reg.Registrar)
+	if bytes.Equal(signer, registrarHash) {
+		return reg.PubKeyHash, nil
+	}
+	return owner(signer)
+}
+
+// ownerLookup 查询地址所属一方的公钥哈希，没有登记或不是继承身份的地址属于其自身
+type ownerLookup func(pubKeyHash []byte) ([]byte, error)
+
+// ownerInDB 在事务中查询地址所属的一方
+func ownerInDB(txn *badger.Txn) ownerLookup {
+	return func(pubKeyHash []byte) ([]byte, error) {
+		rec, err := getIdentity(txn, pubKeyHash)
+		if errors.Is(err, ErrIdentityNotFound) {
+			return pubKeyHash, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec.Owner) == 0 {
+			return pubKeyHash, nil
+		}
+		return rec.Owner, nil
+	}
+}
+
+// checkRegistrar 检查登记的签名者是否有权登记，无权时返回ErrNotRegistrar
+// 登记员即创建区块链的一方，可以登记任意地址；已登记的地址可以把尚未登记的地址登记为与自己相同的身份，
+// 分层确定性钱包以此为派生的地址继承身份
+func checkRegistrar(reg *trade.Registration, registrarHash []byte, lookup identityLookup) error {
+	signer := util.PublicKeyHash(reg.Registrar)
+	if bytes.Equal(signer, registrarHash) {
+		return nil
+	}
+	identity, ok, err := lookup(signer)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: 签名者%s既不是登记员也没有登记身份", ErrNotRegistrar, util.PublicHashToAddress(signer))
+	}
+	if reg.Identity != identity {
+		return fmt.Errorf("%w: 继承的身份%s与签名者的身份%s不同", ErrNotRegistrar, reg.Identity, identity)
+	}
+	if _, ok, err := lookup(reg.PubKeyHash); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("%w: 地址%s已登记身份，只有登记员可以修改", ErrNotRegistrar, util.PublicHashToAddress(reg.PubKeyHash))
+	}
+	return nil
+}
+
+// registryUndo 区块中的一次登记覆盖的旧记录，Old为nil表示此前没有登记
+type registryUndo struct {
+	PubKeyHash []byte
+	Old        *IdentityRecord
+}
+
+// updateRegistry 在事务中写入区块中的身份登记，被覆盖的记录保存为回滚数据
+func updateRegistry(txn *badger.Txn, block *Block) error {
+	var undo []registryUndo
+	var registrarHash []byte
+	for _, t := range block.TradeList {
+		if !t.IsRegistration() {
+			continue
+		}
+		if registrarHash == nil {
+			var err error
+			if registrarHash, err = registrar(txn); err != nil {
+				return err
+			}
+		}
+		reg := t.Registration
+		old, err := getIdentity(txn, reg.PubKeyHash)
+		if err != nil && !errors.Is(err, ErrIdentityNotFound) {
+			return err
+		}
+		owner, err := registrationOwner(reg, registrarHash, ownerInDB(txn))
+		if err != nil {
+			return err
+		}
+		undo = append(undo, registryUndo{reg.PubKeyHash, old})
+		rec := IdentityRecord{Identity: reg.Identity, Name: reg.Name, TradeID: t.ID}
+		if !bytes.Equal(owner, reg.PubKeyHash) {
+			rec.Owner = owner
+		}
+		if err := txn.Set(identityKey(reg.PubKeyHash), rec.Serialize()); err != nil {
+			return err
+		}
+	}
+	if len(undo) == 0 {
+		return nil
+	}
+	return txn.Set(identityUndoKey(block.Hash), serializeRegistryUndo(undo))
+}
+
+// rollbackRegistry 在事务中撤销区块中的身份登记
+func rollbackRegistry(txn *badger.Txn, block *Block) error {
+	item, err := txn.Get(identityUndoKey(block.Hash))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var undo []registryUndo
+	err = item.Value(func(val []byte) error {
+		undo, err = parseRegistryUndo(val)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// 同一区块可能多次登记同一地址，按相反顺序恢复
+	for i := len(undo) - 1; i >= 0; i-- {
+		key := identityKey(undo[i].PubKeyHash)
+		if undo[i].Old == nil {
+			err = txn.Delete(key)
+		} else {
+			err = txn.Set(key, undo[i].Old.Serialize())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Delete(identityUndoKey(block.Hash))
+}
+
+// serializeRegistryUndo 序列化身份登记的回滚数据
+// 版本号 | 个数 | 各登记的公钥哈希、是否有旧记录和旧记录
+func serializeRegistryUndo(undo []registryUndo) []byte {
+	var w codec.Writer
+	w.WriteVersion(identityVersion)
+	w.WriteInt(int64(len(undo)))
+	for _, u := range undo {
+		w.WriteBytes(u.PubKeyHash)
+		w.WriteBool(u.Old != nil)
+		if u.Old != nil {
+			u.Old.encode(&w)
+		}
+	}
+	return w.Bytes()
+}
+
+// parseRegistryUndo 解析身份登记的回滚数据
+func parseRegistryUndo(data []byte) ([]registryUndo, error) {
+	r := codec.NewReader(data)
+	version := r.ReadVersionUpTo(identityVersion)
+	undo := make([]registryUndo, r.ReadCount(8+1))
+	for i := range undo {
+		undo[i].PubKeyHash = r.ReadBytes()
+		if r.ReadBool() {
+			undo[i].Old = decodeIdentityRecord(r, version)
+		}
+	}
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("%w: 身份登记回滚数据%v", ErrCorruptData, err)
+	}
+	return undo, nil
+}
+
+// FlowPolicy 供应链角色之间允许的转账方向
+// 键为付款方身份，值为允许的收款方身份；为nil时不限制转账方向
+type FlowPolicy map[util.Identity][]util.Identity
+
+// ParseFlowPolicy 解析以逗号分隔的“付款方身份>收款方身份”，如"Raw>Producer,Producer>Dealer"
+// 空字符串表示不限制转账方向
+func ParseFlowPolicy(s string) (FlowPolicy, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	policy := make(FlowPolicy)
+	for _, rule := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(rule), ">")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("流转规则%s格式错误，应为付款方身份>收款方身份", rule)
+		}
+		from, to := util.Identity(parts[0]), util.Identity(parts[1])
+		if !from.Valid() || !to.Valid() {
+			return nil, fmt.Errorf("流转规则%s包含未知的身份", rule)
+		}
+		policy[from] = append(policy[from], to)
+	}
+	return policy, nil
+}
+
+// Allows 判断是否允许从from身份转账到to身份
+func (p FlowPolicy) Allows(from, to util.Identity) bool {
+	for _, allowed := range p[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// identityLookup 查询地址登记的身份，未登记时返回false
+type identityLookup func(pubKeyHash []byte) (util.Identity, bool, error)
+
+// flowSender 一种资产在交易中的付款方
+type flowSender struct {
+	identity util.Identity
+	owners   map[string]bool // 付款方所属的一方，以公钥哈希的十六进制为键
+}
+
+// checkFlow 检查交易是否符合流转规则，spent为各输入花费的输出，违反时返回ErrFlowViolation
+// 每种资产分别检查：持有该资产输入的付款方必须属于同一个已登记的身份，新发行的资产以发行方为付款方；
+// 转给付款方所属一方地址的输出视为找零，不受限制，如分层确定性钱包继承身份的找零地址；
+// 其余输出的收款方必须已登记，且付款方身份到收款方身份的流转被允许
+// 多方交换资产时，每个方向的流转都需要被允许
+func (p FlowPolicy) checkFlow(t *trade.Trade, spent []trade.TradeOut, lookup identityLookup, owner ownerLookup) error {
+	if p == nil || len(t.Inputs) == 0 {
+		return nil
+	}
+
+	// identityOf 查询付款方或收款方的身份，role用于错误信息
+	identityOf := func(pubKeyHash []byte, role string) (util.Identity, error) {
+		identity, ok, err := lookup(pubKeyHash)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("%w: %s%s没有登记身份", ErrFlowViolation, role, util.PublicHashToAddress(pubKeyHash))
+		}
+		return identity, nil
+	}
+
+	senders := make(map[string]*flowSender)
+	for i, in := range t.Inputs {
+		pubKeyHash := util.PublicKeyHash(in.PublicKey)
+		identity, err := identityOf(pubKeyHash, "付款方")
+		if err != nil {
+			return err
+		}
+		sender, ok := senders[spent[i].Asset]
+		if !ok {
+			sender = &flowSender{identity, make(map[string]bool)}
+			senders[spent[i].Asset] = sender
+		}
+		if identity != sender.identity {
+			return fmt.Errorf("%w: %s的输入分属%s和%s", ErrFlowViolation, assetName(spent[i].Asset), sender.identity, identity)
+		}
+		party, err := owner(pubKeyHash)
+		if err != nil {
+			return err
+		}
+		sender.owners[hex.EncodeToString(party)] = true
+	}
+
+	for _, out := range t.Outputs {
+		sender, ok := senders[out.Asset]
+		if !ok {
+			issuer, _, err := trade.ParseAssetID(out.Asset)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrFlowViolation, err)
+			}
+			identity, err := identityOf(issuer, "发行方")
+			if err != nil {
+				return err
+			}
+			party, err := owner(issuer)
+			if err != nil {
+				return err
+			}
+			sender = &flowSender{identity, map[string]bool{hex.EncodeToString(party): true}}
+			senders[out.Asset] = sender
+		}
+		party, err := owner(out.HashPublicKey)
+		if err != nil {
+			return err
+		}
+		if sender.owners[hex.EncodeToString(party)] {
+			continue
+		}
+		identity, err := identityOf(out.HashPublicKey, "收款方")
+		if err != nil {
+			return err
+		}
+		if !p.Allows(sender.identity, identity) {
+			return fmt.Errorf("%w: 不允许%s从%s转给%s", ErrFlowViolation, assetName(out.Asset), sender.identity, identity)
+		}
+	}
+	return nil
+}
+
+// assetName 用于错误信息的资产名称
+func assetName(asset string) string {
+	if asset == trade.NativeAsset {
+		return "原生商品"
+	}
+	return "资产" + asset
+}
+
+var (
+	flowPolicyMu sync.RWMutex
+	flowPolicy   FlowPolicy
+)
+
+// SetFlowPolicy 设置进程内使用的流转规则，需在打开区块链前调用，默认不限制转账方向
+// 流转规则是节点的本地策略，只决定哪些交易可以进入本节点的交易池和本节点挖出的区块，
+// 收到的区块和verifychain不检查流转规则，各节点的规则不同时不会互相拒绝区块
+func SetFlowPolicy(policy FlowPolicy) {
+	flowPolicyMu.Lock()
+	defer flowPolicyMu.Unlock()
+	flowPolicy = policy
+}
+
+// GetFlowPolicy 获取进程内使用的流转规则
+func GetFlowPolicy() FlowPolicy {
+	flowPolicyMu.RLock()
+	defer flowPolicyMu.RUnlock()
+	return flowPolicy
+}
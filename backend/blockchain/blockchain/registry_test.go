@@ -0,0 +1,112 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"testing"
+)
+
+func TestCheckRegistrar(t *testing.T) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, _ := util.GenNeKeyPair()
+		return &key
+	}
+	registrarKey, producerKey := newKey(), newKey()
+	registrarHash := util.PublicKeyHash(util.PublicKeyBytes(&registrarKey.PublicKey))
+	producer := util.PublicKeyHash(util.PublicKeyBytes(&producerKey.PublicKey))
+	registered := bytes.Repeat([]byte{0x03}, 20)
+	fresh := bytes.Repeat([]byte{0x04}, 20)
+	identities := map[string]util.Identity{string(producer): util.Producer, string(registered): util.Dealer}
+	lookup := func(pubKeyHash []byte) (util.Identity, bool, error) {
+		identity, ok := identities[string(pubKeyHash)]
+		return identity, ok, nil
+	}
+
+	tests := []struct {
+		name     string
+		key      *ecdsa.PrivateKey
+		target   []byte
+		identity util.Identity
+		ok       bool
+	}{
+		{"登记员登记新地址", registrarKey, fresh, util.Dealer, true},
+		{"登记员修改已登记的地址", registrarKey, registered, util.User, true},
+		{"继承自己的身份", producerKey, fresh, util.Producer, true},
+		{"继承其他身份", producerKey, fresh, util.Raw, false},
+		{"修改已登记的地址", producerKey, registered, util.Producer, false},
+		{"未登记的签名者", newKey(), fresh, util.Producer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg, err := trade.NewRegistration(tt.target, tt.identity, "", *tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkRegistrar(reg.Registration, registrarHash, lookup)
+			if tt.ok && err != nil {
+				t.Fatalf("期望通过，得到%v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrNotRegistrar) {
+				t.Fatalf("期望ErrNotRegistrar，得到%v", err)
+			}
+		})
+	}
+}
+
+func TestCheckFlowChangeToOwnParty(t *testing.T) {
+	policy, err := ParseFlowPolicy(util.DefaultFlowPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payerKey := util.GenNeKeyPair()
+	payer := util.PublicKeyHash(payerKey)
+	derived := bytes.Repeat([]byte{0x05}, 20)
+	otherProducer := bytes.Repeat([]byte{0x06}, 20)
+	dealer := bytes.Repeat([]byte{0x07}, 20)
+	identities := map[string]util.Identity{
+		string(payer): util.Producer, string(derived): util.Producer,
+		string(otherProducer): util.Producer, string(dealer): util.Dealer,
+	}
+	lookup := func(pubKeyHash []byte) (util.Identity, bool, error) {
+		identity, ok := identities[string(pubKeyHash)]
+		return identity, ok, nil
+	}
+	owner := func(pubKeyHash []byte) ([]byte, error) {
+		if bytes.Equal(pubKeyHash, derived) {
+			return payer, nil
+		}
+		return pubKeyHash, nil
+	}
+
+	tests := []struct {
+		name   string
+		change []byte
+		ok     bool
+	}{
+		{"找零给付款地址", payer, true},
+		{"找零给继承身份的地址", derived, true},
+		{"转给其他生产商", otherProducer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &trade.Trade{
+				Inputs: []trade.TradeIn{{TradeID: []byte{0x01}, PublicKey: payerKey}},
+				Outputs: []trade.TradeOut{
+					{Num: 60, HashPublicKey: dealer},
+					{Num: 40, HashPublicKey: tt.change},
+				},
+			}
+			spent := []trade.TradeOut{{Num: 100, HashPublicKey: payer}}
+			err := policy.checkFlow(tx, spent, lookup, owner)
+			if tt.ok && err != nil {
+				t.Fatalf("期望通过，得到%v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrFlowViolation) {
+				t.Fatalf("期望ErrFlowViolation，得到%v", err)
+			}
+		})
+	}
+}
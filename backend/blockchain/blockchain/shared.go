@@ -0,0 +1,130 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrChainClosed 共享的区块链已关闭
+var ErrChainClosed = errors.New("区块链已关闭")
+
+// SharedChain 进程内共享的区块链
+// badger同一时间只能被一个实例打开，HTTP服务和网络节点通过SharedChain访问同一个数据库，
+// 读操作可以并发进行，挖矿、添加区块等写操作互斥
+type SharedChain struct {
+	mu    sync.RWMutex
+	chain *BlockChain
+	tip   chan struct{} // 主链末端变化或区块链关闭时关闭并换成新的通道
+}
+
+// OpenSharedChain 打开本地区块链供进程内共享，不存在时创建一个空链
+func OpenSharedChain() (*SharedChain, error) {
+	chain, err := OpenBlockChain()
+	if err != nil {
+		return nil, err
+	}
+	return &SharedChain{chain: chain, tip: make(chan struct{})}, nil
+}
+
+// View 在读锁下访问区块链，fn中不能修改主链
+func (s *SharedChain) View(fn func(chain *BlockChain) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.chain == nil {
+		return ErrChainClosed
+	}
+	return fn(s.chain)
+}
+
+// Update 在写锁下访问区块链，挖矿、添加区块等会改变主链末端的操作使用
+// 主链末端发生变化时通知正在基于旧末端挖矿的任务
+func (s *SharedChain) Update(fn func(chain *BlockChain) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chain == nil {
+		return ErrChainClosed
+	}
+	lastHash := s.chain.LastHash
+	err := fn(s.chain)
+	if !bytes.Equal(lastHash, s.chain.LastHash) {
+		s.notifyTip()
+	}
+	return err
+}
+
+// notifyTip 关闭当前的通知通道，调用方需持有写锁
+func (s *SharedChain) notifyTip() {
+	close(s.tip)
+	s.tip = make(chan struct{})
+}
+
+// Mine 挖出一个接在主链末端之后的区块
+// 在读锁下组装候选区块，不持锁封装，再在写锁下接入主链，挖矿期间不阻塞其他请求；
+// 封装期间主链末端发生变化（如收到其他节点的区块）时放弃当前任务，基于新的末端重新开始。
+// ctx被取消时返回ctx的错误
+func (s *SharedChain) Mine(ctx context.Context, minerAddress []byte) (*Block, *SealResult, error) {
+	for {
+		var candidateBlock *Block
+		var tipChanged <-chan struct{}
+		err := s.View(func(chain *BlockChain) error {
+			if chain.IsEmpty() {
+				return ErrChainNotFound
+			}
+			tipChanged = s.tip
+			var err error
+			candidateBlock, err = chain.PrepareBlock(minerAddress)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		jobCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-tipChanged:
+				cancel()
+			case <-jobCtx.Done():
+			}
+		}()
+		result, err := GetConsensus().Seal(jobCtx, candidateBlock)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil || !errors.Is(err, context.Canceled) {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		stale := false
+		err = s.Update(func(chain *BlockChain) error {
+			if !bytes.Equal(chain.LastHash, candidateBlock.PrevHash) {
+				stale = true
+				return nil
+			}
+			return chain.connectMined(candidateBlock)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if !stale {
+			return candidateBlock, result, nil
+		}
+	}
+}
+
+// Close 等待进行中的操作结束后关闭数据库，之后的访问返回ErrChainClosed
+// 正在封装区块的挖矿任务随之停止
+func (s *SharedChain) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chain == nil {
+		return nil
+	}
+	err := s.chain.Database.Close()
+	s.chain = nil
+	s.notifyTip()
+	return err
+}
@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"sort"
+)
+
+// 防伪凭证的校验结论
+const (
+	TokenGenuine      = "genuine"      // 凭证引用的输出在主链上，且由有权的签发方签发
+	TokenForged       = "forged"       // 签名无效，凭证被伪造或篡改
+	TokenUnknown      = "unknown"      // 主链上没有凭证引用的输出
+	TokenUnauthorized = "unauthorized" // 签发方无权为该输出签发凭证
+)
+
+// TokenVerification 防伪凭证的校验结果
+type TokenVerification struct {
+	Status  string
+	Detail  string
+	Issuer  []byte         // 签发方的公钥哈希
+	Out     trade.TradeOut // 凭证引用的输出
+	Custody []ItemCustody  // 按时间顺序的经手记录
+	// Claimable 凭证引用单品时为true；可分割的数量会被拆分、合并，经手记录包含其后所有分支，无法判断凭证对应的商品是否被认领
+	Claimable bool
+	Claim     int // 单品第一次转入已登记为消费者的地址的经手在Custody中的下标，尚未被认领或不是单品时为-1
+}
+
+// VerifyToken 对照主链校验防伪凭证
+// 签发方须已登记为原料厂或生产商：凭证引用其他资产的输出时签发方须为该资产的发行方，引用原生商品的输出时须为该交易的付款方或该输出的收款方
+// 单品的经手记录从铸造开始，可分割的数量从凭证引用的输出开始，包含其后逐级花费的交易中同一资产的输出
+// 只有单品判断是否已被消费者认领，可分割数量的某个分支转给消费者并不说明凭证对应的商品已售出
+// 凭证的签名、引用的输出或签发方不符合要求时，Status说明原因，不返回错误
+func (blockChain *BlockChain) VerifyToken(token *trade.ProductToken) (*TokenVerification, error) {
+	result := &TokenVerification{Issuer: util.PublicKeyHash(token.PublicKey), Claim: -1}
+	if !token.Verify() {
+		result.Status, result.Detail = TokenForged, "凭证签名无效"
+		return result, nil
+	}
+
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		b := newProvenanceBuilder(txn, &ProvenanceGraph{})
+		root, err := b.node(token.TradeID)
+		if errors.Is(err, ErrTradeNotFound) {
+			result.Status, result.Detail = TokenUnknown, fmt.Sprintf("主链上没有交易%x", token.TradeID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if token.OutID < 0 || token.OutID >= len(root.Trade.Outputs) {
+			result.Status, result.Detail = TokenUnknown, fmt.Sprintf("交易%x没有第%d个输出", token.TradeID, token.OutID)
+			return nil
+		}
+		result.Out = root.Trade.Outputs[token.OutID]
+
+		if detail, err := checkTokenIssuer(txn, root.Trade, result.Out, result.Issuer); err != nil || detail != "" {
+			result.Status, result.Detail = TokenUnauthorized, detail
+			return err
+		}
+		result.Status = TokenGenuine
+
+		if !result.Out.IsItem() {
+			result.Custody, err = b.outputCustody(root, token.OutID)
+			return err
+		}
+		history, err := itemHistory(txn, result.Out.Serial)
+		if err != nil {
+			return err
+		}
+		result.Custody, result.Claimable = history.Custody, true
+		for i := range result.Custody {
+			rec, err := getIdentity(txn, result.Custody[i].Out.HashPublicKey)
+			if errors.Is(err, ErrIdentityNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if rec.Identity == util.User {
+				result.Claim = i
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// checkTokenIssuer 检查签发方是否有权为交易t的输出out签发凭证，无权时返回原因
+func checkTokenIssuer(txn *badger.Txn, t *trade.Trade, out trade.TradeOut, issuer []byte) (string, error) {
+	rec, err := getIdentity(txn, issuer)
+	if errors.Is(err, ErrIdentityNotFound) {
+		return fmt.Sprintf("签发方%s没有登记身份", util.PublicHashToAddress(issuer)), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if rec.Identity != util.Raw && rec.Identity != util.Producer {
+		return fmt.Sprintf("签发方%s登记为%s，不是原料厂或生产商", util.PublicHashToAddress(issuer), rec.Identity), nil
+	}
+
+	if out.Asset != trade.NativeAsset {
+		assetIssuer, _, err := trade.ParseAssetID(out.Asset)
+		if err != nil {
+			return err.Error(), nil
+		}
+		if !bytes.Equal(assetIssuer, issuer) {
+			return fmt.Sprintf("签发方%s不是%s的发行方", util.PublicHashToAddress(issuer), assetName(out.Asset)), nil
+		}
+		return "", nil
+	}
+	if bytes.Equal(out.HashPublicKey, issuer) {
+		return "", nil
+	}
+	for _, in := range t.Inputs {
+		if bytes.Equal(util.PublicKeyHash(in.PublicKey), issuer) {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("签发方%s既不是交易%x的付款方也不是该输出的收款方", util.PublicHashToAddress(issuer), t.ID), nil
+}
+
+// outputCustody 可分割数量的经手记录：交易root的第outID个输出，以及其后逐级花费的交易中同一资产的输出，按区块高度排列
+func (b *provenanceBuilder) outputCustody(root *ProvenanceNode, outID int) ([]ItemCustody, error) {
+	out := root.Trade.Outputs[outID]
+	custody := []ItemCustody{{root, outID, out}}
+	if err := b.downstream(root, outID); err != nil {
+		return nil, err
+	}
+	nodes := append([]*ProvenanceNode{}, b.graph.Nodes[1:]...)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Height < nodes[j].Height
+	})
+	for _, n := range nodes {
+		for i, o := range n.Trade.Outputs {
+			if o.Asset == out.Asset {
+				custody = append(custody, ItemCustody{n, i, o})
+			}
+		}
+	}
+	return custody, nil
+}
@@ -0,0 +1,326 @@
+package blockchain
+
+import (
+	"blockchain/codec"
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	utxoPrefix  = []byte("utxo-") // UTXO集合的键前缀
+	undoPrefix  = []byte("undo-") // 区块回滚数据的键前缀
+	utxoTipKey  = []byte("utxoh") // UTXO集合当前对应的区块哈希
+	utxoKeyTail = 4               // 键末尾存放output序号的字节数
+)
+
+// UTXOSet 未花费交易输出集合
+// 以独立的键前缀保存在数据库中，查询时无需遍历整条区块链
+type UTXOSet struct {
+	BlockChain *BlockChain
+}
+
+// UTXO 一个未花费的交易输出
+type UTXO struct {
+	TradeID []byte
+	OutID   int
+	Out     trade.TradeOut
+}
+
+// UTXOSet 获取区块链对应的UTXO集合
+func (blockChain *BlockChain) UTXOSet() UTXOSet {
+	return UTXOSet{blockChain}
+}
+
+// ownerPrefix 生成某个公钥哈希下全部UTXO的键前缀
+func ownerPrefix(pubKeyHash []byte) []byte {
+	prefix := append([]byte{}, utxoPrefix...)
+	prefix = append(prefix, byte(len(pubKeyHash)))
+	return append(prefix, pubKeyHash...)
+}
+
+// utxoKey 生成UTXO的键: 前缀 + 公钥哈希长度 + 公钥哈希 + 交易ID + output序号
+func utxoKey(pubKeyHash, tradeID []byte, outID int) []byte {
+	key := ownerPrefix(pubKeyHash)
+	key = append(key, tradeID...)
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], uint32(outID))
+	return append(key, idx[:]...)
+}
+
+// parseUTXOKey 从键中解析出交易ID和output序号
+func parseUTXOKey(key []byte, prefixLen int) ([]byte, int) {
+	tradeID := append([]byte{}, key[prefixLen:len(key)-utxoKeyTail]...)
+	outID := int(binary.BigEndian.Uint32(key[len(key)-utxoKeyTail:]))
+	return tradeID, outID
+}
+
+// Reindex 清空并从创世区块开始重放主链，重建UTXO集合、身份登记和回滚数据
+// 身份登记与UTXO集合在同一事务中随区块更新，二者一起重建
+func (u UTXOSet) Reindex() error {
+	db := u.BlockChain.Database
+	if err := db.DropPrefix(utxoPrefix, undoPrefix, identityPrefix, identityUndoPrefix); err != nil {
+		return err
+	}
+
+	hashes, err := u.BlockChain.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+	for i := len(hashes) - 1; i >= 0; i-- {
+		err := db.Update(func(txn *badger.Txn) error {
+			block, err := getBlock(txn, hashes[i])
+			if err != nil {
+				return err
+			}
+			if err := u.Update(txn, block); err != nil {
+				return err
+			}
+			return updateRegistry(txn, block)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update 在给定的数据库事务中根据新区块更新UTXO集合
+// 与区块写入处于同一事务，保证二者原子更新
+// 被花费的输出记录为回滚数据，主链重组时用于恢复
+func (u UTXOSet) Update(txn *badger.Txn, block *Block) error {
+	var spent []UTXO
+	for _, t := range block.TradeList {
+		if !t.IsFirstTrade() {
+			for _, in := range t.Inputs {
+				out, ok, err := findUTXO(txn, util.PublicKeyHash(in.PublicKey), in.TradeID, in.OutID)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("交易%x引用的输出%x:%d不存在或已被花费", t.ID, in.TradeID, in.OutID)
+				}
+				spent = append(spent, UTXO{in.TradeID, in.OutID, out})
+				if err := txn.Delete(utxoKey(out.HashPublicKey, in.TradeID, in.OutID)); err != nil {
+					return err
+				}
+			}
+		}
+		for outID, out := range t.Outputs {
+			key := utxoKey(out.HashPublicKey, t.ID, outID)
+			if err := txn.Set(key, out.Serialize()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := txn.Set(undoKey(block.Hash), serializeUTXOs(spent)); err != nil {
+		return err
+	}
+	return txn.Set(utxoTipKey, block.Hash)
+}
+
+// Rollback 在给定的数据库事务中撤销区块对UTXO集合的修改
+func (u UTXOSet) Rollback(txn *badger.Txn, block *Block) error {
+	item, err := txn.Get(undoKey(block.Hash))
+	if err != nil {
+		return fmt.Errorf("区块%x缺少回滚数据: %v", block.Hash, err)
+	}
+	var spent []UTXO
+	err = item.Value(func(val []byte) error {
+		spent, err = parseUTXOs(val)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(block.TradeList) - 1; i >= 0; i-- {
+		t := block.TradeList[i]
+		for outID, out := range t.Outputs {
+			if err := txn.Delete(utxoKey(out.HashPublicKey, t.ID, outID)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, utxo := range spent {
+		key := utxoKey(utxo.Out.HashPublicKey, utxo.TradeID, utxo.OutID)
+		if err := txn.Set(key, utxo.Out.Serialize()); err != nil {
+			return err
+		}
+	}
+	if err := txn.Delete(undoKey(block.Hash)); err != nil {
+		return err
+	}
+	return txn.Set(utxoTipKey, block.PrevHash)
+}
+
+// IsSynced 判断UTXO集合是否与区块链末端一致
+func (u UTXOSet) IsSynced() bool {
+	var tip []byte
+	err := u.BlockChain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoTipKey)
+		if err != nil {
+			return err
+		}
+		tip, err = item.ValueCopy(nil)
+		return err
+	})
+	return err == nil && bytes.Equal(tip, u.BlockChain.LastHash)
+}
+
+// FindUTXOs 按公钥哈希查找全部未花费输出
+func (u UTXOSet) FindUTXOs(pubKeyHash []byte) ([]UTXO, error) {
+	var utxos []UTXO
+	prefix := ownerPrefix(pubKeyHash)
+
+	err := u.BlockChain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			tradeID, outID := parseUTXOKey(item.Key(), len(prefix))
+			err := item.Value(func(val []byte) error {
+				out, err := trade.ParseTradeOut(val)
+				if err != nil {
+					return err
+				}
+				utxos = append(utxos, UTXO{tradeID, outID, out})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return utxos, nil
+}
+
+// FindUTXO 查找某个输入引用的未花费输出，不存在时返回false
+func (u UTXOSet) FindUTXO(pubKeyHash, tradeID []byte, outID int) (trade.TradeOut, bool, error) {
+	var out trade.TradeOut
+	found := false
+
+	err := u.BlockChain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		out, found, err = findUTXO(txn, pubKeyHash, tradeID, outID)
+		return err
+	})
+	return out, found, err
+}
+
+// findUTXO 在事务中查找未花费输出，可以读到同一事务中尚未提交的修改
+func findUTXO(txn *badger.Txn, pubKeyHash, tradeID []byte, outID int) (trade.TradeOut, bool, error) {
+	var out trade.TradeOut
+	item, err := txn.Get(utxoKey(pubKeyHash, tradeID, outID))
+	if err == badger.ErrKeyNotFound {
+		return out, false, nil
+	}
+	if err != nil {
+		return out, false, err
+	}
+	err = item.Value(func(val []byte) error {
+		out, err = trade.ParseTradeOut(val)
+		return err
+	})
+	return out, err == nil, err
+}
+
+// Balances 按资产编号汇总公钥哈希的余额，原生商品的余额以空字符串为键
+func (u UTXOSet) Balances(pubKeyHash []byte) (map[string]int, error) {
+	utxos, err := u.FindUTXOs(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]int)
+	for _, utxo := range utxos {
+		balances[utxo.Out.Asset] += utxo.Out.Num
+	}
+	return balances, nil
+}
+
+// FindSpendableOutputs 找到资产asset累计金额不小于amount的未花费输出，跳过单品和skip返回true的输出
+// skip为nil时不跳过，通常用于排除已被交易池中的交易花费的输出
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, asset string, amount int, skip func(tradeID []byte, outID int) bool) (int, map[string][]int, error) {
+	unspentOuts := make(map[string][]int)
+	accumulated := 0
+
+	utxos, err := u.FindUTXOs(pubKeyHash)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, utxo := range utxos {
+		if accumulated >= amount {
+			break
+		}
+		if utxo.Out.Asset != asset || utxo.Out.IsItem() || (skip != nil && skip(utxo.TradeID, utxo.OutID)) {
+			continue
+		}
+		tradeID := hex.EncodeToString(utxo.TradeID)
+		accumulated += utxo.Out.Num
+		unspentOuts[tradeID] = append(unspentOuts[tradeID], utxo.OutID)
+	}
+	return accumulated, unspentOuts, nil
+}
+
+// FindItem 查找公钥哈希持有的序列号为serial的单品，已被pool中的交易花费时视为不存在
+func (u UTXOSet) FindItem(pubKeyHash []byte, serial string, pool *Mempool) (UTXO, bool, error) {
+	utxos, err := u.FindUTXOs(pubKeyHash)
+	if err != nil {
+		return UTXO{}, false, err
+	}
+	for _, utxo := range utxos {
+		if utxo.Out.Serial == serial && (pool == nil || !pool.IsSpent(utxo.TradeID, utxo.OutID)) {
+			return utxo, true, nil
+		}
+	}
+	return UTXO{}, false, nil
+}
+
+func undoKey(hash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), hash...)
+}
+
+// serializeUTXOs 序列化回滚数据
+// 版本号 | 个数 | 各输出的交易ID、序号、输出的规范编码、资产编号和序列号
+func serializeUTXOs(utxos []UTXO) []byte {
+	var w codec.Writer
+	w.WriteVersion(trade.TradeVersion)
+	w.WriteInt(int64(len(utxos)))
+	for _, utxo := range utxos {
+		w.WriteBytes(utxo.TradeID)
+		w.WriteInt(int64(utxo.OutID))
+		utxo.Out.Encode(&w)
+		w.WriteString(utxo.Out.Asset)
+		w.WriteString(utxo.Out.Serial)
+	}
+	return w.Bytes()
+}
+
+// parseUTXOs 解析回滚数据
+func parseUTXOs(data []byte) ([]UTXO, error) {
+	r := codec.NewReader(data)
+	version := r.ReadVersionUpTo(trade.TradeVersion)
+	utxos := make([]UTXO, r.ReadCount(4*8))
+	for i := range utxos {
+		utxos[i] = UTXO{TradeID: r.ReadBytes(), OutID: int(r.ReadInt()), Out: trade.DecodeTradeOut(r)}
+		if version >= 4 {
+			utxos[i].Out.Asset = r.ReadString()
+		}
+		if version >= 5 {
+			utxos[i].Out.Serial = r.ReadString()
+		}
+	}
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("%w: 回滚数据%v", ErrCorruptData, err)
+	}
+	return utxos, nil
+}
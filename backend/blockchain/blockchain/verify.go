@@ -0,0 +1,233 @@
+package blockchain
+
+import (
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+)
+
+// 链校验的规则名称
+const (
+	RuleIndex     = "index"     // 主链高度索引连续，且最高的区块为链的末端
+	RuleHeight    = "height"    // 区块高度与所在位置一致
+	RulePrevHash  = "prevhash"  // PrevHash指向前一个区块
+	RuleTimestamp = "timestamp" // 时间戳不早于前一个区块
+	RuleHash      = "hash"      // 保存的哈希与重新计算的哈希一致
+	RuleTradeID   = "tradeid"   // 交易ID与重新计算的交易哈希一致
+	RuleMerkle    = "merkle"    // 默克尔根与交易列表一致
+	RuleSize      = "size"      // 除奖励交易以外的交易总字节数不超过util.MaxBlockSize
+	RuleSeal      = "seal"      // 共识证明有效，如PoW的哈希达到目标值、PoA由轮到的授权钱包签名
+	RuleGenesis   = "genesis"   // 创世区块只有一笔初始交易，金额不超过初始数量，且为期望的创世区块
+	RuleCoinbase  = "coinbase"  // 创世区块之后只有第一笔奖励交易可以不引用输出，且只包含原生商品、金额不超过奖励
+	RuleSignature = "signature" // 交易签名有效
+	RuleUTXO      = "utxo"      // 输入引用的输出存在、未被花费且属于签名者
+	RuleAmount    = "amount"    // 输出金额非负，原生商品的输入总额不小于输出总额，其他资产的输入总额不大于输出总额
+	RuleIssue     = "issue"     // 新发行的资产由已登记为原料厂或生产商的发行方签名
+	RuleItem      = "item"      // 单品的数量为1，序列号唯一，花费后原样转入一个输出
+	RuleRegister  = "register"  // 身份登记内容有效，由登记员签名或由已登记地址为未登记地址继承身份
+	RulePayload   = "payload"   // 交易携带的产品载荷有效
+)
+
+// chainReplay 校验主链时在内存中重放的状态
+type chainReplay struct {
+	utxos      map[string]trade.TradeOut
+	identities map[string]util.Identity // 已登记的身份，以公钥哈希的十六进制为键
+	items      map[string]bool          // 已铸造的单品序列号
+	registrar  []byte                   // 登记员的公钥哈希，即创世区块奖励的接收者
+}
+
+// lookup 查询已重放的身份登记
+func (state *chainReplay) lookup(pubKeyHash []byte) (util.Identity, bool, error) {
+	identity, ok := state.identities[hex.EncodeToString(pubKeyHash)]
+	return identity, ok, nil
+}
+
+// ChainViolation 链校验发现的违反规则的区块
+type ChainViolation struct {
+	Height int64  // 区块高度
+	Hash   []byte // 区块哈希
+	Rule   string // 违反的规则
+	Detail string // 具体原因
+}
+
+func (v *ChainViolation) Error() string {
+	return fmt.Sprintf("高度%d的区块%x违反规则%s: %s", v.Height, v.Hash, v.Rule, v.Detail)
+}
+
+// VerifyChain 从创世区块开始按高度逐个校验主链上的区块
+// UTXO和身份登记在内存中重放，不依赖也不修改数据库中的UTXO集合和身份登记
+// 返回校验通过的区块数；发现违规时返回*ChainViolation，描述第一个违反规则的区块
+func (blockChain *BlockChain) VerifyChain() (int64, error) {
+	var checked int64
+	err := blockChain.Database.View(func(txn *badger.Txn) error {
+		state := &chainReplay{
+			utxos:      make(map[string]trade.TradeOut),
+			identities: make(map[string]util.Identity),
+			items:      make(map[string]bool),
+		}
+		var prev *Block
+
+		for height := int64(0); ; height++ {
+			item, err := txn.Get(heightKey(height))
+			if err == badger.ErrKeyNotFound {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			hash, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			block, err := getBlock(txn, hash)
+			if err == badger.ErrKeyNotFound {
+				return &ChainViolation{height, hash, RuleIndex, "高度索引指向的区块不存在"}
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := verifyBlock(txn, block, prev, height, state); err != nil {
+				return err
+			}
+			prev = block
+			checked++
+		}
+
+		if prev == nil {
+			return nil
+		}
+		if !bytes.Equal(prev.Hash, blockChain.LastHash) {
+			return &ChainViolation{prev.Height, prev.Hash, RuleIndex, fmt.Sprintf("高度索引的末端与链末端%x不一致", blockChain.LastHash)}
+		}
+		return nil
+	})
+	return checked, err
+}
+
+// verifyBlock 校验单个区块，state为前序区块重放后的状态，校验通过后更新
+func verifyBlock(txn *badger.Txn, block, prev *Block, height int64, state *chainReplay) error {
+	violation := func(rule, detail string) error {
+		return &ChainViolation{height, block.Hash, rule, detail}
+	}
+
+	if block.Height != height {
+		return violation(RuleHeight, fmt.Sprintf("区块记录的高度为%d", block.Height))
+	}
+	if prev != nil {
+		if !bytes.Equal(block.PrevHash, prev.Hash) {
+			return violation(RulePrevHash, fmt.Sprintf("PrevHash为%x，前一个区块为%x", block.PrevHash, prev.Hash))
+		}
+		if block.Time.Before(prev.Time) {
+			return violation(RuleTimestamp, fmt.Sprintf("时间%s早于前一个区块的%s", block.Time, prev.Time))
+		}
+	}
+
+	recomputed := Block{BlockHeader: block.BlockHeader}
+	recomputed.SetHash()
+	if !bytes.Equal(recomputed.Hash, block.Hash) {
+		return violation(RuleHash, fmt.Sprintf("重新计算的哈希为%x", recomputed.Hash))
+	}
+	if !bytes.Equal(block.MerkleRoot, block.GetMerkleRoot()) {
+		return violation(RuleMerkle, "默克尔根与交易列表不一致")
+	}
+	if err := verifySeal(txn, block); err != nil {
+		return violation(RuleSeal, err.Error())
+	}
+	if err := verifyBlockSize(block); err != nil {
+		return violation(RuleSize, err.Error())
+	}
+
+	if prev == nil {
+		if err := verifyGenesis(block); err != nil {
+			return violation(RuleGenesis, err.Error())
+		}
+		state.registrar = genesisRegistrar(block)
+	}
+	fees := 0
+	for _, t := range block.TradeList {
+		// 交易ID决定其输出在UTXO集合中的键，创世交易的ID还决定创世区块哈希是否包含登记员
+		if !bytes.Equal(t.ID, t.ComputeID()) {
+			return violation(RuleTradeID, fmt.Sprintf("交易%x重新计算的ID为%x", t.ID, t.ComputeID()))
+		}
+		if t.IsRegistration() {
+			if err := t.VerifyRegistration(); err != nil {
+				return violation(RuleRegister, fmt.Sprintf("交易%x: %v", t.ID, err))
+			}
+			if err := checkRegistrar(t.Registration, state.registrar, state.lookup); err != nil {
+				return violation(RuleRegister, fmt.Sprintf("交易%x的%v", t.ID, err))
+			}
+			state.identities[hex.EncodeToString(t.Registration.PubKeyHash)] = t.Registration.Identity
+			continue
+		}
+		if t.Payload != nil {
+			if err := t.Payload.Validate(); err != nil {
+				return violation(RulePayload, fmt.Sprintf("交易%x: %v", t.ID, err))
+			}
+		}
+		if !t.IsFirstTrade() {
+			fee, rule, err := spendInputs(t, state)
+			if err != nil {
+				return violation(rule, err.Error())
+			}
+			fees += fee
+		}
+		for outID, out := range t.Outputs {
+			state.utxos[outPointKey(t.ID, outID)] = out
+		}
+	}
+	if prev != nil {
+		if err := verifyCoinbase(block, fees); err != nil {
+			return violation(RuleCoinbase, err.Error())
+		}
+	}
+	return nil
+}
+
+// spendInputs 校验交易并从state.utxos中移除其花费的输出，返回手续费，失败时返回违反的规则
+func spendInputs(t *trade.Trade, state *chainReplay) (int, string, error) {
+	var spent []trade.TradeOut
+	for _, in := range t.Inputs {
+		key := outPointKey(in.TradeID, in.OutID)
+		out, ok := state.utxos[key]
+		if !ok {
+			return 0, RuleUTXO, fmt.Errorf("交易%x引用的输出%x:%d不存在或已被花费", t.ID, in.TradeID, in.OutID)
+		}
+		if !bytes.Equal(util.PublicKeyHash(in.PublicKey), out.HashPublicKey) {
+			return 0, RuleUTXO, fmt.Errorf("交易%x引用的输出%x:%d不属于签名者", t.ID, in.TradeID, in.OutID)
+		}
+		spent = append(spent, out)
+		delete(state.utxos, key)
+	}
+	fee, err := checkAmounts(t, spent, state.lookup)
+	if errors.Is(err, ErrIssuanceDenied) {
+		return 0, RuleIssue, err
+	}
+	if err != nil {
+		return 0, RuleAmount, err
+	}
+	minted, err := checkItems(t, spent, state.lookup, func(serial string) (bool, error) {
+		return state.items[serial], nil
+	})
+	if errors.Is(err, ErrIssuanceDenied) {
+		return 0, RuleIssue, err
+	}
+	if err != nil {
+		return 0, RuleItem, err
+	}
+	if !t.Verify() {
+		return 0, RuleSignature, fmt.Errorf("交易%x签名无效", t.ID)
+	}
+	for _, serial := range minted {
+		state.items[serial] = true
+	}
+	return fee, "", nil
+}
+
+func outPointKey(tradeID []byte, outID int) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(tradeID), outID)
+}
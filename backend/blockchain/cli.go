@@ -0,0 +1,466 @@
+package main
+
+import (
+	"blockchain/blockchain"
+	"blockchain/network"
+	"blockchain/trade"
+	"blockchain/util"
+	"blockchain/wallet"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// CommandLine 命令行工具
+// 直接操作当前目录下files中的区块链数据
+type CommandLine struct{}
+
+// printUsage 打印用法
+func (cli *CommandLine) printUsage() {
+	fmt.Println("用法:")
+	fmt.Println("  reindexutxo [-files DIR] - 根据区块数据重建UTXO集合")
+	fmt.Println("  migratedb [-files DIR] - 将旧版本gob编码的区块数据库迁移为规范编码")
+	fmt.Println("  createwallet -identity ROLE [-ref NAME] [-files DIR] - 创建钱包，私钥用输入的口令加密")
+	fmt.Println("  createhdwallet -identity ROLE [-ref NAME] [-restore] [-files DIR] - 创建分层确定性钱包并显示助记词，-restore时从输入的助记词恢复")
+	fmt.Println("  newaddress -wallet ADDR [-change] [-files DIR] - 为分层确定性钱包派生新的收款或找零地址")
+	fmt.Println("  migratewallets [-files DIR] - 用输入的口令加密全部旧版本的明文钱包")
+	fmt.Println("  send -from ADDR -to ADDR -amount N [-fee N] [-des TEXT] [-miner ADDR] [-files DIR] - 转账并立即挖矿")
+	fmt.Println("  verifychain [-files DIR] - 从创世区块开始校验主链上的全部区块")
+	fmt.Println("  startnode -node ADDR [-peers ADDR,ADDR] [-files DIR] - 启动P2P节点，本地无区块链时从其他节点同步")
+}
+
+// validateArgs 检查参数数量
+func (cli *CommandLine) validateArgs() {
+	if len(os.Args) < 2 {
+		cli.printUsage()
+		os.Exit(1)
+	}
+}
+
+// reindexUTXO 重建UTXO集合
+func (cli *CommandLine) reindexUTXO() {
+	chain, err := blockchain.ContinueBlockChain()
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	defer chain.Database.Close()
+
+	utxoSet := chain.UTXOSet()
+	if err := utxoSet.Reindex(); err != nil {
+		util.Err(err)
+		return
+	}
+	util.Info(fmt.Sprintf("UTXO集合重建完成，当前区块: %x", chain.LastHash))
+}
+
+// migrateDB 迁移旧版本的区块数据库
+func (cli *CommandLine) migrateDB() {
+	migrated, err := blockchain.MigrateDatabase()
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	util.Info(fmt.Sprintf("数据库迁移完成，改写了%d个区块", migrated))
+	util.Info("迁移不会重新计算哈希，请执行verifychain检查，校验失败的区块链需在启动节点时加-reset重新生成")
+}
+
+// stdin 读取口令使用的标准输入
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase 提示并从标准输入读取一行口令
+func readPassphrase(prompt string) string {
+	fmt.Print(prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		util.Err(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// readNewPassphrase 读取两次口令并确认一致
+func readNewPassphrase() (string, bool) {
+	passphrase := readPassphrase("请输入口令: ")
+	if readPassphrase("请再次输入口令: ") != passphrase {
+		fmt.Println("两次输入的口令不一致")
+		return "", false
+	}
+	return passphrase, true
+}
+
+// setRef 记录钱包别名，rescan时先扫描钱包目录中新增的钱包文件
+func setRef(address, refname string, rescan bool) error {
+	refList, err := wallet.LoadRefList()
+	if err != nil {
+		return err
+	}
+	if rescan {
+		if err := refList.Update(); err != nil {
+			return err
+		}
+	}
+	refList.SetRef(address, refname)
+	return refList.Save()
+}
+
+// createWallet 创建加密钱包
+func (cli *CommandLine) createWallet(identity, refname string) {
+	passphrase, ok := readNewPassphrase()
+	if !ok {
+		return
+	}
+	w := wallet.NewWallet(util.Identity(identity))
+	if err := w.SaveWallet(passphrase); err != nil {
+		util.Err(err)
+		return
+	}
+	if err := setRef(string(w.Address()), refname, false); err != nil {
+		util.Err(err)
+		return
+	}
+	fmt.Printf("钱包地址: %s\n", w.Address())
+}
+
+// createHDWallet 创建或从助记词恢复分层确定性钱包
+func (cli *CommandLine) createHDWallet(identity, refname string, restore bool) {
+	lookahead := 1
+	var mnemonic string
+	if restore {
+		mnemonic = readPassphrase("请输入助记词: ")
+		lookahead = util.HDLookahead
+	} else {
+		var err error
+		if mnemonic, err = wallet.NewMnemonic(); err != nil {
+			util.Err(err)
+			return
+		}
+	}
+	passphrase, ok := readNewPassphrase()
+	if !ok {
+		return
+	}
+	hd, err := wallet.CreateHDWallet(mnemonic, util.Identity(identity), passphrase, lookahead)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	if err := setRef(hd.ID, refname, true); err != nil {
+		util.Err(err)
+		return
+	}
+	if !restore {
+		fmt.Printf("助记词: %s\n请妥善抄写保存，丢失后无法恢复钱包\n", mnemonic)
+	}
+	fmt.Printf("钱包地址: %s\n", hd.ID)
+}
+
+// newAddress 为分层确定性钱包派生新地址
+func (cli *CommandLine) newAddress(address string, change bool) {
+	hd, err := wallet.FindHDWallet(address)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	chain := wallet.ChainReceive
+	if change {
+		chain = wallet.ChainChange
+	}
+	w, err := hd.NewAddress(chain, readPassphrase("请输入口令: "))
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	if err := setRef(string(w.Address()), "", false); err != nil {
+		util.Err(err)
+		return
+	}
+	fmt.Printf("新地址: %s\n", w.Address())
+}
+
+// migrateWallets 加密旧版本的明文钱包
+func (cli *CommandLine) migrateWallets() {
+	passphrase, ok := readNewPassphrase()
+	if !ok {
+		return
+	}
+	migrated, err := wallet.MigrateWallets(passphrase)
+	util.Err(err)
+	fmt.Printf("已加密%d个钱包\n", migrated)
+}
+
+// send 解锁钱包转账，并立即挖出包含该交易的区块
+func (cli *CommandLine) send(from, to string, amount, fee int, des, miner string) {
+	if !util.ValidateAddress([]byte(to)) || (miner != "" && !util.ValidateAddress([]byte(miner))) {
+		fmt.Println("钱包地址无效")
+		return
+	}
+	passphrase := readPassphrase("请输入付款钱包的口令: ")
+	fromWallet, err := wallet.UnlockWallet(from, passphrase)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	others, err := wallet.OtherWallets(from, passphrase)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+
+	chain, err := blockchain.ContinueBlockChain()
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	defer chain.Database.Close()
+
+	// 设置了流转规则时只找零到已登记的地址，新派生的找零地址由付款方登记为相同身份，与转账打包进同一区块
+	var registered func([]byte) (bool, error)
+	if blockchain.GetFlowPolicy() != nil {
+		registered = func(pubKeyHash []byte) (bool, error) {
+			_, err := chain.GetIdentity(pubKeyHash)
+			if errors.Is(err, blockchain.ErrIdentityNotFound) {
+				return false, nil
+			}
+			return err == nil, err
+		}
+	}
+	changePubHash, unregistered, err := wallet.ChangeAddress(from, passphrase, registered)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	if rec, err := chain.GetIdentity(util.PublicKeyHash(fromWallet.PublicKey)); err == nil && unregistered != nil {
+		reg, err := trade.NewRegistration(unregistered, rec.Identity, rec.Name, fromWallet.PrivateKey)
+		if err != nil {
+			util.Err(err)
+			return
+		}
+		if err := blockchain.GetMempool().Add(chain, reg); err != nil {
+			util.Err(err)
+			return
+		}
+	}
+
+	leg := blockchain.TradeLeg{
+		From:      fromWallet.PublicKey,
+		Change:    changePubHash,
+		Transfers: []blockchain.Transfer{{To: util.AddressToPublicHash([]byte(to)), Amount: amount}},
+		Fee:       fee,
+		Key:       &fromWallet.PrivateKey,
+	}
+	for _, w := range others {
+		leg.Sources = append(leg.Sources, blockchain.TradeSource{PublicKey: w.PublicKey, Key: &w.PrivateKey})
+	}
+	t, err := chain.CreateTrade([]blockchain.TradeLeg{leg}, des, nil)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	if err := blockchain.GetMempool().Add(chain, t); err != nil {
+		util.Err(err)
+		return
+	}
+	var minerAddress []byte
+	if miner != "" {
+		minerAddress = util.AddressToPublicHash([]byte(miner))
+	}
+	block, result, err := chain.Mine(context.Background(), minerAddress)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	fmt.Printf("交易%x已打包进区块%x，计算%d次哈希，算力%.0f H/s\n", t.ID, block.Hash, result.Hashes, result.HashRate())
+}
+
+// verifyChain 校验整条主链，报告第一个违反规则的区块
+func (cli *CommandLine) verifyChain() {
+	chain, err := blockchain.ContinueBlockChain()
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	defer chain.Database.Close()
+
+	checked, err := chain.VerifyChain()
+	if err != nil {
+		util.Err(err)
+		fmt.Printf("校验未通过，此前%d个区块有效\n", checked)
+		return
+	}
+	fmt.Printf("校验通过，共%d个区块\n", checked)
+}
+
+// startNode 启动P2P节点
+// 启动时载入上次保存的交易池，收到退出信号时等待进行中的写操作结束，关闭区块链并保存交易池
+func (cli *CommandLine) startNode(address, peers string) {
+	var peerList []string
+	if peers != "" {
+		peerList = strings.Split(peers, ",")
+	}
+
+	chain, err := blockchain.OpenSharedChain()
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	util.Err(chain.View(func(chain *blockchain.BlockChain) error {
+		return blockchain.GetMempool().LoadFile(chain)
+	}))
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-quit
+		util.Err(chain.Close())
+		util.Err(blockchain.GetMempool().SaveFile())
+		util.Info("交易池已保存，节点退出")
+		os.Exit(0)
+	}()
+
+	util.Err(network.StartServer(address, peerList, chain))
+}
+
+// Run 解析并执行命令
+func (cli *CommandLine) Run() {
+	cli.validateArgs()
+
+	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	createHDWalletCmd := flag.NewFlagSet("createhdwallet", flag.ExitOnError)
+	newAddressCmd := flag.NewFlagSet("newaddress", flag.ExitOnError)
+	migrateWalletsCmd := flag.NewFlagSet("migratewallets", flag.ExitOnError)
+	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+
+	reindexFiles := reindexUTXOCmd.String("files", util.FilesDir, "数据文件目录")
+	migrateDBFiles := migrateDBCmd.String("files", util.FilesDir, "数据文件目录")
+	createWalletFiles := createWalletCmd.String("files", util.FilesDir, "数据文件目录")
+	createWalletIdentity := createWalletCmd.String("identity", "", "钱包身份: Raw, Producer, Dealer, User")
+	createWalletRef := createWalletCmd.String("ref", "", "钱包别名")
+	createHDWalletFiles := createHDWalletCmd.String("files", util.FilesDir, "数据文件目录")
+	createHDWalletIdentity := createHDWalletCmd.String("identity", "", "钱包身份: Raw, Producer, Dealer, User")
+	createHDWalletRef := createHDWalletCmd.String("ref", "", "钱包别名")
+	createHDWalletRestore := createHDWalletCmd.Bool("restore", false, "从助记词恢复钱包")
+	newAddressFiles := newAddressCmd.String("files", util.FilesDir, "数据文件目录")
+	newAddressWallet := newAddressCmd.String("wallet", "", "分层确定性钱包中的任一地址")
+	newAddressChange := newAddressCmd.Bool("change", false, "派生找零地址")
+	migrateFiles := migrateWalletsCmd.String("files", util.FilesDir, "数据文件目录")
+	sendFiles := sendCmd.String("files", util.FilesDir, "数据文件目录")
+	sendFrom := sendCmd.String("from", "", "付款钱包地址")
+	sendTo := sendCmd.String("to", "", "收款钱包地址")
+	sendAmount := sendCmd.Int("amount", 0, "转账数量")
+	sendFee := sendCmd.Int("fee", 0, "手续费")
+	sendDes := sendCmd.String("des", "", "交易描述")
+	sendMiner := sendCmd.String("miner", "", "接收挖矿奖励的钱包地址")
+	verifyFiles := verifyChainCmd.String("files", util.FilesDir, "数据文件目录")
+	nodeFiles := startNodeCmd.String("files", util.FilesDir, "数据文件目录")
+	nodeAddress := startNodeCmd.String("node", "", "本节点地址，如localhost:3000")
+	nodePeers := startNodeCmd.String("peers", "", "启动时连接的节点地址，以逗号分隔")
+
+	switch os.Args[1] {
+	case "reindexutxo":
+		err := reindexUTXOCmd.Parse(os.Args[2:])
+		util.Err(err)
+	case "migratedb":
+		err := migrateDBCmd.Parse(os.Args[2:])
+		util.Err(err)
+	case "createwallet":
+		err := createWalletCmd.Parse(os.Args[2:])
+		util.Err(err)
+	case "createhdwallet":
+		err := createHDWalletCmd.Parse(os.Args[2:])
+		util.Err(err)
+	case "newaddress":
+		err := newAddressCmd.Parse(os.Args[2:])
+		util.Err(err)
+	case "migratewallets":
+		err := migrateWalletsCmd.Parse(os.Args[2:])
+		util.Err(err)
+	case "send":
+		err := sendCmd.Parse(os.Args[2:])
+		util.Err(err)
+	case "verifychain":
+		err := verifyChainCmd.Parse(os.Args[2:])
+		util.Err(err)
+	case "startnode":
+		err := startNodeCmd.Parse(os.Args[2:])
+		util.Err(err)
+	default:
+		cli.printUsage()
+		os.Exit(1)
+	}
+
+	if reindexUTXOCmd.Parsed() {
+		util.Err(util.SetFilesDir(*reindexFiles))
+		cli.reindexUTXO()
+	}
+
+	if migrateDBCmd.Parsed() {
+		util.Err(util.SetFilesDir(*migrateDBFiles))
+		cli.migrateDB()
+	}
+
+	if createWalletCmd.Parsed() {
+		if *createWalletIdentity == "" {
+			createWalletCmd.Usage()
+			os.Exit(1)
+		}
+		util.Err(util.SetFilesDir(*createWalletFiles))
+		cli.createWallet(*createWalletIdentity, *createWalletRef)
+	}
+
+	if createHDWalletCmd.Parsed() {
+		if *createHDWalletIdentity == "" {
+			createHDWalletCmd.Usage()
+			os.Exit(1)
+		}
+		util.Err(util.SetFilesDir(*createHDWalletFiles))
+		cli.createHDWallet(*createHDWalletIdentity, *createHDWalletRef, *createHDWalletRestore)
+	}
+
+	if newAddressCmd.Parsed() {
+		if *newAddressWallet == "" {
+			newAddressCmd.Usage()
+			os.Exit(1)
+		}
+		util.Err(util.SetFilesDir(*newAddressFiles))
+		cli.newAddress(*newAddressWallet, *newAddressChange)
+	}
+
+	if migrateWalletsCmd.Parsed() {
+		util.Err(util.SetFilesDir(*migrateFiles))
+		cli.migrateWallets()
+	}
+
+	if sendCmd.Parsed() {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+			sendCmd.Usage()
+			os.Exit(1)
+		}
+		util.Err(util.SetFilesDir(*sendFiles))
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendDes, *sendMiner)
+	}
+
+	if verifyChainCmd.Parsed() {
+		util.Err(util.SetFilesDir(*verifyFiles))
+		cli.verifyChain()
+	}
+
+	if startNodeCmd.Parsed() {
+		if *nodeAddress == "" {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		util.Err(util.SetFilesDir(*nodeFiles))
+		cli.startNode(*nodeAddress, *nodePeers)
+	}
+}
@@ -0,0 +1,174 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// 规范的二进制编码
+// 整数一律为8字节大端序，字节串和字符串带8字节长度前缀，列表先写元素个数
+// 同一数据只有一种编码结果，可以直接用于计算哈希；解码时拒绝不完整或末尾有多余字节的数据
+
+var (
+	ErrTruncated = errors.New("编码数据不完整")
+	ErrTrailing  = errors.New("编码数据末尾有多余的字节")
+	ErrVersion   = errors.New("不支持的编码版本")
+	ErrMalformed = errors.New("编码数据格式错误")
+)
+
+// Writer 编码器
+type Writer struct {
+	buf bytes.Buffer
+}
+
+// WriteVersion 写入1字节的版本号
+func (w *Writer) WriteVersion(version byte) {
+	w.buf.WriteByte(version)
+}
+
+// WriteInt 写入定长整数
+func (w *Writer) WriteInt(n int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	w.buf.Write(b[:])
+}
+
+// WriteBool 写入1字节的布尔值，用于标记可选字段是否存在
+func (w *Writer) WriteBool(b bool) {
+	if b {
+		w.buf.WriteByte(1)
+	} else {
+		w.buf.WriteByte(0)
+	}
+}
+
+// WriteBytes 写入长度前缀和字节内容，nil与空字节串的编码相同
+func (w *Writer) WriteBytes(data []byte) {
+	w.WriteInt(int64(len(data)))
+	w.buf.Write(data)
+}
+
+// WriteString 写入长度前缀和字符串内容
+func (w *Writer) WriteString(s string) {
+	w.WriteInt(int64(len(s)))
+	w.buf.WriteString(s)
+}
+
+// Bytes 获取编码结果
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// Reader 解码器
+// 出错后后续读取均返回零值，解码结束时通过Err或Finish统一检查
+type Reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// NewReader 创建解码器
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data}
+}
+
+func (r *Reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data)-r.pos {
+		r.err = ErrTruncated
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// ReadVersion 读取版本号，与期望的版本不一致时记为错误
+func (r *Reader) ReadVersion(version byte) {
+	b := r.next(1)
+	if b != nil && b[0] != version {
+		r.err = ErrVersion
+	}
+}
+
+// ReadVersionUpTo 读取版本号，接受1到maxVersion之间的版本，返回读到的版本
+// 编码格式只增加字段时，解码方可以据此兼容旧版本的数据
+func (r *Reader) ReadVersionUpTo(maxVersion byte) byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	if b[0] < 1 || b[0] > maxVersion {
+		r.err = ErrVersion
+		return 0
+	}
+	return b[0]
+}
+
+// ReadInt 读取定长整数
+func (r *Reader) ReadInt() int64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// ReadBool 读取布尔值，取值不是0或1时记为错误
+func (r *Reader) ReadBool() bool {
+	b := r.next(1)
+	if b == nil {
+		return false
+	}
+	if b[0] > 1 {
+		r.err = ErrMalformed
+		return false
+	}
+	return b[0] == 1
+}
+
+// ReadCount 读取列表的元素个数，每个元素至少占minSize字节，超出剩余数据长度时记为错误
+// 避免按损坏数据中的巨大个数分配内存
+func (r *Reader) ReadCount(minSize int) int {
+	n := r.ReadInt()
+	if r.err == nil && (n < 0 || n > int64((len(r.data)-r.pos)/minSize)) {
+		r.err = ErrTruncated
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// ReadBytes 读取带长度前缀的字节串，返回副本，长度为0时返回nil
+func (r *Reader) ReadBytes() []byte {
+	n := r.ReadInt()
+	if r.err == nil && (n < 0 || n > int64(len(r.data)-r.pos)) {
+		r.err = ErrTruncated
+	}
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	return append([]byte(nil), r.next(int(n))...)
+}
+
+// ReadString 读取带长度前缀的字符串
+func (r *Reader) ReadString() string {
+	return string(r.ReadBytes())
+}
+
+// Err 获取解码过程中的第一个错误
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Finish 结束解码，数据没有被完整读取时返回ErrTrailing
+func (r *Reader) Finish() error {
+	if r.err == nil && r.pos != len(r.data) {
+		r.err = ErrTrailing
+	}
+	return r.err
+}
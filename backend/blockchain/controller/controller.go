@@ -1,126 +1,453 @@
 package main
 
 import (
+	"blockchain/blockchain"
+	"blockchain/network"
+	"blockchain/trade"
 	"blockchain/util"
+	"blockchain/wallet"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	port     = flag.String("port", "8081", "HTTP服务端口")
+	filesDir = flag.String("files", util.FilesDir, "数据文件目录，同一台机器上的多个节点需使用不同目录")
+	nodeAddr = flag.String("node", "", "P2P节点地址，如localhost:3000，为空时不启用节点网络")
+	peers    = flag.String("peers", "", "启动时连接的节点地址，以逗号分隔")
+	miner    = flag.String("miner", "", "默认接收挖矿奖励的钱包地址，为空时不产生奖励")
+	autoMine = flag.Bool("automine", false, "启动后在后台挖矿，交易池中有交易时自动打包")
+	engine   = flag.String("consensus", "pow", "共识引擎，pow或poa")
+	signers  = flag.String("authorities", "", "PoA按顺序轮流出块的授权钱包地址，以逗号分隔，为空时使用演示数据中的原料厂、生产商和经销商")
+	flows    = flag.String("flowpolicy", util.DefaultFlowPolicy, "供应链流转规则，以逗号分隔的付款方身份>收款方身份，只用于本节点的交易池和挖矿，为空时不限制转账方向")
+	genesis  = flag.String("genesis", "", "期望的创世区块哈希，指定后只接受并同步该创世区块，为空时接受本地创建的创世区块")
+	reset    = flag.Bool("reset", false, "启动前清空数据目录中的区块链、钱包和交易池，重新创建演示数据")
 )
 
 // 载入区块链服务
+// 服务运行期间一直持有打开的区块链，HTTP请求和P2P节点共用
+// 数据目录中已有的区块链、钱包和交易池在重启后保留，指定-reset时才清空
 func loadBlockChain() *Service {
-	util.CleanData()
-	s := Service{}
-	return &s
+	util.Err(util.SetFilesDir(*filesDir))
+	if *reset {
+		util.CleanData()
+	}
+	if *genesis != "" {
+		hash, err := hex.DecodeString(*genesis)
+		if err != nil {
+			util.Err(fmt.Errorf("%w: -genesis %v", ErrInvalidHash, err))
+			os.Exit(1)
+		}
+		blockchain.SetGenesisHash(hash)
+	}
+	s, err := NewService(*miner)
+	if err != nil {
+		util.Err(err)
+		os.Exit(1)
+	}
+	if err := s.chain.View((*blockchain.BlockChain).CheckGenesis); err != nil {
+		util.Err(err)
+		os.Exit(1)
+	}
+	var authorities []string
+	if *signers != "" {
+		authorities = strings.Split(*signers, ",")
+	}
+	if err := s.UseConsensus(*engine, authorities); err != nil {
+		util.Err(err)
+		os.Exit(1)
+	}
+	policy, err := blockchain.ParseFlowPolicy(*flows)
+	if err != nil {
+		util.Err(err)
+		os.Exit(1)
+	}
+	blockchain.SetFlowPolicy(policy)
+	return s
+}
+
+// startNode 启动P2P节点
+func startNode(s *Service) {
+	var peerList []string
+	if *peers != "" {
+		peerList = strings.Split(*peers, ",")
+	}
+	go func() {
+		util.Err(network.StartServer(*nodeAddr, peerList, s.chain))
+	}()
+}
+
+// handleShutdown 启动HTTP服务并等待退出信号
+// 收到SIGINT或SIGTERM后停止接收新请求，等待进行中的请求结束，再关闭区块链并保存交易池
+func handleShutdown(s *Service, srv *http.Server) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		util.Info("HTTP服务已启动，监听" + srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			util.Err(err)
+			quit <- syscall.SIGTERM
+		}
+	}()
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), util.ShutdownTimeout)
+	defer cancel()
+	util.Err(srv.Shutdown(ctx))
+	util.Err(s.Close())
+	util.Info("区块链已关闭，交易池已保存，服务退出")
+}
+
+// statusOf 根据错误类型确定HTTP状态码
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidAddress), errors.Is(err, ErrInvalidHash), errors.Is(err, ErrInvalidIdentity),
+		errors.Is(err, blockchain.ErrInvalidAmount), errors.Is(err, wallet.ErrInvalidMnemonic),
+		errors.Is(err, trade.ErrInvalidPayload), errors.Is(err, trade.ErrInvalidAsset), errors.Is(err, trade.ErrInvalidSerial),
+		errors.Is(err, trade.ErrInvalidToken), errors.Is(err, wallet.ErrEmptyPassphrase):
+		return http.StatusBadRequest
+	case errors.Is(err, wallet.ErrWrongPassphrase):
+		return http.StatusUnauthorized
+	case errors.Is(err, blockchain.ErrFlowViolation), errors.Is(err, blockchain.ErrNotRegistrar),
+		errors.Is(err, blockchain.ErrIssuanceDenied), errors.Is(err, ErrTokenDenied):
+		return http.StatusForbidden
+	case errors.Is(err, blockchain.ErrChainNotFound), errors.Is(err, blockchain.ErrBlockNotFound),
+		errors.Is(err, blockchain.ErrTradeNotFound), errors.Is(err, wallet.ErrWalletNotFound),
+		errors.Is(err, wallet.ErrRefNotFound), errors.Is(err, wallet.ErrNotHDWallet),
+		errors.Is(err, blockchain.ErrIdentityNotFound), errors.Is(err, blockchain.ErrItemNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, blockchain.ErrChainExists), errors.Is(err, blockchain.ErrTradeKnown),
+		errors.Is(err, blockchain.ErrTradeConflict), errors.Is(err, blockchain.ErrMinerRunning):
+		return http.StatusConflict
+	case errors.Is(err, blockchain.ErrInsufficientFunds), errors.Is(err, blockchain.ErrTradeInvalid),
+		errors.Is(err, blockchain.ErrInvalidBlock), errors.Is(err, blockchain.ErrInvalidSeal),
+		errors.Is(err, blockchain.ErrPrevHashMismatch), errors.Is(err, blockchain.ErrInvalidHeight):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, blockchain.ErrMempoolFull), errors.Is(err, blockchain.ErrChainClosed),
+		errors.Is(err, blockchain.ErrNotInTurn):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// respond 返回接口结果，出错时按错误类型返回对应的状态码和ErrorResult
+func respond(c *gin.Context, result interface{}, err error) {
+	if err != nil {
+		status := statusOf(err)
+		if status == http.StatusInternalServerError {
+			util.Err(err)
+		}
+		c.JSON(status, ErrorResult{Success: false, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
 }
 
 func main() {
+	flag.Parse()
 
 	s := loadBlockChain()
-	s.InitBlockChain()
+	// 有其他节点或指定了创世区块时从网络同步区块链，否则在本地还没有区块链时创建演示数据
+	if *peers == "" && *genesis == "" && s.IsEmpty() {
+		util.Err(s.InitBlockChain())
+	}
+	util.Err(s.LoadMempool())
+	if *nodeAddr != "" {
+		startNode(s)
+	}
+	if *autoMine {
+		_, err := s.StartMining("")
+		util.Err(err)
+	}
 	r := gin.Default()
 	r.Use(cors.Default())
 
 	r.GET("/create_blockchain/:address", func(c *gin.Context) {
 		address := c.Param("address")
-		result := s.CreateBlockChain(address)
-		c.JSON(http.StatusOK, result)
+		result, err := s.CreateBlockChain(address)
+		respond(c, result, err)
 	})
 
 	r.GET("/wallet_info/:address", func(c *gin.Context) {
 		address := c.Param("address")
-		result := s.WalletInfo(address)
-		c.JSON(http.StatusOK, result)
+		result, err := s.WalletInfo(address)
+		respond(c, result, err)
 	})
 
 	r.GET("/wallet_info_ref/:refname", func(c *gin.Context) {
 		refname := c.Param("refname")
-		result := s.WalletInfoRefName(refname)
-		c.JSON(http.StatusOK, result)
+		result, err := s.WalletInfoRefName(refname)
+		respond(c, result, err)
 	})
 
 	r.GET("/wallets_list", func(c *gin.Context) {
-		result := s.WalletsList()
-		c.JSON(http.StatusOK, result)
+		result, err := s.WalletsList()
+		respond(c, result, err)
 	})
 
 	r.GET("/balance/:address", func(c *gin.Context) {
 		address := c.Param("address")
-		result := s.Balance(address)
-		c.JSON(http.StatusOK, result)
+		result, err := s.Balance(address)
+		respond(c, result, err)
 	})
 
 	r.GET("/balance_ref/:refname", func(c *gin.Context) {
 		address := c.Param("refname")
-		result := s.BalanceRefName(address)
-		c.JSON(http.StatusOK, result)
+		result, err := s.BalanceRefName(address)
+		respond(c, result, err)
+	})
+
+	r.GET("/utxos/:address", func(c *gin.Context) {
+		address := c.Param("address")
+		result, err := s.UTXOs(address)
+		respond(c, result, err)
+	})
+
+	// 付款方钱包的口令通过POST请求体传入，避免口令出现在URL中
+	r.POST("/send", func(c *gin.Context) {
+		var req SendRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		var result TradeResult
+		var err error
+		if req.Serial != "" {
+			result, err = s.SendItem(req.From, req.To, req.Serial, req.Fee, req.Description, req.Passphrase, req.Payload)
+		} else {
+			result, err = s.Send(req.From, req.To, req.Asset, req.Amount, req.Fee, req.Description, req.Passphrase, req.Payload)
+		}
+		respond(c, result, err)
+	})
+
+	// 一笔交易转给多个收款方，付款方钱包的口令通过POST请求体传入
+	r.POST("/send_many", func(c *gin.Context) {
+		var req SendManyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.SendMany(req)
+		respond(c, result, err)
+	})
+
+	// 发行方钱包的口令通过POST请求体传入
+	r.POST("/issue", func(c *gin.Context) {
+		var req IssueRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.Issue(req)
+		respond(c, result, err)
+	})
+
+	// 在生产环节铸造单品，发行方钱包的口令通过POST请求体传入
+	r.POST("/mint", func(c *gin.Context) {
+		var req MintRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.Mint(req)
+		respond(c, result, err)
+	})
+
+	r.GET("/item/:serial", func(c *gin.Context) {
+		result, err := s.Item(c.Param("serial"))
+		respond(c, result, err)
+	})
+
+	// 签发方钱包的口令通过POST请求体传入
+	r.POST("/token", func(c *gin.Context) {
+		var req TokenRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.IssueToken(req)
+		respond(c, result, err)
+	})
+
+	// 面向消费者的防伪查询，只读，token为扫描二维码得到的凭证字符串
+	r.GET("/verify/:token", func(c *gin.Context) {
+		result, err := s.VerifyToken(c.Param("token"))
+		respond(c, result, err)
 	})
 
-	r.GET("/send/:from/:to/:amount/:des", func(c *gin.Context) {
-		from := c.Param("from")
-		to := c.Param("to")
-		amount, _ := strconv.Atoi(c.Param("amount"))
-		des := c.Param("des")
-		result := s.Send(from, to, amount, des)
-		c.JSON(http.StatusOK, result)
+	// 交换双方的口令都通过POST请求体传入
+	r.POST("/swap", func(c *gin.Context) {
+		var req SwapRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.Swap(req)
+		respond(c, result, err)
 	})
 
-	r.GET("/send_by_ref/:from/:to/:amount/:des", func(c *gin.Context) {
-		from := c.Param("from")
-		to := c.Param("to")
-		amount, _ := strconv.Atoi(c.Param("amount"))
-		des := c.Param("des")
-		result := s.SendRefName(from, to, amount, des)
-		c.JSON(http.StatusOK, result)
+	// 登记员钱包的口令通过POST请求体传入
+	r.POST("/register", func(c *gin.Context) {
+		var req RegisterRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.Register(req.Address, req.Identity, req.Name, req.Passphrase)
+		respond(c, result, err)
+	})
+
+	r.GET("/identity/:address", func(c *gin.Context) {
+		result, err := s.Identity(c.Param("address"))
+		respond(c, result, err)
+	})
+
+	// 按钱包别名转账，付款方钱包的口令通过POST请求体传入
+	r.POST("/send_by_ref", func(c *gin.Context) {
+		var req SendByRefRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.SendRefName(req.From, req.To, req.Amount, req.Fee, req.Description, req.Passphrase)
+		respond(c, result, err)
 	})
 
 	r.GET("/mine", func(c *gin.Context) {
-		result := s.Mine()
-		c.JSON(http.StatusOK, result)
+		result, err := s.Mine(c.Request.Context(), c.Query("miner"))
+		respond(c, result, err)
+	})
+
+	r.GET("/mining/start", func(c *gin.Context) {
+		result, err := s.StartMining(c.Query("miner"))
+		respond(c, result, err)
+	})
+
+	r.GET("/mining/stop", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.StopMining())
+	})
+
+	r.GET("/mining/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.MiningStatus())
 	})
 
 	r.GET("/update_wallets", func(c *gin.Context) {
-		result := s.UpdateWallets()
-		c.JSON(http.StatusOK, result)
+		result, err := s.UpdateWallets()
+		respond(c, result, err)
 	})
 
-	r.GET("/create_wallet/:refname/:identity", func(c *gin.Context) {
-		refname := c.Param("refname")
-		identity := util.Identity(c.Param("identity"))
-		result := s.CreateWallet(refname, identity)
-		c.JSON(http.StatusOK, result)
+	r.POST("/create_wallet", func(c *gin.Context) {
+		var req CreateWalletRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.CreateWallet(req.RefName, util.Identity(req.Identity), req.Passphrase)
+		respond(c, result, err)
+	})
+
+	r.POST("/create_hd_wallet", func(c *gin.Context) {
+		var req CreateHDWalletRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.CreateHDWallet(req.RefName, util.Identity(req.Identity), req.Passphrase, req.Mnemonic)
+		respond(c, result, err)
+	})
+
+	r.POST("/hd_wallet/new_address", func(c *gin.Context) {
+		var req NewAddressRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "请求格式错误"})
+			return
+		}
+		result, err := s.NewAddress(req.Wallet, req.Change, req.Passphrase)
+		respond(c, result, err)
+	})
+
+	r.GET("/hd_wallet/:address", func(c *gin.Context) {
+		result, err := s.HDWalletInfo(c.Param("address"))
+		respond(c, result, err)
 	})
 
 	r.GET("/blockchain_info", func(c *gin.Context) {
-		result := s.GetBlockChainInfo()
-		c.JSON(http.StatusOK, result)
+		result, err := s.GetBlockChainInfo()
+		respond(c, result, err)
+	})
+
+	r.GET("/block/height/:n", func(c *gin.Context) {
+		height, err := strconv.ParseInt(c.Param("n"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResult{Success: false, Message: "区块高度格式错误"})
+			return
+		}
+		result, err := s.BlockByHeight(height, c.Query("header_only") == "true")
+		respond(c, result, err)
+	})
+
+	r.GET("/block/hash/:hash", func(c *gin.Context) {
+		hash := c.Param("hash")
+		result, err := s.BlockByHash(hash, c.Query("header_only") == "true")
+		respond(c, result, err)
+	})
+
+	r.GET("/merkle_proof/:trade_id", func(c *gin.Context) {
+		tradeID := c.Param("trade_id")
+		result, err := s.MerkleProof(tradeID)
+		respond(c, result, err)
+	})
+
+	r.GET("/verify_chain", func(c *gin.Context) {
+		result, err := s.VerifyChain()
+		respond(c, result, err)
+	})
+
+	// ref为交易ID或“交易ID:输出序号”，downstream=true时同时返回下游，format=dot时导出Graphviz格式
+	r.GET("/provenance/:ref", func(c *gin.Context) {
+		result, err := s.Provenance(c.Param("ref"), c.Query("downstream") == "true")
+		if err == nil && c.Query("format") == "dot" {
+			c.Data(http.StatusOK, "text/vnd.graphviz; charset=utf-8", []byte(provenanceDOT(result)))
+			return
+		}
+		respond(c, result, err)
 	})
 
 	r.GET("/trace_currency", func(c *gin.Context) {
-		result := s.traceCurrency()
-		c.JSON(http.StatusOK, result)
+		result, err := s.traceCurrency()
+		respond(c, result, err)
 	})
 
 	r.GET("/all_balance", func(c *gin.Context) {
-		result := s.getAllBalance()
-		c.JSON(http.StatusOK, result)
+		result, err := s.getAllBalance()
+		respond(c, result, err)
 	})
 
 	r.GET("/buy", func(c *gin.Context) {
-		result := s.buy()
-		c.JSON(http.StatusOK, result)
+		result, err := s.buy()
+		respond(c, result, err)
 	})
 
 	r.GET("/producer_buy", func(c *gin.Context) {
-		result := s.producerBuy()
-		c.JSON(http.StatusOK, result)
+		result, err := s.producerBuy()
+		respond(c, result, err)
 	})
 
 	r.GET("/dealer_buy", func(c *gin.Context) {
-		result := s.dealerBuy()
-		c.JSON(http.StatusOK, result)
+		result, err := s.dealerBuy()
+		respond(c, result, err)
 	})
 
-	r.Run(":8081")
+	handleShutdown(s, &http.Server{Addr: ":" + *port, Handler: r})
 }
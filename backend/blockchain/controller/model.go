@@ -1,11 +1,42 @@
 package main
 
+import "blockchain/trade"
+
+// ErrorResult 请求失败时返回的错误信息
+type ErrorResult struct {
+	Success bool
+	Message string
+}
+
 type BlockInfo struct {
+	Height       int64
 	Timestamp    string
 	PreviousHash string
+	MerkleRoot   string
 	Trades       []TradeInfo
 	Hash         string
-	Pow          bool
+	Target       string
+	Nonce        int64
+	Signer       string // PoA区块签名者的钱包地址
+	Pow          bool   // 共识证明是否有效
+}
+
+type BlockHeaderInfo struct {
+	Height       int64
+	Timestamp    string
+	PreviousHash string
+	MerkleRoot   string
+	Target       string
+	Nonce        int64
+	Signer       string
+	Hash         string
+}
+
+type BlockResult struct {
+	Success bool
+	Message string
+	Header  *BlockHeaderInfo `json:",omitempty"`
+	Block   *BlockInfo       `json:",omitempty"`
 }
 
 type TradeInfo struct {
@@ -13,6 +44,7 @@ type TradeInfo struct {
 	Inputs      []InputInfo
 	Outputs     []OutputInfo
 	Description string
+	Payload     *trade.Payload // 交易携带的产品信息，没有时为null
 }
 
 type InputInfo struct {
@@ -24,6 +56,35 @@ type InputInfo struct {
 type OutputInfo struct {
 	Num        int
 	HashPubKey string
+	Asset      string // 资产编号，原生商品为空
+	Serial     string // 单品序列号，可分割的数量为空
+}
+
+type ProofNodeInfo struct {
+	Hash string
+	Left bool
+}
+
+type MerkleProofResult struct {
+	Success     bool
+	Message     string
+	TradeID     string
+	BlockHash   string
+	BlockHeight int64
+	MerkleRoot  string
+	Index       int
+	Path        []ProofNodeInfo
+	Verified    bool
+}
+
+type VerifyChainResult struct {
+	Success bool
+	Message string
+	Blocks  int64  // 校验通过的区块数
+	Height  int64  // 第一个违反规则的区块高度
+	Hash    string // 第一个违反规则的区块哈希
+	Rule    string // 违反的规则
+	Detail  string
 }
 
 type BlockchainCreationResult struct {
@@ -33,27 +94,287 @@ type BlockchainCreationResult struct {
 
 type BalanceResult struct {
 	Address string
-	Balance int
+	Balance int            // 原生商品的余额
+	Assets  map[string]int `json:",omitempty"` // 其他资产的余额，按资产编号计
+}
+
+type UTXOInfo struct {
+	TradeID string
+	OutID   int
+	Num     int
+	Asset   string
+	Serial  string
+}
+
+type UTXOsResult struct {
+	Address string
+	UTXOs   []UTXOInfo
 }
 
 type TradeResult struct {
 	Success bool
 	Message string
+	TradeID string
 }
 
 type MiningResult struct {
-	Message string
+	Message  string
+	Hash     string
+	Height   int64
+	Hashes   uint64  // 封装区块时计算的哈希次数，PoA为0
+	HashRate float64 // 单位为H/s
+}
+
+type MinerStatusResult struct {
+	Running  bool
+	Address  string
+	Blocks   int
+	Hashes   uint64
+	HashRate float64
 }
 
 type CreateWalletResult struct {
+	Success bool
 	Message string
+	Address string
 }
 
+// CreateWalletRequest POST /create_wallet的请求体
+type CreateWalletRequest struct {
+	RefName    string
+	Identity   string
+	Passphrase string
+}
+
+// CreateHDWalletRequest POST /create_hd_wallet的请求体，Mnemonic不为空时从助记词恢复钱包
+type CreateHDWalletRequest struct {
+	RefName    string
+	Identity   string
+	Passphrase string
+	Mnemonic   string
+}
+
+type CreateHDWalletResult struct {
+	Success  bool
+	Message  string
+	Address  string // 第一个收款地址，同时作为钱包ID
+	Mnemonic string
+}
+
+// NewAddressRequest POST /hd_wallet/new_address的请求体，Wallet为钱包中任一地址
+type NewAddressRequest struct {
+	Wallet     string
+	Change     bool
+	Passphrase string
+}
+
+type HDWalletInfoResult struct {
+	Success  bool
+	Message  string
+	ID       string
+	Identity string
+	Receive  []BalanceResult
+	Change   []BalanceResult
+	Balance  int // 全部地址的余额之和
+}
+
+// RegisterRequest POST /register的请求体，Passphrase为登记员钱包的口令
+type RegisterRequest struct {
+	Address    string
+	Identity   string
+	Name       string
+	Passphrase string
+}
+
+type RegisterResult struct {
+	Success bool
+	Message string
+	TradeID string
+}
+
+// SendRequest POST /send的请求体，From和To为钱包地址，Payload为可选的产品信息
+type SendRequest struct {
+	From        string
+	To          string
+	Amount      int
+	Fee         int
+	Description string
+	Passphrase  string
+	Payload     *trade.Payload
+	Asset       string // 转出的资产编号，为空时转出原生商品
+	Serial      string // 转出的单品序列号，不为空时转出该单品，忽略Amount
+}
+
+// SendByRefRequest POST /send_by_ref的请求体，From和To为钱包别名，转出原生商品
+type SendByRefRequest struct {
+	From        string
+	To          string
+	Amount      int
+	Fee         int
+	Description string
+	Passphrase  string
+}
+
+// SendOutput 批量转账中的一笔转出，Serial不为空时转出该单品，忽略Asset和Amount
+type SendOutput struct {
+	To     string
+	Asset  string
+	Amount int
+	Serial string
+}
+
+// SendManyRequest 一笔交易转给多个收款方，如将一批原料拆分为多个生产批次
+// Lots为指定花费的批次，格式为“交易ID:序号”，可用于合并多个供应商的原料；不足的部分自动选择
+type SendManyRequest struct {
+	From        string
+	Outputs     []SendOutput
+	Lots        []string
+	Fee         int
+	Description string
+	Passphrase  string
+	Payload     *trade.Payload
+}
+
+// IssueRequest 发行资产，Address为发行方，新发行的Amount个资产转给To，To为空时留在发行方
+type IssueRequest struct {
+	Address     string
+	Symbol      string
+	Amount      int
+	To          string
+	Fee         int
+	Description string
+	Passphrase  string
+	Payload     *trade.Payload
+}
+
+type IssueResult struct {
+	Success bool
+	Message string
+	Asset   string
+	TradeID string
+}
+
+// MintRequest 铸造单品，Address为发行方，每个序列号铸造一个属于资产Symbol的单品转给To，To为空时留在发行方
+type MintRequest struct {
+	Address     string
+	Symbol      string
+	Serials     []string
+	To          string
+	Fee         int
+	Description string
+	Passphrase  string
+	Payload     *trade.Payload
+}
+
+type MintResult struct {
+	Success bool
+	Message string
+	Asset   string
+	Serials []string
+	TradeID string
+}
+
+// ItemCustodyInfo 单品的一次经手，Address为该次交易中单品的收款方
+type ItemCustodyInfo struct {
+	TradeID     string
+	OutID       int
+	BlockHash   string
+	Height      int64
+	Time        string
+	Description string
+	Payload     *trade.Payload
+	Address     string
+	Identity    string
+	Name        string
+}
+
+// ItemResult 单品的当前持有方及经手记录，History按时间顺序排列，第一条为铸造
+type ItemResult struct {
+	Success  bool
+	Serial   string
+	Asset    string
+	Owner    string
+	Identity string
+	Name     string
+	History  []ItemCustodyInfo
+}
+
+// TokenRequest 签发防伪凭证，Output为交易ID和输出序号，格式为“交易ID:序号”
+type TokenRequest struct {
+	Address    string
+	Output     string
+	Passphrase string
+}
+
+// TokenResult Token为印在二维码中的凭证字符串
+type TokenResult struct {
+	Success bool
+	Message string
+	Token   string
+	TradeID string
+	OutID   int
+}
+
+// VerifyResult 防伪凭证的校验结果
+// Genuine为true时凭证引用的输出在主链上且由有权的签发方签发，Status和Detail说明结论及原因
+// Claimed为true时商品已转入登记为消费者的地址，ClaimedBy为该次经手；同一凭证被多次扫描时可据此发现仿冒
+// 只有单品能判断是否被认领，Claimable为false时凭证引用可分割的数量，Custody包含其拆分后的所有去向
+type VerifyResult struct {
+	Success        bool
+	Message        string
+	Genuine        bool
+	Status         string
+	Detail         string
+	TradeID        string
+	OutID          int
+	Issuer         string
+	IssuerIdentity string
+	IssuerName     string
+	Asset          string
+	Serial         string
+	Num            int
+	Claimable      bool
+	Claimed        bool
+	ClaimedBy      *ItemCustodyInfo `json:",omitempty"`
+	Custody        []ItemCustodyInfo
+}
+
+// SwapSide 交换中一方转给另一方的资产
+type SwapSide struct {
+	Address    string
+	Asset      string
+	Amount     int
+	Passphrase string
+}
+
+// SwapRequest 双方在同一笔交易中交换资产，如以商品交换货款
+// 手续费由转出原生商品的一方承担，双方都转出其他资产时由A方承担
+type SwapRequest struct {
+	A           SwapSide
+	B           SwapSide
+	Fee         int
+	Description string
+	Payload     *trade.Payload
+}
+
+// WalletInfoResult 钱包信息，Identity和Name为链上登记的身份和名称
+// Registered为false时地址尚未登记，Identity为本地钱包文件中声明的身份
 type WalletInfoResult struct {
 	Address       string
 	PublicKey     string
 	ReferenceName string
 	Identity      string
+	Name          string
+	Registered    bool
+}
+
+// IdentityResult 地址在链上登记的身份，TradeID为最近一次登记交易的ID
+type IdentityResult struct {
+	Success  bool
+	Address  string
+	Identity string
+	Name     string
+	TradeID  string
 }
 
 type UpdateWalletsResult struct {
@@ -73,9 +394,57 @@ type getAllBalanceResult struct {
 	User_balance       string
 }
 
+// TraceTrade 溯源记录，Address、Identity和Name为收款方的地址及其在链上登记的身份和名称
 type TraceTrade struct {
 	Time        string
 	Description string
+	Payload     *trade.Payload
+	Address     string
+	Identity    string
+	Name        string
+}
+
+// ProvenanceResult 溯源图，Nodes按区块从新到旧排列，Truncated表示交易过多、溯源图不完整
+type ProvenanceResult struct {
+	Success   bool
+	Root      string
+	Nodes     []ProvenanceNodeInfo
+	Edges     []ProvenanceEdgeInfo
+	Truncated bool
+}
+
+type ProvenanceNodeInfo struct {
+	ID          string
+	BlockHash   string
+	Height      int64
+	Time        string
+	Description string
+	Payload     *trade.Payload
+	Outputs     []ProvenanceOutputInfo
+}
+
+// ProvenanceOutputInfo 交易输出的收款方，Identity和Name为其在链上登记的身份和名称
+type ProvenanceOutputInfo struct {
+	OutID    int
+	Num      int
+	Asset    string
+	Serial   string
+	Address  string
+	Identity string
+	Name     string
+}
+
+// ProvenanceEdgeInfo From交易的第OutID个输出被To交易花费，Address为该输出的持有方
+type ProvenanceEdgeInfo struct {
+	From     string
+	OutID    int
+	To       string
+	Num      int
+	Asset    string
+	Serial   string
+	Address  string
+	Identity string
+	Name     string
 }
 
 type BuyResult struct {
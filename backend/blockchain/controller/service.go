@@ -2,429 +2,1694 @@ package main
 
 import (
 	"blockchain/blockchain"
+	"blockchain/merkle"
+	"blockchain/network"
+	"blockchain/trade"
 	"blockchain/util"
 	"blockchain/wallet"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-type Service struct{}
-
-func (s *Service) InitBlockChain() {
-	s.CreateWallet("原料厂", util.Identity("Raw"))
-	s.CreateWallet("贵州生产商", util.Identity("Producer"))
-	//s.CreateWallet("重庆生产商", util.Identity("Producer"))
-	s.CreateWallet("北京经销商", util.Identity("Dealer"))
-	s.CreateWallet("上海经销商", util.Identity("Dealer"))
-	s.CreateWallet("天津经销商", util.Identity("Dealer"))
-	s.CreateWallet("用户", util.Identity("User"))
-	address := s.WalletInfoRefName("原料厂").Address
-	s.CreateBlockChain(address)
-	s.SendRefName("原料厂", "贵州生产商", 900, "贵州生产商进货")
-	s.Mine()
-	time.Sleep(1 * time.Second)
-	s.SendRefName("贵州生产商", "北京经销商", 189, "北京经销商进货")
-	s.Mine()
-	s.SendRefName("贵州生产商", "上海经销商", 243, "上海经销商进货")
-	s.Mine()
-	s.SendRefName("贵州生产商", "天津经销商", 199, "天津经销商进货")
-	s.Mine()
-	time.Sleep(1 * time.Second)
-	s.SendRefName("天津经销商", "用户", 1, "用户购买")
-	s.Mine()
-	s.traceCurrency()
+// demoPassphrase 演示数据中的钱包使用的口令
+// 该口令是公开的，只用于演示数据和模拟购买的接口，通过POST接口创建的钱包由调用方提供口令
+const demoPassphrase = "demo"
+
+// 请求参数错误
+var (
+	ErrInvalidAddress  = errors.New("钱包地址无效")
+	ErrInvalidHash     = errors.New("哈希格式错误")
+	ErrInvalidIdentity = errors.New("身份角色无效")
+	ErrTokenDenied     = errors.New("无权签发防伪凭证")
+)
 
+type Service struct {
+	Miner string                  // 默认接收挖矿奖励的钱包地址，为空时不产生奖励
+	chain *blockchain.SharedChain // 进程内共享的区块链，服务运行期间保持打开
+	miner *blockchain.Miner       // 后台挖矿，挖出的区块向其他节点广播
 }
 
-func (s *Service) CreateBlockChain(address string) BlockchainCreationResult {
-	newChain := blockchain.InitBlockChain(util.AddressToPublicHash([]byte(address)))
-	err := newChain.Database.Close()
+// NewService 打开本地区块链并创建服务，本地没有区块链时打开一个空链
+func NewService(miner string) (*Service, error) {
+	chain, err := blockchain.OpenSharedChain()
 	if err != nil {
-		util.Err(err)
-		return BlockchainCreationResult{
-			Success: false,
-			Message: err.Error(),
+		return nil, err
+	}
+	return &Service{Miner: miner, chain: chain, miner: blockchain.NewMiner(chain, network.BroadcastBlock)}, nil
+}
+
+// view 在读锁下访问区块链，还没有创建区块链时返回ErrChainNotFound
+func (s *Service) view(fn func(chain *blockchain.BlockChain) error) error {
+	return s.chain.View(func(chain *blockchain.BlockChain) error {
+		if chain.IsEmpty() {
+			return blockchain.ErrChainNotFound
+		}
+		return fn(chain)
+	})
+}
+
+// update 在写锁下访问区块链，还没有创建区块链时返回ErrChainNotFound
+func (s *Service) update(fn func(chain *blockchain.BlockChain) error) error {
+	return s.chain.Update(func(chain *blockchain.BlockChain) error {
+		if chain.IsEmpty() {
+			return blockchain.ErrChainNotFound
+		}
+		return fn(chain)
+	})
+}
+
+// Close 停止后台挖矿，等待进行中的请求结束后关闭区块链并保存交易池，服务退出时调用
+func (s *Service) Close() error {
+	s.miner.Stop()
+	if err := s.chain.Close(); err != nil {
+		return err
+	}
+	return blockchain.GetMempool().SaveFile()
+}
+
+// UseConsensus 设置共识引擎，name为pow或poa
+// PoA按authorities的顺序轮流出块，本节点持有的授权钱包用demoPassphrase解锁后参与签名，
+// 其余授权钱包属于其他节点，本节点只验证它们签名的区块
+func (s *Service) UseConsensus(name string, authorities []string) error {
+	switch name {
+	case "pow":
+		blockchain.SetConsensus(&blockchain.PoW{})
+	case "poa":
+		poa, err := blockchain.NewPoA(authorities)
+		if err != nil {
+			return err
+		}
+		for _, address := range authorities {
+			w, err := wallet.UnlockWallet(address, demoPassphrase)
+			if errors.Is(err, wallet.ErrWalletNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := poa.AddSigner(w.PrivateKey); err != nil {
+				return err
+			}
 		}
+		blockchain.SetConsensus(poa)
+	default:
+		return fmt.Errorf("不支持的共识引擎%s", name)
+	}
+	util.Info(fmt.Sprintf("使用共识引擎%s", name))
+	return nil
+}
+
+// InitBlockChain 创建演示用的钱包和交易
+func (s *Service) InitBlockChain() error {
+	wallets := []struct {
+		refname  string
+		identity util.Identity
+	}{
+		{"原料厂", "Raw"},
+		{"贵州生产商", "Producer"},
+		//{"重庆生产商", "Producer"},
+		{"北京经销商", "Dealer"},
+		{"上海经销商", "Dealer"},
+		{"天津经销商", "Dealer"},
+		{"用户", "User"},
+	}
+	var addresses, authorities []string
+	for _, w := range wallets {
+		created, err := s.CreateWallet(w.refname, w.identity, demoPassphrase)
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, created.Address)
+		if w.identity != util.User {
+			authorities = append(authorities, created.Address)
+		}
+	}
+	// 使用PoA且没有指定授权钱包时，由原料厂、生产商和经销商轮流出块
+	if poa, ok := blockchain.GetConsensus().(*blockchain.PoA); ok && len(poa.Authorities) == 0 {
+		if err := s.UseConsensus("poa", authorities); err != nil {
+			return err
+		}
+	}
+	raw, err := s.WalletInfoRefName("原料厂")
+	if err != nil {
+		return err
+	}
+	if _, err := s.CreateBlockChain(raw.Address); err != nil {
+		return err
+	}
+	// 原料厂创建区块链，作为登记员将各方的身份登记上链
+	for i, w := range wallets {
+		if _, err := s.Register(addresses[i], string(w.identity), w.refname, demoPassphrase); err != nil {
+			return err
+		}
+	}
+	if _, err := s.Mine(context.Background(), ""); err != nil {
+		return err
+	}
+
+	// sendAndMine 转账并立即挖出包含该交易的区块
+	sendAndMine := func(from, to string, amount int, des string) error {
+		if _, err := s.SendRefName(from, to, amount, 0, des, demoPassphrase); err != nil {
+			return err
+		}
+		_, err := s.Mine(context.Background(), "")
+		return err
+	}
+	if err := sendAndMine("原料厂", "贵州生产商", 900, "贵州生产商进货"); err != nil {
+		return err
+	}
+	time.Sleep(1 * time.Second)
+	if err := sendAndMine("贵州生产商", "北京经销商", 189, "北京经销商进货"); err != nil {
+		return err
+	}
+	if err := sendAndMine("贵州生产商", "上海经销商", 243, "上海经销商进货"); err != nil {
+		return err
+	}
+	if err := sendAndMine("贵州生产商", "天津经销商", 199, "天津经销商进货"); err != nil {
+		return err
+	}
+	time.Sleep(1 * time.Second)
+	if err := sendAndMine("天津经销商", "用户", 1, "用户购买"); err != nil {
+		return err
+	}
+	_, err = s.traceCurrency()
+	return err
+}
+
+func (s *Service) CreateBlockChain(address string) (BlockchainCreationResult, error) {
+	if !util.ValidateAddress([]byte(address)) {
+		return BlockchainCreationResult{}, ErrInvalidAddress
+	}
+
+	err := s.chain.Update(func(chain *blockchain.BlockChain) error {
+		return chain.CreateGenesis(util.AddressToPublicHash([]byte(address)))
+	})
+	if err != nil {
+		return BlockchainCreationResult{}, err
 	}
 	return BlockchainCreationResult{
 		Success: true,
 		Message: "Finished creating blockchain,a and the owner is: " + address,
-	}
+	}, nil
 }
 
-func (s *Service) Balance(address string) BalanceResult {
-	chain := blockchain.ContinueBlockChain()
-	defer chain.Database.Close()
-
-	wallet := wallet.LoadWallet(address)
+func (s *Service) Balance(address string) (BalanceResult, error) {
+	wallet, err := wallet.LoadWallet(address)
+	if err != nil {
+		return BalanceResult{}, err
+	}
 
-	balance, _ := chain.FindUTXOs(wallet.PublicKey)
+	var balances map[string]int
+	err = s.view(func(chain *blockchain.BlockChain) error {
+		var err error
+		balances, _, err = chain.FindUTXOs(wallet.PublicKey)
+		return err
+	})
+	if err != nil {
+		return BalanceResult{}, err
+	}
+	balance := balances[trade.NativeAsset]
+	delete(balances, trade.NativeAsset)
+	if len(balances) == 0 {
+		balances = nil
+	}
 	util.Info(fmt.Sprintf("Address:%s, Balance:%d \n", address, balance))
 	return BalanceResult{
 		Address: address,
 		Balance: balance,
-	}
+		Assets:  balances,
+	}, nil
 }
 
-func (s *Service) GetBlockChainInfo() []BlockInfo {
+func (s *Service) UTXOs(address string) (UTXOsResult, error) {
+	if !util.ValidateAddress([]byte(address)) {
+		return UTXOsResult{}, ErrInvalidAddress
+	}
+
+	var found []blockchain.UTXO
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		var err error
+		found, err = chain.UTXOSet().FindUTXOs(util.AddressToPublicHash([]byte(address)))
+		return err
+	})
+	if err != nil {
+		return UTXOsResult{}, err
+	}
+	var utxos []UTXOInfo
+	for _, utxo := range found {
+		utxos = append(utxos, UTXOInfo{
+			TradeID: hex.EncodeToString(utxo.TradeID),
+			OutID:   utxo.OutID,
+			Num:     utxo.Out.Num,
+			Asset:   utxo.Out.Asset,
+			Serial:  utxo.Out.Serial,
+		})
+	}
+	return UTXOsResult{
+		Address: address,
+		UTXOs:   utxos,
+	}, nil
+}
 
+func (s *Service) GetBlockChainInfo() ([]BlockInfo, error) {
 	var blocks []BlockInfo
 
-	chain := blockchain.ContinueBlockChain()
-	defer chain.Database.Close()
-	iterator := chain.InitIterator()
-	ogprevhash := chain.GetOGPrevHash()
-
-	for {
-		block := iterator.Next()
-		if block == nil {
-			break
-		}
-
-		blockInfo := BlockInfo{
-			Timestamp:    block.Time.Format("2006-01-02 15:04:05"),
-			PreviousHash: fmt.Sprintf("%x", block.PrevHash),
-			Trades:       nil,
-			Hash:         fmt.Sprintf("%x", block.Hash),
-			Pow:          block.ValidatePoW(),
-		}
-
-		// 接下来处理tradelist
-		var tradesInfo []TradeInfo
-		for _, trade := range block.TradeList {
-			if trade != nil { // 确保指针非空
-				tInfo := TradeInfo{
-					ID:          hex.EncodeToString(trade.ID),
-					Inputs:      make([]InputInfo, len(trade.Inputs)),
-					Outputs:     make([]OutputInfo, len(trade.Outputs)),
-					Description: trade.Description,
-				}
-				for i, input := range trade.Inputs {
-					tInfo.Inputs[i] = InputInfo{
-						TradeID: hex.EncodeToString(input.TradeID),
-						OutID:   input.OutID,
-						PubKey:  fmt.Sprintf("%x", input.PublicKey),
-					}
-					//util.Info("Key : " + fmt.Sprintf("%x", input.PublicKey))
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		iterator := chain.InitIterator()
+		ogprevhash, err := chain.GetOGPrevHash()
+		if err != nil {
+			return err
+		}
+
+		for {
+			block, err := iterator.Next()
+			if err != nil {
+				return err
+			}
+
+			blockInfo := newBlockInfo(chain, block)
+			blocks = append(blocks, blockInfo)
+
+			if bytes.Equal(block.PrevHash, ogprevhash) {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// newBlockInfo 将区块转换为接口返回的区块信息
+func newBlockInfo(chain *blockchain.BlockChain, block *blockchain.Block) BlockInfo {
+	blockInfo := BlockInfo{
+		Height:       block.Height,
+		Timestamp:    block.Time.Format("2006-01-02 15:04:05"),
+		PreviousHash: fmt.Sprintf("%x", block.PrevHash),
+		MerkleRoot:   fmt.Sprintf("%x", block.MerkleRoot),
+		Trades:       nil,
+		Hash:         fmt.Sprintf("%x", block.Hash),
+		Target:       fmt.Sprintf("%x", block.Target),
+		Nonce:        block.Nonce,
+		Signer:       signerAddress(block.Signer),
+		Pow:          chain.VerifySeal(block) == nil,
+	}
+
+	// 接下来处理tradelist
+	var tradesInfo []TradeInfo
+	for _, trade := range block.TradeList {
+		if trade != nil { // 确保指针非空
+			tInfo := TradeInfo{
+				ID:          hex.EncodeToString(trade.ID),
+				Inputs:      make([]InputInfo, len(trade.Inputs)),
+				Outputs:     make([]OutputInfo, len(trade.Outputs)),
+				Description: trade.Description,
+				Payload:     trade.Payload,
+			}
+			for i, input := range trade.Inputs {
+				tInfo.Inputs[i] = InputInfo{
+					TradeID: hex.EncodeToString(input.TradeID),
+					OutID:   input.OutID,
+					PubKey:  fmt.Sprintf("%x", input.PublicKey),
 				}
-				for i, output := range trade.Outputs {
-					tInfo.Outputs[i] = OutputInfo{
-						Num:        output.Num,
-						HashPubKey: fmt.Sprintf("%x", output.HashPublicKey),
-					}
+			}
+			for i, output := range trade.Outputs {
+				tInfo.Outputs[i] = OutputInfo{
+					Num:        output.Num,
+					HashPubKey: fmt.Sprintf("%x", output.HashPublicKey),
+					Asset:      output.Asset,
+					Serial:     output.Serial,
 				}
-				tradesInfo = append(tradesInfo, tInfo)
 			}
+			tradesInfo = append(tradesInfo, tInfo)
 		}
+	}
+
+	// 现在 tradesInfo 包含实际的数据而非指针
+	blockInfo.Trades = tradesInfo
+	return blockInfo
+}
 
-		// 现在 tradesInfo 包含实际的数据而非指针
-		blockInfo.Trades = tradesInfo
+// newBlockHeaderInfo 将区块头转换为接口返回的区块头信息
+func newBlockHeaderInfo(header *blockchain.BlockHeader) BlockHeaderInfo {
+	return BlockHeaderInfo{
+		Height:       header.Height,
+		Timestamp:    header.Time.Format("2006-01-02 15:04:05"),
+		PreviousHash: fmt.Sprintf("%x", header.PrevHash),
+		MerkleRoot:   fmt.Sprintf("%x", header.MerkleRoot),
+		Target:       fmt.Sprintf("%x", header.Target),
+		Nonce:        header.Nonce,
+		Signer:       signerAddress(header.Signer),
+		Hash:         fmt.Sprintf("%x", header.Hash),
+	}
+}
 
-		blocks = append(blocks, blockInfo)
+// signerAddress 获取PoA区块签名者的钱包地址，PoW区块返回空字符串
+func signerAddress(signer []byte) string {
+	if len(signer) == 0 {
+		return ""
+	}
+	return string(util.PublicHashToAddress(util.PublicKeyHash(signer)))
+}
 
-		if bytes.Equal(block.PrevHash, ogprevhash) {
-			break
+// BlockByHeight 按高度查询主链上的区块，headerOnly时只读取区块头
+func (s *Service) BlockByHeight(height int64, headerOnly bool) (BlockResult, error) {
+	var result BlockResult
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		hash, err := chain.GetBlockHashByHeight(height)
+		if err != nil {
+			return fmt.Errorf("高度%d处没有区块: %w", height, err)
 		}
+		result, err = s.blockResult(chain, hash, headerOnly)
+		return err
+	})
+	return result, err
+}
+
+// BlockByHash 按哈希查询区块，侧链上的区块同样可以查到
+func (s *Service) BlockByHash(hash string, headerOnly bool) (BlockResult, error) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return BlockResult{}, ErrInvalidHash
 	}
 
-	return blocks
+	var result BlockResult
+	err = s.view(func(chain *blockchain.BlockChain) error {
+		result, err = s.blockResult(chain, hashBytes, headerOnly)
+		return err
+	})
+	return result, err
 }
 
-func (s *Service) Send(from, to string, amount int, des string) TradeResult {
-	chain := blockchain.ContinueBlockChain()
-	defer chain.Database.Close()
+func (s *Service) blockResult(chain *blockchain.BlockChain, hash []byte, headerOnly bool) (BlockResult, error) {
+	if headerOnly {
+		header, err := chain.GetBlockHeader(hash)
+		if err != nil {
+			return BlockResult{}, err
+		}
+		headerInfo := newBlockHeaderInfo(header)
+		return BlockResult{Success: true, Header: &headerInfo}, nil
+	}
 
-	fromWallet := wallet.LoadWallet(from)
+	block, err := chain.GetBlock(hash)
+	if err != nil {
+		return BlockResult{}, err
+	}
+	headerInfo := newBlockHeaderInfo(&block.BlockHeader)
+	blockInfo := newBlockInfo(chain, block)
+	return BlockResult{Success: true, Header: &headerInfo, Block: &blockInfo}, nil
+}
 
-	toPubHash := util.AddressToPublicHash([]byte(to))
-	trade, ok := chain.CreateTrade(fromWallet.PublicKey, toPubHash, amount, fromWallet.PrivateKey, des)
+// MerkleProof 生成交易包含在主链区块中的默克尔证明
+// 审计方只需区块头中的默克尔根即可用merkle.VerifyProof离线验证
+func (s *Service) MerkleProof(tradeID string) (MerkleProofResult, error) {
+	id, err := hex.DecodeString(tradeID)
+	if err != nil {
+		return MerkleProofResult{}, ErrInvalidHash
+	}
+
+	var block *blockchain.Block
+	err = s.view(func(chain *blockchain.BlockChain) error {
+		_, block, err = chain.FindTrade(id)
+		return err
+	})
+	if err != nil {
+		return MerkleProofResult{}, err
+	}
+	proof, ok := block.MerkleProof(id)
 	if !ok {
-		return TradeResult{Success: false, Message: "Failed to create trade"}
+		return MerkleProofResult{}, errors.New("无法生成默克尔证明")
 	}
 
-	tp := blockchain.CreateTradePool()
-	tp.AddTrade(trade)
-	tp.SaveFile()
+	path := make([]ProofNodeInfo, len(proof.Path))
+	for i, node := range proof.Path {
+		path[i] = ProofNodeInfo{Hash: hex.EncodeToString(node.Hash), Left: node.Left}
+	}
+	return MerkleProofResult{
+		Success:     true,
+		TradeID:     tradeID,
+		BlockHash:   hex.EncodeToString(block.Hash),
+		BlockHeight: block.Height,
+		MerkleRoot:  hex.EncodeToString(block.MerkleRoot),
+		Index:       proof.Index,
+		Path:        path,
+		Verified:    merkle.VerifyProof(id, block.MerkleRoot, proof),
+	}, nil
+}
+
+// VerifyChain 从创世区块开始校验主链，返回第一个违反规则的区块
+// 校验未通过属于正常的校验结果，只有无法完成校验时返回错误
+func (s *Service) VerifyChain() (VerifyChainResult, error) {
+	var checked int64
+	var verifyErr error
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		checked, verifyErr = chain.VerifyChain()
+		return nil
+	})
+	if err != nil {
+		return VerifyChainResult{}, err
+	}
 
-	return TradeResult{Success: true, Message: "Trade successful"}
+	var violation *blockchain.ChainViolation
+	if errors.As(verifyErr, &violation) {
+		return VerifyChainResult{
+			Success: false,
+			Message: "区块链校验未通过",
+			Blocks:  checked,
+			Height:  violation.Height,
+			Hash:    hex.EncodeToString(violation.Hash),
+			Rule:    violation.Rule,
+			Detail:  violation.Detail,
+		}, nil
+	}
+	if verifyErr != nil {
+		return VerifyChainResult{}, verifyErr
+	}
+	return VerifyChainResult{Success: true, Message: "区块链校验通过", Blocks: checked}, nil
 }
 
-func (s *Service) Mine() MiningResult {
-	chain := blockchain.ContinueBlockChain()
-	defer chain.Database.Close()
-	chain.Mine()
+// Send 转账，asset为转出的资产编号，为空时转出原生商品；fee为支付给矿工的手续费，passphrase用于解锁付款方钱包
+// payload为交易携带的产品信息，可以为nil，未填写版本时按当前版本处理
+func (s *Service) Send(from, to, asset string, amount, fee int, des, passphrase string, payload *trade.Payload) (TradeResult, error) {
+	if !util.ValidateAddress([]byte(to)) {
+		return TradeResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, to)
+	}
+	if err := trade.ValidateAsset(asset); err != nil {
+		return TradeResult{}, err
+	}
+	transfer := blockchain.Transfer{To: util.AddressToPublicHash([]byte(to)), Asset: asset, Amount: amount}
+	return s.transfer(from, []blockchain.Transfer{transfer}, nil, fee, des, passphrase, payload)
+}
+
+// SendItem 将序列号为serial的单品转给to，单品须由付款方持有，fee为以原生商品支付的手续费
+func (s *Service) SendItem(from, to, serial string, fee int, des, passphrase string, payload *trade.Payload) (TradeResult, error) {
+	if !util.ValidateAddress([]byte(to)) {
+		return TradeResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, to)
+	}
+	if err := trade.ValidateSerial(serial); err != nil {
+		return TradeResult{}, err
+	}
+	transfer := blockchain.Transfer{To: util.AddressToPublicHash([]byte(to)), Serial: serial}
+	return s.transfer(from, []blockchain.Transfer{transfer}, nil, fee, des, passphrase, payload)
+}
+
+// SendMany 在一笔交易中转给多个收款方，每个收款方对应一个输出
+// 可以指定花费的批次，将多个供应商的原料合并后再拆分，溯源时各批次的来源和去向都保留在链上
+func (s *Service) SendMany(req SendManyRequest) (TradeResult, error) {
+	if len(req.Outputs) == 0 || len(req.Outputs) > util.MaxTradeOutputs {
+		return TradeResult{}, fmt.Errorf("%w: 收款方应为1到%d个", blockchain.ErrInvalidAmount, util.MaxTradeOutputs)
+	}
+	var transfers []blockchain.Transfer
+	for _, out := range req.Outputs {
+		if !util.ValidateAddress([]byte(out.To)) {
+			return TradeResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, out.To)
+		}
+		if out.Serial != "" {
+			if err := trade.ValidateSerial(out.Serial); err != nil {
+				return TradeResult{}, err
+			}
+		} else if err := trade.ValidateAsset(out.Asset); err != nil {
+			return TradeResult{}, err
+		}
+		transfers = append(transfers, blockchain.Transfer{
+			To:     util.AddressToPublicHash([]byte(out.To)),
+			Asset:  out.Asset,
+			Amount: out.Amount,
+			Serial: out.Serial,
+		})
+	}
+	var lots []blockchain.OutPoint
+	for _, ref := range req.Lots {
+		tradeID, outID, err := parseOutputRef(ref)
+		if err != nil {
+			return TradeResult{}, err
+		}
+		if outID < 0 {
+			return TradeResult{}, fmt.Errorf("%w: 批次%s缺少输出序号", ErrInvalidHash, ref)
+		}
+		lots = append(lots, blockchain.OutPoint{TradeID: tradeID, OutID: outID})
+	}
+	return s.transfer(req.From, transfers, lots, req.Fee, req.Description, req.Passphrase, req.Payload)
+}
+
+// transfer 解锁付款方钱包，创建由付款方一方付款的交易并提交，lots为指定花费的输出
+func (s *Service) transfer(from string, transfers []blockchain.Transfer, lots []blockchain.OutPoint, fee int, des, passphrase string, payload *trade.Payload) (TradeResult, error) {
+	if err := preparePayload(payload); err != nil {
+		return TradeResult{}, err
+	}
+	// 口令派生较慢，在获取区块链锁之前完成
+	fromWallet, err := wallet.UnlockWallet(from, passphrase)
+	if err != nil {
+		return TradeResult{}, err
+	}
+	// 付款方属于分层确定性钱包时，付款地址不足的部分从钱包的其他地址支付，找零到派生的找零地址
+	// 设置了流转规则时收款方必须已登记身份，派生的找零地址由付款方登记为相同身份后才使用
+	others, err := wallet.OtherWallets(from, passphrase)
+	if err != nil {
+		return TradeResult{}, err
+	}
+	var registered func([]byte) (bool, error)
+	if blockchain.GetFlowPolicy() != nil {
+		registered = s.isRegistered
+	}
+	changePubHash, unregistered, err := wallet.ChangeAddress(from, passphrase, registered)
+	if err != nil {
+		return TradeResult{}, err
+	}
+	if unregistered != nil {
+		if err := s.inheritIdentity(fromWallet, unregistered); err != nil {
+			return TradeResult{}, err
+		}
+	}
+
+	leg := blockchain.TradeLeg{
+		From:      fromWallet.PublicKey,
+		Change:    changePubHash,
+		Transfers: transfers,
+		Lots:      lots,
+		Fee:       fee,
+		Key:       &fromWallet.PrivateKey,
+	}
+	for _, w := range others {
+		leg.Sources = append(leg.Sources, blockchain.TradeSource{PublicKey: w.PublicKey, Key: &w.PrivateKey})
+	}
+	t, err := s.submit([]blockchain.TradeLeg{leg}, des, payload)
+	if err != nil {
+		return TradeResult{}, err
+	}
+	return TradeResult{Success: true, Message: "Trade successful", TradeID: hex.EncodeToString(t.ID)}, nil
+}
+
+// Issue 发行资产，发行方address必须已在链上登记为原料厂或生产商
+// 新发行的amount个资产转给to，to为空时留在发行方；发行交易花费发行方的原生商品支付手续费，剩余部分找零
+func (s *Service) Issue(req IssueRequest) (IssueResult, error) {
+	if !util.ValidateAddress([]byte(req.Address)) {
+		return IssueResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, req.Address)
+	}
+	if req.To == "" {
+		req.To = req.Address
+	}
+	if !util.ValidateAddress([]byte(req.To)) {
+		return IssueResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, req.To)
+	}
+	if err := trade.ValidateSymbol(req.Symbol); err != nil {
+		return IssueResult{}, err
+	}
+	if err := preparePayload(req.Payload); err != nil {
+		return IssueResult{}, err
+	}
+	issuer, err := wallet.UnlockWallet(req.Address, req.Passphrase)
+	if err != nil {
+		return IssueResult{}, err
+	}
+
+	asset := trade.AssetID(util.AddressToPublicHash([]byte(req.Address)), req.Symbol)
+	leg := blockchain.TradeLeg{
+		From:      issuer.PublicKey,
+		Transfers: []blockchain.Transfer{{To: util.AddressToPublicHash([]byte(req.To)), Asset: asset, Amount: req.Amount}},
+		Fee:       req.Fee,
+		Issue:     map[string]int{asset: req.Amount},
+		Key:       &issuer.PrivateKey,
+	}
+	t, err := s.submit([]blockchain.TradeLeg{leg}, req.Description, req.Payload)
+	if err != nil {
+		return IssueResult{}, err
+	}
+	return IssueResult{
+		Success: true,
+		Message: "发行交易已提交，打包进区块后生效",
+		Asset:   asset,
+		TradeID: hex.EncodeToString(t.ID),
+	}, nil
+}
+
+// Mint 在生产环节铸造单品，发行方address必须已在链上登记为原料厂或生产商
+// 每个序列号铸造一个属于资产symbol的单品转给to，to为空时留在发行方；序列号在链上必须唯一
+func (s *Service) Mint(req MintRequest) (MintResult, error) {
+	if !util.ValidateAddress([]byte(req.Address)) {
+		return MintResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, req.Address)
+	}
+	if req.To == "" {
+		req.To = req.Address
+	}
+	if !util.ValidateAddress([]byte(req.To)) {
+		return MintResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, req.To)
+	}
+	if err := trade.ValidateSymbol(req.Symbol); err != nil {
+		return MintResult{}, err
+	}
+	if len(req.Serials) == 0 {
+		return MintResult{}, fmt.Errorf("%w: 没有要铸造的序列号", trade.ErrInvalidSerial)
+	}
+	seen := make(map[string]bool)
+	for _, serial := range req.Serials {
+		if err := trade.ValidateSerial(serial); err != nil {
+			return MintResult{}, err
+		}
+		if seen[serial] {
+			return MintResult{}, fmt.Errorf("%w: 序列号%s重复", trade.ErrInvalidSerial, serial)
+		}
+		seen[serial] = true
+	}
+	if err := preparePayload(req.Payload); err != nil {
+		return MintResult{}, err
+	}
+	issuer, err := wallet.UnlockWallet(req.Address, req.Passphrase)
+	if err != nil {
+		return MintResult{}, err
+	}
+
+	asset := trade.AssetID(util.AddressToPublicHash([]byte(req.Address)), req.Symbol)
+	to := util.AddressToPublicHash([]byte(req.To))
+	leg := blockchain.TradeLeg{From: issuer.PublicKey, Fee: req.Fee, Key: &issuer.PrivateKey}
+	for _, serial := range req.Serials {
+		leg.Mint = append(leg.Mint, blockchain.Transfer{To: to, Asset: asset, Serial: serial})
+	}
+	t, err := s.submit([]blockchain.TradeLeg{leg}, req.Description, req.Payload)
+	if err != nil {
+		return MintResult{}, err
+	}
+	return MintResult{
+		Success: true,
+		Message: "铸造交易已提交，打包进区块后生效",
+		Asset:   asset,
+		Serials: req.Serials,
+		TradeID: hex.EncodeToString(t.ID),
+	}, nil
+}
+
+// Swap 双方在同一笔交易中交换资产，双方各自签名自己的输入，任一方余额不足时整笔交易不成立
+// 手续费由转出原生商品的一方承担，双方都转出其他资产时由A方承担；找零均返回付款方
+func (s *Service) Swap(req SwapRequest) (TradeResult, error) {
+	if req.A.Address == req.B.Address {
+		return TradeResult{}, fmt.Errorf("%w: 交换双方不能是同一地址", ErrInvalidAddress)
+	}
+	if err := preparePayload(req.Payload); err != nil {
+		return TradeResult{}, err
+	}
+	payer := &req.A
+	if req.A.Asset != trade.NativeAsset && req.B.Asset == trade.NativeAsset {
+		payer = &req.B
+	}
+
+	var legs []blockchain.TradeLeg
+	for _, side := range []struct{ from, to *SwapSide }{{&req.A, &req.B}, {&req.B, &req.A}} {
+		if !util.ValidateAddress([]byte(side.from.Address)) {
+			return TradeResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, side.from.Address)
+		}
+		if err := trade.ValidateAsset(side.from.Asset); err != nil {
+			return TradeResult{}, err
+		}
+		w, err := wallet.UnlockWallet(side.from.Address, side.from.Passphrase)
+		if err != nil {
+			return TradeResult{}, err
+		}
+		leg := blockchain.TradeLeg{
+			From:      w.PublicKey,
+			Transfers: []blockchain.Transfer{{To: util.AddressToPublicHash([]byte(side.to.Address)), Asset: side.from.Asset, Amount: side.from.Amount}},
+			Key:       &w.PrivateKey,
+		}
+		if side.from == payer {
+			leg.Fee = req.Fee
+		}
+		legs = append(legs, leg)
+	}
+
+	t, err := s.submit(legs, req.Description, req.Payload)
+	if err != nil {
+		return TradeResult{}, err
+	}
+	return TradeResult{Success: true, Message: "Trade successful", TradeID: hex.EncodeToString(t.ID)}, nil
+}
+
+// submit 创建交易并放入交易池，然后广播
+// 选择输出到放入交易池之间不能有其他交易插入，否则两笔交易可能选中同一个输出
+func (s *Service) submit(legs []blockchain.TradeLeg, des string, payload *trade.Payload) (*trade.Trade, error) {
+	var t *trade.Trade
+	err := s.update(func(chain *blockchain.BlockChain) error {
+		var err error
+		t, err = chain.CreateTrade(legs, des, payload)
+		if err != nil {
+			return err
+		}
+		return blockchain.GetMempool().Add(chain, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	network.BroadcastTrade(t)
+	return t, nil
+}
+
+// preparePayload 检查请求中的交易载荷，未填写版本时按当前版本处理，payload可以为nil
+func preparePayload(payload *trade.Payload) error {
+	if payload == nil {
+		return nil
+	}
+	if payload.Schema == 0 {
+		payload.Schema = trade.PayloadVersion
+	}
+	return payload.Validate()
+}
+
+// Register 由登记员将地址登记为identity身份，name为显示名称
+// 登记员即创建区块链的一方，其钱包需在本节点，用passphrase解锁；登记交易打包进区块后生效
+func (s *Service) Register(address, identity, name, passphrase string) (RegisterResult, error) {
+	if !util.ValidateAddress([]byte(address)) {
+		return RegisterResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+	}
+	if !util.Identity(identity).Valid() {
+		return RegisterResult{}, fmt.Errorf("%w: %s", ErrInvalidIdentity, identity)
+	}
+
+	var registrarHash []byte
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		var err error
+		registrarHash, err = chain.Registrar()
+		return err
+	})
+	if err != nil {
+		return RegisterResult{}, err
+	}
+	registrarAddress := string(util.PublicHashToAddress(registrarHash))
+	registrarWallet, err := wallet.UnlockWallet(registrarAddress, passphrase)
+	if errors.Is(err, wallet.ErrWalletNotFound) {
+		return RegisterResult{}, fmt.Errorf("%w: 本节点没有登记员%s的钱包", blockchain.ErrNotRegistrar, registrarAddress)
+	}
+	if err != nil {
+		return RegisterResult{}, err
+	}
+
+	t, err := trade.NewRegistration(util.AddressToPublicHash([]byte(address)), util.Identity(identity), name, registrarWallet.PrivateKey)
+	if err != nil {
+		return RegisterResult{}, err
+	}
+	err = s.view(func(chain *blockchain.BlockChain) error {
+		return blockchain.GetMempool().Add(chain, t)
+	})
+	if err != nil {
+		return RegisterResult{}, err
+	}
+	network.BroadcastTrade(t)
+
+	return RegisterResult{
+		Success: true,
+		Message: "登记交易已提交，打包进区块后生效",
+		TradeID: hex.EncodeToString(t.ID),
+	}, nil
+}
+
+// inheritIdentity 由已登记的parent把派生的地址登记为与自己相同的身份，parent尚未登记时不做处理
+// 登记交易打包进区块后生效
+func (s *Service) inheritIdentity(parent *wallet.Wallet, pubKeyHash []byte) error {
+	var t *trade.Trade
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		rec, err := chain.GetIdentity(util.PublicKeyHash(parent.PublicKey))
+		if errors.Is(err, blockchain.ErrIdentityNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if t, err = trade.NewRegistration(pubKeyHash, rec.Identity, rec.Name, parent.PrivateKey); err != nil {
+			return err
+		}
+		return blockchain.GetMempool().Add(chain, t)
+	})
+	if err != nil || t == nil {
+		return err
+	}
+	network.BroadcastTrade(t)
+	return nil
+}
+
+// isRegistered 判断地址是否已在主链上登记身份
+func (s *Service) isRegistered(pubKeyHash []byte) (bool, error) {
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		_, err := chain.GetIdentity(pubKeyHash)
+		return err
+	})
+	if errors.Is(err, blockchain.ErrIdentityNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// IsEmpty 判断本地是否还没有区块链
+func (s *Service) IsEmpty() bool {
+	empty := true
+	s.chain.View(func(chain *blockchain.BlockChain) error {
+		empty = chain.IsEmpty()
+		return nil
+	})
+	return empty
+}
+
+// LoadMempool 载入上次退出时保存的交易池
+func (s *Service) LoadMempool() error {
+	return s.chain.View(func(chain *blockchain.BlockChain) error {
+		return blockchain.GetMempool().LoadFile(chain)
+	})
+}
+
+// minerAddress 确定接收挖矿奖励的钱包地址，miner为空时使用默认的矿工地址
+func (s *Service) minerAddress(miner string) (string, error) {
+	if miner == "" {
+		miner = s.Miner
+	}
+	if miner != "" && !util.ValidateAddress([]byte(miner)) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidAddress, miner)
+	}
+	return miner, nil
+}
+
+// Mine 挖矿，miner为接收挖矿奖励的钱包地址，为空时使用默认的矿工地址
+// 寻找nonce期间不阻塞其他请求，ctx被取消时放弃
+func (s *Service) Mine(ctx context.Context, miner string) (MiningResult, error) {
+	miner, err := s.minerAddress(miner)
+	if err != nil {
+		return MiningResult{}, err
+	}
+	var minerAddress []byte
+	if miner != "" {
+		minerAddress = util.AddressToPublicHash([]byte(miner))
+	}
+
+	block, result, err := s.chain.Mine(ctx, minerAddress)
+	if err != nil {
+		return MiningResult{}, err
+	}
+	network.BroadcastBlock(block)
 
 	return MiningResult{
-		Message: "Mining successful",
+		Message:  "Mining successful",
+		Hash:     hex.EncodeToString(block.Hash),
+		Height:   block.Height,
+		Hashes:   result.Hashes,
+		HashRate: result.HashRate(),
+	}, nil
+}
+
+// StartMining 开始后台挖矿，miner为空时使用默认的矿工地址
+func (s *Service) StartMining(miner string) (MinerStatusResult, error) {
+	miner, err := s.minerAddress(miner)
+	if err != nil {
+		return MinerStatusResult{}, err
 	}
+	if err := s.miner.Start(miner); err != nil {
+		return MinerStatusResult{}, err
+	}
+	return s.MiningStatus(), nil
+}
+
+// StopMining 停止后台挖矿
+func (s *Service) StopMining() MinerStatusResult {
+	s.miner.Stop()
+	return s.MiningStatus()
 }
 
-func (s *Service) CreateWallet(refname string, identity util.Identity) CreateWalletResult {
+// MiningStatus 获取后台挖矿的运行状态和算力
+func (s *Service) MiningStatus() MinerStatusResult {
+	return MinerStatusResult(s.miner.Stats())
+}
+
+// CreateWallet 创建钱包，私钥用passphrase加密保存
+func (s *Service) CreateWallet(refname string, identity util.Identity, passphrase string) (CreateWalletResult, error) {
 	newWallet := wallet.NewWallet(identity)
 
-	newWallet.SaveWallet()
-	refList := wallet.LoadRefList()
-	refList.SetRef(string(newWallet.Address()), refname)
-	refList.Save()
+	if err := newWallet.SaveWallet(passphrase); err != nil {
+		return CreateWalletResult{}, err
+	}
+	if err := setRef(string(newWallet.Address()), refname, false); err != nil {
+		return CreateWalletResult{}, err
+	}
 	return CreateWalletResult{
+		Success: true,
 		Message: "Succeed in creating wallet.",
+		Address: string(newWallet.Address()),
+	}, nil
+}
+
+// setRef 记录钱包别名，rescan时先扫描钱包目录中新增的钱包文件
+func setRef(address, refname string, rescan bool) error {
+	refList, err := wallet.LoadRefList()
+	if err != nil {
+		return err
+	}
+	if rescan {
+		if err := refList.Update(); err != nil {
+			return err
+		}
+	}
+	refList.SetRef(address, refname)
+	return refList.Save()
+}
+
+// CreateHDWallet 创建分层确定性钱包，mnemonic为空时生成新的助记词，否则从助记词恢复
+func (s *Service) CreateHDWallet(refname string, identity util.Identity, passphrase, mnemonic string) (CreateHDWalletResult, error) {
+	lookahead := util.HDLookahead
+	if mnemonic == "" {
+		var err error
+		if mnemonic, err = wallet.NewMnemonic(); err != nil {
+			return CreateHDWalletResult{}, err
+		}
+		lookahead = 1
+	}
+	hd, err := wallet.CreateHDWallet(mnemonic, identity, passphrase, lookahead)
+	if err != nil {
+		return CreateHDWalletResult{}, err
+	}
+
+	if err := setRef(hd.ID, refname, true); err != nil {
+		return CreateHDWalletResult{}, err
+	}
+	return CreateHDWalletResult{
+		Success:  true,
+		Message:  "Succeed in creating HD wallet.",
+		Address:  hd.ID,
+		Mnemonic: mnemonic,
+	}, nil
+}
+
+// NewAddress 为分层确定性钱包派生新的收款或找零地址
+func (s *Service) NewAddress(address string, change bool, passphrase string) (CreateWalletResult, error) {
+	hd, err := wallet.FindHDWallet(address)
+	if err != nil {
+		return CreateWalletResult{}, err
+	}
+	chain := wallet.ChainReceive
+	if change {
+		chain = wallet.ChainChange
+	}
+	w, err := hd.NewAddress(chain, passphrase)
+	if err != nil {
+		return CreateWalletResult{}, err
+	}
+	// 钱包的第一个地址已登记时新地址继承其身份，设置了流转规则时登记后才能收款
+	first, err := wallet.UnlockWallet(hd.ID, passphrase)
+	if err != nil {
+		return CreateWalletResult{}, err
+	}
+	if err := s.inheritIdentity(first, util.PublicKeyHash(w.PublicKey)); err != nil {
+		return CreateWalletResult{}, err
+	}
+
+	if err := setRef(string(w.Address()), "", false); err != nil {
+		return CreateWalletResult{}, err
+	}
+	return CreateWalletResult{Success: true, Message: "Succeed in deriving address.", Address: string(w.Address())}, nil
+}
+
+// HDWalletInfo 获取分层确定性钱包派生的全部地址及余额
+func (s *Service) HDWalletInfo(address string) (HDWalletInfoResult, error) {
+	hd, err := wallet.FindHDWallet(address)
+	if err != nil {
+		return HDWalletInfoResult{}, err
+	}
+
+	result := HDWalletInfoResult{Success: true, ID: hd.ID, Identity: string(hd.Identity)}
+	err = s.view(func(chain *blockchain.BlockChain) error {
+		balances := func(addresses []string) ([]BalanceResult, error) {
+			var list []BalanceResult
+			for _, a := range addresses {
+				utxos, err := chain.UTXOSet().FindUTXOs(util.AddressToPublicHash([]byte(a)))
+				if err != nil {
+					return nil, err
+				}
+				balance := 0
+				for _, utxo := range utxos {
+					if utxo.Out.Asset == trade.NativeAsset {
+						balance += utxo.Out.Num
+					}
+				}
+				list = append(list, BalanceResult{Address: a, Balance: balance})
+				result.Balance += balance
+			}
+			return list, nil
+		}
+		var err error
+		if result.Receive, err = balances(hd.Receive); err != nil {
+			return err
+		}
+		result.Change, err = balances(hd.Change)
+		return err
+	})
+	if err != nil {
+		return HDWalletInfoResult{}, err
 	}
+	return result, nil
 }
 
-func (s *Service) WalletInfo(address string) WalletInfoResult {
-	wlt := wallet.LoadWallet(address)
-	refList := wallet.LoadRefList()
+func (s *Service) WalletInfo(address string) (WalletInfoResult, error) {
+	refList, err := wallet.LoadRefList()
+	if err != nil {
+		return WalletInfoResult{}, err
+	}
+	return s.walletInfo(address, (*refList)[address])
+}
+
+// walletInfo 组装钱包信息，身份以链上登记的为准
+// 地址尚未登记时Identity为本地钱包文件中声明的身份，Registered为false
+func (s *Service) walletInfo(address, refname string) (WalletInfoResult, error) {
+	wlt, err := wallet.LoadWallet(address)
+	if err != nil {
+		return WalletInfoResult{}, err
+	}
+	rec, err := s.chainIdentity(util.AddressToPublicHash([]byte(address)))
+	if err != nil {
+		return WalletInfoResult{}, err
+	}
 
-	return WalletInfoResult{
+	info := WalletInfoResult{
 		Address:       address,
 		PublicKey:     fmt.Sprintf("%x", wlt.PublicKey),
-		ReferenceName: (*refList)[address],
+		ReferenceName: refname,
 		Identity:      string(wlt.Identity),
 	}
+	if rec != nil {
+		info.Identity = string(rec.Identity)
+		info.Name = rec.Name
+		info.Registered = true
+	}
+	return info, nil
+}
+
+// chainIdentity 查询公钥哈希在链上登记的身份，未登记或尚未创建区块链时返回nil
+func (s *Service) chainIdentity(pubKeyHash []byte) (*blockchain.IdentityRecord, error) {
+	var rec *blockchain.IdentityRecord
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		var err error
+		rec, err = chain.GetIdentity(pubKeyHash)
+		return err
+	})
+	if errors.Is(err, blockchain.ErrIdentityNotFound) || errors.Is(err, blockchain.ErrChainNotFound) {
+		return nil, nil
+	}
+	return rec, err
+}
+
+// Identity 查询地址在链上登记的身份和名称，任何节点都可以查询，不需要持有钱包文件
+func (s *Service) Identity(address string) (IdentityResult, error) {
+	if !util.ValidateAddress([]byte(address)) {
+		return IdentityResult{}, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+	}
+	rec, err := s.chainIdentity(util.AddressToPublicHash([]byte(address)))
+	if err != nil {
+		return IdentityResult{}, err
+	}
+	if rec == nil {
+		return IdentityResult{}, fmt.Errorf("%w: %s", blockchain.ErrIdentityNotFound, address)
+	}
+	return IdentityResult{
+		Success:  true,
+		Address:  address,
+		Identity: string(rec.Identity),
+		Name:     rec.Name,
+		TradeID:  hex.EncodeToString(rec.TradeID),
+	}, nil
 }
 
-func (s *Service) WalletInfoRefName(refname string) WalletInfoResult {
-	refList := wallet.LoadRefList()
-	address, _ := refList.FindRef(refname) // 这里忽略错误处理，根据您的指示
+// findRef 通过别名查找钱包地址
+func findRef(refname string) (string, error) {
+	refList, err := wallet.LoadRefList()
+	if err != nil {
+		return "", err
+	}
+	address, err := refList.FindRef(refname)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, refname)
+	}
+	return address, nil
+}
 
+func (s *Service) WalletInfoRefName(refname string) (WalletInfoResult, error) {
+	address, err := findRef(refname)
+	if err != nil {
+		return WalletInfoResult{}, err
+	}
 	return s.WalletInfo(address)
 }
 
-func (s *Service) UpdateWallets() UpdateWalletsResult {
-	refList := wallet.LoadRefList()
-	refList.Update()
-	refList.Save()
+func (s *Service) UpdateWallets() (UpdateWalletsResult, error) {
+	refList, err := wallet.LoadRefList()
+	if err != nil {
+		return UpdateWalletsResult{}, err
+	}
+	if err := refList.Update(); err != nil {
+		return UpdateWalletsResult{}, err
+	}
+	if err := refList.Save(); err != nil {
+		return UpdateWalletsResult{}, err
+	}
 	return UpdateWalletsResult{
 		Message: ("Succeed in updating wallets."),
-	}
+	}, nil
 }
 
-func (s *Service) WalletsList() WalletsListResult {
-	refList := wallet.LoadRefList()
+func (s *Service) WalletsList() (WalletsListResult, error) {
+	refList, err := wallet.LoadRefList()
+	if err != nil {
+		return WalletsListResult{}, err
+	}
 	var wallets []WalletInfoResult
 
-	for address := range *refList {
-		wlt := wallet.LoadWallet(address)
-		walletInfo := WalletInfoResult{
-			Address:       address,
-			PublicKey:     fmt.Sprintf("%x", wlt.PublicKey),
-			ReferenceName: (*refList)[address],
-			Identity:      string(wlt.Identity),
+	for address, refname := range *refList {
+		walletInfo, err := s.walletInfo(address, refname)
+		if err != nil {
+			return WalletsListResult{}, err
 		}
 		wallets = append(wallets, walletInfo)
 	}
 	return WalletsListResult{
 		Wallets: wallets,
-	}
+	}, nil
 }
 
-func (s *Service) SendRefName(fromRefname, toRefname string, amount int, des string) TradeResult {
-	refList := wallet.LoadRefList()
-
-	fromAddress, err := refList.FindRef(fromRefname)
+func (s *Service) SendRefName(fromRefname, toRefname string, amount, fee int, des, passphrase string) (TradeResult, error) {
+	fromAddress, err := findRef(fromRefname)
 	if err != nil {
-		return TradeResult{Success: false, Message: "Failed to find sender address: " + err.Error()}
+		return TradeResult{}, err
 	}
 
-	toAddress, err := refList.FindRef(toRefname)
+	toAddress, err := findRef(toRefname)
 	if err != nil {
-		return TradeResult{Success: false, Message: "Failed to find receiver address: " + err.Error()}
+		return TradeResult{}, err
 	}
 
-	return s.Send(fromAddress, toAddress, amount, des)
+	return s.Send(fromAddress, toAddress, trade.NativeAsset, amount, fee, des, passphrase, nil)
 }
 
-func (s *Service) CreateBlockChainRefName(refname string) BlockchainCreationResult {
-	refList := wallet.LoadRefList()
-	address, err := refList.FindRef(refname)
-	util.Err(err)
+func (s *Service) CreateBlockChainRefName(refname string) (BlockchainCreationResult, error) {
+	address, err := findRef(refname)
+	if err != nil {
+		return BlockchainCreationResult{}, err
+	}
 	return s.CreateBlockChain(address)
 }
 
-func (s *Service) BalanceRefName(refname string) BalanceResult {
-	refList := wallet.LoadRefList()
-	address, err := refList.FindRef(refname)
-	util.Err(err)
+func (s *Service) BalanceRefName(refname string) (BalanceResult, error) {
+	address, err := findRef(refname)
+	if err != nil {
+		return BalanceResult{}, err
+	}
 	return s.Balance(address)
 }
 
-func (s *Service) getAllBalance() getAllBalanceResult {
+// balancesRefName 按别名查询多个钱包的余额
+func (s *Service) balancesRefName(refnames ...string) ([]int, error) {
+	balances := make([]int, len(refnames))
+	for i, refname := range refnames {
+		result, err := s.BalanceRefName(refname)
+		if err != nil {
+			return nil, err
+		}
+		balances[i] = result.Balance
+	}
+	return balances, nil
+}
+
+func (s *Service) getAllBalance() (getAllBalanceResult, error) {
+	balances, err := s.balancesRefName("原料厂", "贵州生产商", "北京经销商", "上海经销商", "天津经销商", "用户")
+	if err != nil {
+		return getAllBalanceResult{}, err
+	}
 	return getAllBalanceResult{
-		Raw_balance:        strconv.Itoa(s.BalanceRefName("原料厂").Balance),
-		A_producer_balance: strconv.Itoa(s.BalanceRefName("贵州生产商").Balance),
-		A_dealer_balance:   strconv.Itoa(s.BalanceRefName("北京经销商").Balance),
-		B_dealer_balance:   strconv.Itoa(s.BalanceRefName("上海经销商").Balance),
-		C_dealer_balance:   strconv.Itoa(s.BalanceRefName("天津经销商").Balance),
-		User_balance:       strconv.Itoa(s.BalanceRefName("用户").Balance),
+		Raw_balance:        strconv.Itoa(balances[0]),
+		A_producer_balance: strconv.Itoa(balances[1]),
+		A_dealer_balance:   strconv.Itoa(balances[2]),
+		B_dealer_balance:   strconv.Itoa(balances[3]),
+		C_dealer_balance:   strconv.Itoa(balances[4]),
+		User_balance:       strconv.Itoa(balances[5]),
+	}, nil
+}
+
+// traceCurrency 追溯最新区块中第一笔转账经过的供应链环节
+func (s *Service) traceCurrency() ([]TraceTrade, error) {
+	var root []byte
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		block, err := chain.GetBlock(chain.LastHash)
+		if err != nil {
+			return err
+		}
+		for _, t := range block.TradeList {
+			if !t.IsFirstTrade() {
+				root = t.ID
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		util.Info("最新区块中没有转账交易！")
+		return nil, nil
 	}
+	return s.traceFrom(root)
 }
 
-func (s *Service) traceCurrency() []TraceTrade {
+// traceFrom 由交易的上游溯源图生成溯源记录
+// 起点交易的收款方为用户时作为第一条记录，其余按区块从新到旧，经销商和生产商各取最近一笔收款交易
+func (s *Service) traceFrom(tradeID []byte) ([]TraceTrade, error) {
+	graph, err := s.provenance(tradeID, -1, false)
+	if err != nil {
+		return nil, err
+	}
 
-	hasDealer := false
-	hasProducer := false
+	traced := []TraceTrade{}
+	seen := make(map[string]bool)
+	for _, node := range graph.Nodes {
+		if len(node.Outputs) == 0 {
+			continue
+		}
+		payee := node.Outputs[0]
+		switch util.Identity(payee.Identity) {
+		case util.User:
+			if node.ID != graph.Root {
+				continue
+			}
+		case util.Dealer, util.Producer:
+			if seen[payee.Identity] {
+				continue
+			}
+		default:
+			continue
+		}
+		seen[payee.Identity] = true
+		traced = append(traced, TraceTrade{
+			Time:        node.Time,
+			Description: node.Description,
+			Payload:     node.Payload,
+			Address:     payee.Address,
+			Identity:    payee.Identity,
+			Name:        payee.Name,
+		})
+		util.Info(node.Description)
+	}
+	return traced, nil
+}
 
-	blocks := s.GetBlockChainInfo()
-	// 检查区块链是否为空
-	if len(blocks) == 0 {
-		util.Info("区块链暂无区块！")
-		return nil
+// Provenance 查询交易的溯源图，ref为交易ID，或“交易ID:输出序号”形式的输出引用
+// 上游追溯到初始订单或挖矿奖励交易；downstream为true时同时追踪输出被花费的去向，输出引用只追踪该输出
+func (s *Service) Provenance(ref string, downstream bool) (ProvenanceResult, error) {
+	tradeID, outID, err := parseOutputRef(ref)
+	if err != nil {
+		return ProvenanceResult{}, err
 	}
-	// 从最新的区块的第一个交易开始追溯
-	currentTrade := blocks[0].Trades[0] // 最新区块的第一个交易
-	//fmt.Printf("Starting trace from trade %s\n", currentTrade.ID)
-	tradeTrade := []TraceTrade{}
-	if strings.Contains(blocks[0].Trades[0].Description, "用户") {
-		tradeTrade = append(tradeTrade, TraceTrade{
-			Time:        blocks[0].Timestamp,
-			Description: currentTrade.Description,
-		},
-		)
-		util.Info(currentTrade.Description)
-	}
-
-	for {
-		// 打印当前交易信息
-		for _, input := range currentTrade.Inputs {
-			//fmt.Printf("Input from trade %s, output index %d, pubKey %s\n", input.TradeID, input.OutID, input.PubKey)
-			// 寻找输入来源交易
-			found := false
-			for _, block := range blocks {
-				for _, trade := range block.Trades {
-					if trade.ID == input.TradeID {
-						currentTrade = trade
-						if strings.Contains(currentTrade.Description, "经销商") && hasDealer == false {
-
-							tradeTrade = append(tradeTrade, TraceTrade{
-								Time:        block.Timestamp,
-								Description: currentTrade.Description,
-							},
-							)
-							util.Info(currentTrade.Description)
-							hasDealer = true
-						}
-						if strings.Contains(currentTrade.Description, "生产商") && hasProducer == false {
-
-							tradeTrade = append(tradeTrade, TraceTrade{
-								Time:        block.Timestamp,
-								Description: currentTrade.Description,
-							},
-							)
-							util.Info(currentTrade.Description)
-							hasProducer = true
-						}
-
-						found = true
-						break
-					}
-				}
-				if found {
-					break
-				}
+	return s.provenance(tradeID, outID, downstream)
+}
+
+// parseOutputRef 解析交易ID或“交易ID:输出序号”，只有交易ID时输出序号为-1
+func parseOutputRef(ref string) ([]byte, int, error) {
+	idPart, outPart, hasOut := strings.Cut(ref, ":")
+	tradeID, err := hex.DecodeString(idPart)
+	if err != nil || len(tradeID) == 0 {
+		return nil, 0, fmt.Errorf("%w: %s", ErrInvalidHash, ref)
+	}
+	if !hasOut {
+		return tradeID, -1, nil
+	}
+	outID, err := strconv.Atoi(outPart)
+	if err != nil || outID < 0 {
+		return nil, 0, fmt.Errorf("%w: 输出序号%s", ErrInvalidHash, outPart)
+	}
+	return tradeID, outID, nil
+}
+
+// provenance 构建溯源图，并查询各输出收款方在链上登记的身份
+// 节点按区块从新到旧排列，同一区块内保持交易顺序
+func (s *Service) provenance(tradeID []byte, outID int, downstream bool) (ProvenanceResult, error) {
+	var graph *blockchain.ProvenanceGraph
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		var err error
+		graph, err = chain.Provenance(tradeID, outID, downstream)
+		return err
+	})
+	if err != nil {
+		return ProvenanceResult{}, err
+	}
+
+	nodes := append([]*blockchain.ProvenanceNode{}, graph.Nodes...)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Height > nodes[j].Height
+	})
+	// 同一地址可能多次出现，身份只查询一次
+	identities := make(map[string]*blockchain.IdentityRecord)
+	payee := func(pubKeyHash []byte) (string, *blockchain.IdentityRecord, error) {
+		address := string(util.PublicHashToAddress(pubKeyHash))
+		rec, ok := identities[address]
+		if !ok {
+			var err error
+			if rec, err = s.chainIdentity(pubKeyHash); err != nil {
+				return "", nil, err
 			}
-			if !found {
-				util.Err(errors.New("源交易未找到..."))
-				return nil
+			identities[address] = rec
+		}
+		return address, rec, nil
+	}
+
+	result := ProvenanceResult{Success: true, Root: hex.EncodeToString(graph.Root), Truncated: graph.Truncated}
+	for _, n := range nodes {
+		info := ProvenanceNodeInfo{
+			ID:          hex.EncodeToString(n.Trade.ID),
+			BlockHash:   hex.EncodeToString(n.BlockHash),
+			Height:      n.Height,
+			Time:        n.Time.Format("2006-01-02 15:04:05"),
+			Description: n.Trade.Description,
+			Payload:     n.Trade.Payload,
+		}
+		for i, out := range n.Trade.Outputs {
+			address, rec, err := payee(out.HashPublicKey)
+			if err != nil {
+				return ProvenanceResult{}, err
 			}
-			if currentTrade.Description == "first trade" {
-				util.Info("到达首次交易！")
-				return tradeTrade
+			output := ProvenanceOutputInfo{OutID: i, Num: out.Num, Asset: out.Asset, Serial: out.Serial, Address: address}
+			if rec != nil {
+				output.Identity = string(rec.Identity)
+				output.Name = rec.Name
 			}
+			info.Outputs = append(info.Outputs, output)
+		}
+		result.Nodes = append(result.Nodes, info)
+	}
+	for _, e := range graph.Edges {
+		address, rec, err := payee(e.Out.HashPublicKey)
+		if err != nil {
+			return ProvenanceResult{}, err
+		}
+		edge := ProvenanceEdgeInfo{
+			From:    hex.EncodeToString(e.From),
+			OutID:   e.OutID,
+			To:      hex.EncodeToString(e.To),
+			Num:     e.Out.Num,
+			Asset:   e.Out.Asset,
+			Serial:  e.Out.Serial,
+			Address: address,
 		}
+		if rec != nil {
+			edge.Identity = string(rec.Identity)
+			edge.Name = rec.Name
+		}
+		result.Edges = append(result.Edges, edge)
 	}
+	return result, nil
 }
 
-func (s *Service) buy() BuyResult {
-	if s.BalanceRefName("北京经销商").Balance+s.BalanceRefName("上海经销商").Balance+s.BalanceRefName("天津经销商").Balance <= 0 {
+// provenanceDOT 将溯源图导出为Graphviz的DOT格式，起点交易加粗显示
+// 节点标注交易ID前缀、时间和描述，边标注流转的数量及经手方
+func provenanceDOT(result ProvenanceResult) string {
+	var b strings.Builder
+	b.WriteString("digraph provenance {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, n := range result.Nodes {
+		label := fmt.Sprintf("%s\n%s 高度%d\n%s", shortID(n.ID), n.Time, n.Height, n.Description)
+		style := ""
+		if n.ID == result.Root {
+			style = ", style=bold"
+		}
+		fmt.Fprintf(&b, "\t%q [label=%q%s];\n", n.ID, label, style)
+	}
+	for _, e := range result.Edges {
+		holder := e.Address
+		if e.Name != "" {
+			holder = fmt.Sprintf("%s(%s)", e.Name, e.Identity)
+		}
+		amount := strconv.Itoa(e.Num)
+		if e.Asset != trade.NativeAsset {
+			amount += " " + e.Asset
+		}
+		if e.Serial != "" {
+			amount += " #" + e.Serial
+		}
+		fmt.Fprintf(&b, "\t%q -> %q [label=%q];\n", e.From, e.To, fmt.Sprintf("#%d %s %s", e.OutID, amount, holder))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
 
-		return BuyResult{
-			Success: false,
-			Message: "经销商余量不足",
+// Item 查询单品的当前持有方及从铸造开始的全部经手记录
+func (s *Service) Item(serial string) (ItemResult, error) {
+	var history *blockchain.ItemHistory
+	err := s.view(func(chain *blockchain.BlockChain) error {
+		var err error
+		history, err = chain.Item(serial)
+		return err
+	})
+	if err != nil {
+		return ItemResult{}, err
+	}
+
+	custody, err := s.custodyInfo(history.Custody)
+	if err != nil {
+		return ItemResult{}, err
+	}
+	current := custody[len(custody)-1]
+	return ItemResult{
+		Success:  true,
+		Serial:   history.Serial,
+		Asset:    history.Asset,
+		Owner:    current.Address,
+		Identity: current.Identity,
+		Name:     current.Name,
+		History:  custody,
+	}, nil
+}
+
+// custodyInfo 将经手记录转换为接口返回的信息，并查询各收款方在链上登记的身份
+func (s *Service) custodyInfo(custody []blockchain.ItemCustody) ([]ItemCustodyInfo, error) {
+	identities := make(map[string]*blockchain.IdentityRecord)
+	var list []ItemCustodyInfo
+	for _, c := range custody {
+		address := string(util.PublicHashToAddress(c.Out.HashPublicKey))
+		rec, ok := identities[address]
+		if !ok {
+			var err error
+			if rec, err = s.chainIdentity(c.Out.HashPublicKey); err != nil {
+				return nil, err
+			}
+			identities[address] = rec
+		}
+		info := ItemCustodyInfo{
+			TradeID:     hex.EncodeToString(c.Node.Trade.ID),
+			OutID:       c.OutID,
+			BlockHash:   hex.EncodeToString(c.Node.BlockHash),
+			Height:      c.Node.Height,
+			Time:        c.Node.Time.Format("2006-01-02 15:04:05"),
+			Description: c.Node.Trade.Description,
+			Payload:     c.Node.Trade.Payload,
+			Address:     address,
 		}
+		if rec != nil {
+			info.Identity = string(rec.Identity)
+			info.Name = rec.Name
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+// IssueToken 由address为主链上的一个输出签发防伪凭证，output的格式为“交易ID:序号”
+// 签发前先对照主链校验，签发方无权为该输出签发凭证时返回ErrTokenDenied
+func (s *Service) IssueToken(req TokenRequest) (TokenResult, error) {
+	tradeID, outID, err := parseOutputRef(req.Output)
+	if err != nil {
+		return TokenResult{}, err
+	}
+	if outID < 0 {
+		return TokenResult{}, fmt.Errorf("%w: 缺少输出序号", ErrInvalidHash)
+	}
+	issuer, err := wallet.UnlockWallet(req.Address, req.Passphrase)
+	if err != nil {
+		return TokenResult{}, err
+	}
+	token, err := trade.NewProductToken(tradeID, outID, issuer.PrivateKey)
+	if err != nil {
+		return TokenResult{}, err
+	}
+
+	var check *blockchain.TokenVerification
+	err = s.view(func(chain *blockchain.BlockChain) error {
+		var err error
+		check, err = chain.VerifyToken(token)
+		return err
+	})
+	if err != nil {
+		return TokenResult{}, err
+	}
+	switch check.Status {
+	case blockchain.TokenUnknown:
+		return TokenResult{}, fmt.Errorf("%w: %s", blockchain.ErrTradeNotFound, check.Detail)
+	case blockchain.TokenGenuine:
+	default:
+		return TokenResult{}, fmt.Errorf("%w: %s", ErrTokenDenied, check.Detail)
+	}
+	return TokenResult{
+		Success: true,
+		Message: "防伪凭证已签发",
+		Token:   token.String(),
+		TradeID: hex.EncodeToString(tradeID),
+		OutID:   outID,
+	}, nil
+}
+
+// VerifyToken 校验二维码中的防伪凭证，返回是否为正品、经手记录以及是否已被消费者认领
+// 凭证无法解析时返回错误，签名无效、输出不存在或签发方无权签发时Genuine为false
+func (s *Service) VerifyToken(encoded string) (VerifyResult, error) {
+	token, err := trade.ParseProductToken(encoded)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	var check *blockchain.TokenVerification
+	err = s.view(func(chain *blockchain.BlockChain) error {
+		var err error
+		check, err = chain.VerifyToken(token)
+		return err
+	})
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	result := VerifyResult{
+		Success: true,
+		Genuine: check.Status == blockchain.TokenGenuine,
+		Status:  check.Status,
+		Detail:  check.Detail,
+		TradeID: hex.EncodeToString(token.TradeID),
+		OutID:   token.OutID,
+		Issuer:  string(util.PublicHashToAddress(check.Issuer)),
+	}
+	if !result.Genuine {
+		result.Message = "未能确认为正品: " + check.Detail
+		return result, nil
+	}
+	rec, err := s.chainIdentity(check.Issuer)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	if rec != nil {
+		result.IssuerIdentity, result.IssuerName = string(rec.Identity), rec.Name
+	}
+	result.Asset, result.Serial, result.Num = check.Out.Asset, check.Out.Serial, check.Out.Num
+	if result.Custody, err = s.custodyInfo(check.Custody); err != nil {
+		return VerifyResult{}, err
+	}
+	result.Claimable = check.Claimable
+	switch {
+	case !check.Claimable:
+		result.Message = "正品；凭证对应可分割的批次，经手记录包含其拆分后的所有去向，无法判断是否已售出给消费者"
+	case check.Claim < 0:
+		result.Message = "正品，尚未售出"
+	default:
+		result.Claimed, result.ClaimedBy = true, &result.Custody[check.Claim]
+		result.Message = fmt.Sprintf("正品，已于%s售出给消费者，如果您不是该消费者，手中的商品可能是仿冒品", result.ClaimedBy.Time)
+	}
+	return result, nil
+}
+
+// shortID 截取交易ID的前缀用于显示
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func (s *Service) buy() (BuyResult, error) {
+	dealers := []string{"北京经销商", "上海经销商", "天津经销商"}
+	balances, err := s.balancesRefName(dealers...)
+	if err != nil {
+		return BuyResult{}, err
+	}
+	if balances[0]+balances[1]+balances[2] <= 0 {
+		return BuyResult{}, fmt.Errorf("%w: 经销商余量不足", blockchain.ErrInsufficientFunds)
 	}
 	// 创建一个随机数生成器
 	rand.Seed(time.Now().UnixNano())
+	var sent TradeResult
 	selected := false
 	for selected == false {
 		randomIndex := rand.Intn(3)
-		switch randomIndex {
-		case 0:
-			if s.BalanceRefName("北京经销商").Balance > 0 {
-				s.SendRefName("北京经销商", "用户", 1, "用户购买")
-				selected = true
-			}
-		case 1:
-			if s.BalanceRefName("上海经销商").Balance > 0 {
-				s.SendRefName("上海经销商", "用户", 1, "用户购买")
-				selected = true
-			}
-		case 2:
-			if s.BalanceRefName("天津经销商").Balance > 0 {
-				s.SendRefName("天津经销商", "用户", 1, "用户购买")
-				selected = true
+		if balances[randomIndex] > 0 {
+			if sent, err = s.SendRefName(dealers[randomIndex], "用户", 1, 0, "用户购买", demoPassphrase); err != nil {
+				return BuyResult{}, err
 			}
+			selected = true
 		}
 	}
-	s.Mine()
+	if _, err := s.Mine(context.Background(), ""); err != nil {
+		return BuyResult{}, err
+	}
+	tradeID, err := hex.DecodeString(sent.TradeID)
+	if err != nil {
+		return BuyResult{}, err
+	}
+	traceTrades, err := s.traceFrom(tradeID)
+	if err != nil {
+		return BuyResult{}, err
+	}
 	return BuyResult{
 		Success:     true,
 		Message:     "购买成功",
-		TraceTrades: s.traceCurrency(),
-	}
+		TraceTrades: traceTrades,
+	}, nil
 
 }
 
-func (s *Service) producerBuy() ProducerBuyResult {
-	if s.BalanceRefName("原料厂").Balance <= 0 {
-		return ProducerBuyResult{
-			Success: false,
-			Message: "原料厂余量不足",
-		}
+func (s *Service) producerBuy() (ProducerBuyResult, error) {
+	balance, err := s.BalanceRefName("原料厂")
+	if err != nil {
+		return ProducerBuyResult{}, err
+	}
+	if balance.Balance <= 0 {
+		return ProducerBuyResult{}, fmt.Errorf("%w: 原料厂余量不足", blockchain.ErrInsufficientFunds)
 	}
 
-	s.SendRefName("原料厂", "贵州生产商", 1, "贵州生产商进货")
+	if _, err := s.SendRefName("原料厂", "贵州生产商", 1, 0, "贵州生产商进货", demoPassphrase); err != nil {
+		return ProducerBuyResult{}, err
+	}
 
-	s.Mine()
+	if _, err := s.Mine(context.Background(), ""); err != nil {
+		return ProducerBuyResult{}, err
+	}
 	return ProducerBuyResult{
 		Success: true,
 		Message: "进货成功",
-	}
+	}, nil
 
 }
 
-func (s *Service) dealerBuy() DealerBuyResult {
-	if s.BalanceRefName("贵州生产商").Balance <= 0 {
-
-		return DealerBuyResult{
-			Success: false,
-			Message: "生产商余量不足",
-		}
+func (s *Service) dealerBuy() (DealerBuyResult, error) {
+	balance, err := s.BalanceRefName("贵州生产商")
+	if err != nil {
+		return DealerBuyResult{}, err
+	}
+	if balance.Balance <= 0 {
+		return DealerBuyResult{}, fmt.Errorf("%w: 生产商余量不足", blockchain.ErrInsufficientFunds)
 	}
 	// 创建一个随机数生成器
 	rand.Seed(time.Now().UnixNano())
 
-	randomIndex := rand.Intn(3)
-	switch randomIndex {
-	case 0:
-		s.SendRefName("贵州生产商", "北京经销商", 1, "北京经销商进货")
-
-	case 1:
-		s.SendRefName("贵州生产商", "上海经销商", 1, "上海经销商进货")
-
-	case 2:
-		s.SendRefName("贵州生产商", "天津经销商", 1, "天津经销商进货")
-
+	dealers := []string{"北京经销商", "上海经销商", "天津经销商"}
+	dealer := dealers[rand.Intn(len(dealers))]
+	if _, err := s.SendRefName("贵州生产商", dealer, 1, 0, dealer+"进货", demoPassphrase); err != nil {
+		return DealerBuyResult{}, err
+	}
+	if _, err := s.Mine(context.Background(), ""); err != nil {
+		return DealerBuyResult{}, err
 	}
-	s.Mine()
 	return DealerBuyResult{
 		Success: true,
 		Message: "购买成功",
-	}
+	}, nil
 
 }
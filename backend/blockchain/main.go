@@ -14,6 +14,8 @@ package main
 //}
 
 func main() {
+	cli := CommandLine{}
+	cli.Run()
 
 	//blockchain := blockchain.InitBlockChain()
 	//time.Sleep(time.Second)
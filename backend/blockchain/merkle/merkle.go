@@ -0,0 +1,118 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// 叶子节点和中间节点使用不同的前缀计算哈希，防止用中间节点冒充叶子节点
+const (
+	leafPrefix = byte(0x00)
+	nodePrefix = byte(0x01)
+)
+
+// MerkleTree 默克尔树
+// Levels[0]为叶子节点，最后一层只有根节点
+type MerkleTree struct {
+	Levels [][][]byte
+}
+
+// ProofNode 证明路径上的一个兄弟节点
+type ProofNode struct {
+	Hash []byte // 兄弟节点的哈希
+	Left bool   // 兄弟节点是否位于左侧
+}
+
+// Proof 默克尔包含证明
+type Proof struct {
+	Index int         // 数据在叶子节点中的位置
+	Path  []ProofNode // 从叶子到根的兄弟节点
+}
+
+// HashLeaf 计算叶子节点哈希
+func HashLeaf(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{leafPrefix}, data...))
+	return hash[:]
+}
+
+// HashNode 计算中间节点哈希
+func HashNode(left, right []byte) []byte {
+	buf := make([]byte, 0, 1+len(left)+len(right))
+	buf = append(buf, nodePrefix)
+	buf = append(buf, left...)
+	buf = append(buf, right...)
+	hash := sha256.Sum256(buf)
+	return hash[:]
+}
+
+// NewMerkleTree 根据数据构建默克尔树
+// 某一层节点数为奇数时，最后一个节点直接提升到上一层，而不是与自身配对
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	tree := MerkleTree{}
+	if len(data) == 0 {
+		// 没有叶子节点时根哈希为空数据的哈希
+		empty := sha256.Sum256(nil)
+		tree.Levels = [][][]byte{{}, {empty[:]}}
+		return &tree
+	}
+
+	level := make([][]byte, len(data))
+	for i, d := range data {
+		level[i] = HashLeaf(d)
+	}
+	tree.Levels = append(tree.Levels, level)
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, HashNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		tree.Levels = append(tree.Levels, next)
+		level = next
+	}
+	return &tree
+}
+
+// Root 获取根哈希
+func (tree *MerkleTree) Root() []byte {
+	return tree.Levels[len(tree.Levels)-1][0]
+}
+
+// Proof 生成第index个数据的包含证明
+func (tree *MerkleTree) Proof(index int) (*Proof, bool) {
+	if index < 0 || index >= len(tree.Levels[0]) {
+		return nil, false
+	}
+
+	proof := Proof{Index: index}
+	for _, level := range tree.Levels[:len(tree.Levels)-1] {
+		if index%2 == 1 {
+			proof.Path = append(proof.Path, ProofNode{level[index-1], true})
+		} else if index+1 < len(level) {
+			proof.Path = append(proof.Path, ProofNode{level[index+1], false})
+		}
+		index /= 2
+	}
+	return &proof, true
+}
+
+// VerifyProof 验证数据是否包含在根哈希为root的默克尔树中
+// 只需要数据本身、根哈希和证明，可以离线运行
+func VerifyProof(data, root []byte, proof *Proof) bool {
+	if proof == nil {
+		return false
+	}
+	hash := HashLeaf(data)
+	for _, node := range proof.Path {
+		if node.Left {
+			hash = HashNode(node.Hash, hash)
+		} else {
+			hash = HashNode(hash, node.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
@@ -0,0 +1,74 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// leaves 生成n个互不相同的数据
+func leaves(n int) [][]byte {
+	data := make([][]byte, n)
+	for i := range data {
+		data[i] = []byte(fmt.Sprintf("trade-%d", i))
+	}
+	return data
+}
+
+func TestProofOddLeafCounts(t *testing.T) {
+	tests := []struct {
+		leaves int
+		depth  []int // 各叶子的证明路径长度，奇数层末尾提升的节点没有兄弟节点
+	}{
+		{1, []int{0}},
+		{2, []int{1, 1}},
+		{3, []int{2, 2, 1}},
+		{5, []int{3, 3, 3, 3, 1}},
+		{6, []int{3, 3, 3, 3, 2, 2}},
+		{7, []int{3, 3, 3, 3, 3, 3, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d个叶子", tt.leaves), func(t *testing.T) {
+			data := leaves(tt.leaves)
+			tree := NewMerkleTree(data)
+			root := tree.Root()
+			for i, d := range data {
+				proof, ok := tree.Proof(i)
+				if !ok {
+					t.Fatalf("第%d个叶子没有证明", i)
+				}
+				if len(proof.Path) != tt.depth[i] {
+					t.Errorf("第%d个叶子的证明长度为%d，期望%d", i, len(proof.Path), tt.depth[i])
+				}
+				if !VerifyProof(d, root, proof) {
+					t.Errorf("第%d个叶子的证明未通过", i)
+				}
+				if VerifyProof([]byte("forged"), root, proof) {
+					t.Errorf("第%d个叶子的证明对其他数据通过", i)
+				}
+				if len(proof.Path) > 0 {
+					proof.Path[0].Left = !proof.Path[0].Left
+					if VerifyProof(d, root, proof) {
+						t.Errorf("第%d个叶子的证明交换左右后仍通过", i)
+					}
+				}
+			}
+			if _, ok := tree.Proof(tt.leaves); ok {
+				t.Errorf("越界的下标%d生成了证明", tt.leaves)
+			}
+		})
+	}
+}
+
+func TestOddLevelPromotesLastNode(t *testing.T) {
+	data := leaves(3)
+	want := HashNode(HashNode(HashLeaf(data[0]), HashLeaf(data[1])), HashLeaf(data[2]))
+	if root := NewMerkleTree(data).Root(); !bytes.Equal(root, want) {
+		t.Fatalf("根哈希为%x，期望%x", root, want)
+	}
+	// 末尾节点不与自身配对，重复最后一个数据得到不同的根哈希
+	duplicated := append(leaves(3), data[2])
+	if bytes.Equal(NewMerkleTree(duplicated).Root(), want) {
+		t.Fatal("重复最后一个叶子后根哈希不变")
+	}
+}
@@ -0,0 +1,595 @@
+package network
+
+import (
+	"blockchain/blockchain"
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+const (
+	protocol      = "tcp"
+	nodeVersion   = 1  // 节点协议版本
+	commandLength = 12 // 消息头中命令的长度
+)
+
+// 库存类型
+const (
+	invBlock = "block"
+	invTrade = "trade"
+)
+
+var (
+	nodeAddress string     // 本节点地址
+	knownNodes  []string   // 已知节点
+	mu          sync.Mutex // 保护以上状态
+
+	blocksInTransit = make(map[string][][]byte) // 各节点等待下载的区块，以节点地址为键，按创世区块到末端的顺序排列
+	transitMu       sync.Mutex                  // 保护blocksInTransit
+
+	localChain *blockchain.SharedChain // 本地区块链，与HTTP服务共享同一个数据库
+)
+
+// Addr 节点地址列表
+type Addr struct {
+	AddrList []string
+}
+
+// Version 握手消息
+type Version struct {
+	Version    int
+	BestHeight int
+	AddrFrom   string
+}
+
+// Inv 库存公告，告知对方本节点拥有的区块或交易
+type Inv struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
+}
+
+// GetBlocks 请求对方的区块哈希列表
+type GetBlocks struct {
+	AddrFrom string
+}
+
+// GetData 请求某个区块或交易的完整数据
+type GetData struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+// BlockMsg 区块数据
+type BlockMsg struct {
+	AddrFrom string
+	Block    []byte
+}
+
+// TradeMsg 交易数据
+type TradeMsg struct {
+	AddrFrom string
+	Trade    []byte
+}
+
+// CmdToBytes 将命令转换为定长字节
+func CmdToBytes(cmd string) []byte {
+	var bytes [commandLength]byte
+	for i, c := range []byte(cmd) {
+		bytes[i] = c
+	}
+	return bytes[:]
+}
+
+// BytesToCmd 从定长字节中解析命令
+func BytesToCmd(bytes []byte) string {
+	var cmd []byte
+	for _, b := range bytes {
+		if b != 0x0 {
+			cmd = append(cmd, b)
+		}
+	}
+	return string(cmd)
+}
+
+// GobEncode 序列化消息体
+func GobEncode(data interface{}) []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(data)
+	util.Err(err)
+	return buff.Bytes()
+}
+
+// KnownNodes 获取已知节点列表
+func KnownNodes() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]string{}, knownNodes...)
+}
+
+// addNode 记录新节点
+func addNode(addr string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if addr == nodeAddress {
+		return
+	}
+	for _, node := range knownNodes {
+		if node == addr {
+			return
+		}
+	}
+	knownNodes = append(knownNodes, addr)
+}
+
+// removeNode 移除无法连接的节点
+func removeNode(addr string) {
+	mu.Lock()
+	defer mu.Unlock()
+	var updated []string
+	for _, node := range knownNodes {
+		if node != addr {
+			updated = append(updated, node)
+		}
+	}
+	knownNodes = updated
+}
+
+// setInTransit 记录从peer等待下载的区块
+func setInTransit(peer string, hashes [][]byte) {
+	transitMu.Lock()
+	defer transitMu.Unlock()
+	if len(hashes) == 0 {
+		delete(blocksInTransit, peer)
+		return
+	}
+	blocksInTransit[peer] = hashes
+}
+
+// nextInTransit 取出下一个从peer等待下载的区块，没有时返回nil
+func nextInTransit(peer string) []byte {
+	transitMu.Lock()
+	defer transitMu.Unlock()
+	hashes := blocksInTransit[peer]
+	if len(hashes) == 0 {
+		return nil
+	}
+	if len(hashes) == 1 {
+		delete(blocksInTransit, peer)
+	} else {
+		blocksInTransit[peer] = hashes[1:]
+	}
+	return hashes[0]
+}
+
+// SendData 向指定节点发送数据
+func SendData(addr string, data []byte) {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		util.Info(fmt.Sprintf("节点%s不可用", addr))
+		removeNode(addr)
+		return
+	}
+	defer conn.Close()
+
+	_, err = io.Copy(conn, bytes.NewReader(data))
+	util.Err(err)
+}
+
+// SendAddr 发送已知节点列表
+func SendAddr(addr string) {
+	nodes := Addr{append(KnownNodes(), nodeAddress)}
+	request := append(CmdToBytes("addr"), GobEncode(nodes)...)
+	SendData(addr, request)
+}
+
+// SendVersion 发送握手消息，bestHeight为本地主链的高度
+func SendVersion(addr string, bestHeight int64) {
+	payload := GobEncode(Version{nodeVersion, int(bestHeight), nodeAddress})
+	request := append(CmdToBytes("version"), payload...)
+	SendData(addr, request)
+}
+
+// SendInv 发送库存公告
+func SendInv(addr, kind string, items [][]byte) {
+	payload := GobEncode(Inv{nodeAddress, kind, items})
+	request := append(CmdToBytes("inv"), payload...)
+	SendData(addr, request)
+}
+
+// SendGetBlocks 请求区块哈希列表
+func SendGetBlocks(addr string) {
+	payload := GobEncode(GetBlocks{nodeAddress})
+	request := append(CmdToBytes("getblocks"), payload...)
+	SendData(addr, request)
+}
+
+// SendGetData 请求区块或交易数据
+func SendGetData(addr, kind string, id []byte) {
+	payload := GobEncode(GetData{nodeAddress, kind, id})
+	request := append(CmdToBytes("getdata"), payload...)
+	SendData(addr, request)
+}
+
+// SendBlock 发送区块
+func SendBlock(addr string, block *blockchain.Block) {
+	payload := GobEncode(BlockMsg{nodeAddress, block.Serialize()})
+	request := append(CmdToBytes("block"), payload...)
+	SendData(addr, request)
+}
+
+// SendTrade 发送交易
+func SendTrade(addr string, t *trade.Trade) {
+	payload := GobEncode(TradeMsg{nodeAddress, t.Serialize()})
+	request := append(CmdToBytes("trade"), payload...)
+	SendData(addr, request)
+}
+
+// BroadcastBlock 向所有已知节点公告新区块
+func BroadcastBlock(block *blockchain.Block) {
+	broadcastInv(invBlock, block.Hash, "")
+}
+
+// BroadcastTrade 向所有已知节点公告新交易
+func BroadcastTrade(t *trade.Trade) {
+	broadcastInv(invTrade, t.ID, "")
+}
+
+// broadcastInv 向除except之外的已知节点公告
+func broadcastInv(kind string, id []byte, except string) {
+	if nodeAddress == "" {
+		return
+	}
+	for _, node := range KnownNodes() {
+		if node != except {
+			SendInv(node, kind, [][]byte{id})
+		}
+	}
+}
+
+// HandleAddr 处理节点列表
+func HandleAddr(request []byte) {
+	var payload Addr
+	if err := decodePayload(request, &payload); err != nil {
+		return
+	}
+
+	for _, addr := range payload.AddrList {
+		addNode(addr)
+	}
+	util.Info(fmt.Sprintf("已知节点数量: %d", len(KnownNodes())))
+}
+
+// HandleVersion 处理握手消息
+// 对方更高时请求区块，本节点更高时回复握手让对方来同步
+func HandleVersion(request []byte) {
+	var payload Version
+	if err := decodePayload(request, &payload); err != nil {
+		return
+	}
+
+	// 消息在释放区块链的锁之后再发送，对方响应慢时不会阻塞其他请求
+	height, err := bestHeight()
+	if err != nil {
+		util.Err(err)
+	} else if int(height) < payload.BestHeight {
+		SendGetBlocks(payload.AddrFrom)
+	} else if int(height) > payload.BestHeight {
+		SendVersion(payload.AddrFrom, height)
+	}
+
+	addNode(payload.AddrFrom)
+	SendAddr(payload.AddrFrom)
+}
+
+// bestHeight 获取本地主链的高度
+func bestHeight() (int64, error) {
+	var height int64
+	err := localChain.View(func(chain *blockchain.BlockChain) error {
+		var err error
+		height, err = chain.GetBestHeight()
+		return err
+	})
+	return height, err
+}
+
+// HandleGetBlocks 回复本节点的全部区块哈希
+func HandleGetBlocks(request []byte) {
+	var payload GetBlocks
+	if err := decodePayload(request, &payload); err != nil {
+		return
+	}
+
+	var hashes [][]byte
+	err := localChain.View(func(chain *blockchain.BlockChain) error {
+		var err error
+		hashes, err = chain.GetBlockHashes()
+		return err
+	})
+	if err != nil {
+		util.Err(err)
+		return
+	}
+
+	SendInv(payload.AddrFrom, invBlock, hashes)
+}
+
+// HandleInv 处理库存公告，请求本地缺少的数据
+func HandleInv(request []byte) {
+	var payload Inv
+	if err := decodePayload(request, &payload); err != nil {
+		return
+	}
+	util.Info(fmt.Sprintf("收到来自%s的%d条%s公告", payload.AddrFrom, len(payload.Items), payload.Type))
+	if len(payload.Items) == 0 {
+		return
+	}
+
+	switch payload.Type {
+	case invBlock:
+		// 公告中的区块按末端到创世区块排列，逆序后按顺序下载
+		var missing [][]byte
+		err := localChain.View(func(chain *blockchain.BlockChain) error {
+			for i := len(payload.Items) - 1; i >= 0; i-- {
+				if !chain.HasBlock(payload.Items[i]) {
+					missing = append(missing, payload.Items[i])
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			util.Err(err)
+			return
+		}
+
+		if len(missing) == 0 {
+			return
+		}
+		setInTransit(payload.AddrFrom, missing[1:])
+		SendGetData(payload.AddrFrom, invBlock, missing[0])
+
+	case invTrade:
+		for _, tradeID := range payload.Items {
+			if !blockchain.GetMempool().Has(tradeID) {
+				SendGetData(payload.AddrFrom, invTrade, tradeID)
+			}
+		}
+	}
+}
+
+// HandleGetData 回复区块或交易数据
+func HandleGetData(request []byte) {
+	var payload GetData
+	if err := decodePayload(request, &payload); err != nil {
+		return
+	}
+
+	switch payload.Type {
+	case invBlock:
+		var block *blockchain.Block
+		err := localChain.View(func(chain *blockchain.BlockChain) error {
+			var err error
+			block, err = chain.GetBlock(payload.ID)
+			return err
+		})
+		if err != nil {
+			util.Err(err)
+			return
+		}
+		SendBlock(payload.AddrFrom, block)
+
+	case invTrade:
+		t, ok := blockchain.GetMempool().Get(payload.ID)
+		if !ok {
+			return
+		}
+		SendTrade(payload.AddrFrom, t)
+	}
+}
+
+// HandleBlock 处理收到的区块
+// 校验通过后写入本地，并继续下载等待中的区块
+func HandleBlock(request []byte) {
+	var payload BlockMsg
+	if err := decodePayload(request, &payload); err != nil {
+		return
+	}
+	block, err := blockchain.ParseBlock(payload.Block)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+
+	// 写入区块时持有区块链的写锁，后续消息在释放锁之后再发送
+	added, action := false, syncAbort
+	err = localChain.Update(func(chain *blockchain.BlockChain) error {
+		added, action = addBlock(chain, block, payload.AddrFrom)
+		return nil
+	})
+	if err != nil {
+		util.Err(err)
+		action = syncAbort
+	}
+
+	switch action {
+	case syncContinue:
+		if next := nextInTransit(payload.AddrFrom); next != nil {
+			SendGetData(payload.AddrFrom, invBlock, next)
+		} else if added {
+			broadcastInv(invBlock, block.Hash, payload.AddrFrom)
+		}
+	case syncAbort:
+		setInTransit(payload.AddrFrom, nil)
+	case syncRestart:
+		setInTransit(payload.AddrFrom, nil)
+		SendGetBlocks(payload.AddrFrom)
+	}
+}
+
+// syncAction 处理收到的区块后对当前下载的后续操作
+type syncAction int
+
+const (
+	syncContinue syncAction = iota // 继续下载等待中的区块
+	syncAbort                      // 放弃当前的下载
+	syncRestart                    // 放弃当前的下载并重新请求区块列表
+)
+
+// addBlock 将收到的区块写入本地，返回是否添加成功以及对当前下载的后续操作
+// 调用方持有区块链的写锁，这里不发送任何消息
+func addBlock(chain *blockchain.BlockChain, block *blockchain.Block, from string) (bool, syncAction) {
+	switch {
+	case chain.HasBlock(block.Hash):
+	case chain.IsEmpty() && !block.IsGenesis():
+		// 空链只能从创世区块开始同步
+		return false, syncRestart
+	case chain.IsEmpty() && blockchain.GetGenesisHash() == nil:
+		// 创世区块决定登记员，只同步通过-genesis指定的创世区块，由AddBlock校验哈希
+		util.Err(fmt.Errorf("没有指定期望的创世区块哈希，不从节点%s同步创世区块%x", from, block.Hash))
+		return false, syncAbort
+	case !chain.IsEmpty() && block.IsGenesis():
+		util.Err(fmt.Errorf("节点%s的创世区块与本地不一致", from))
+		return false, syncAbort
+	case !chain.IsEmpty() && !chain.HasBlock(block.PrevHash):
+		// 缺少前序区块，放弃当前下载并重新同步
+		util.Info(fmt.Sprintf("区块%x的前序区块未知，重新请求区块列表", block.Hash))
+		return false, syncRestart
+	default:
+		// 侧链区块同样保存，累计工作量更大时由AddBlock切换主链
+		if err := chain.VerifySeal(block); err != nil {
+			util.Err(err)
+			return false, syncAbort
+		}
+		if err := chain.AddBlock(block); err != nil {
+			util.Err(err)
+			return false, syncAbort
+		}
+		util.Info(fmt.Sprintf("已添加区块%x，当前末端%x", block.Hash, chain.LastHash))
+		return true, syncContinue
+	}
+	return false, syncContinue
+}
+
+// HandleTrade 处理收到的交易
+// 校验通过后加入交易池并转发给其他节点
+func HandleTrade(request []byte) {
+	var payload TradeMsg
+	if err := decodePayload(request, &payload); err != nil {
+		return
+	}
+	t, err := trade.ParseTrade(payload.Trade)
+	if err != nil {
+		util.Err(err)
+		return
+	}
+
+	err = localChain.View(func(chain *blockchain.BlockChain) error {
+		if chain.IsEmpty() {
+			return errors.New("本地区块链为空")
+		}
+		return blockchain.GetMempool().Add(chain, t)
+	})
+	if errors.Is(err, blockchain.ErrTradeKnown) {
+		return
+	}
+	if err != nil {
+		util.Err(fmt.Errorf("交易%x未加入交易池: %v", t.ID, err))
+		return
+	}
+	util.Info(fmt.Sprintf("交易%s已加入交易池", hex.EncodeToString(t.ID)))
+
+	broadcastInv(invTrade, t.ID, payload.AddrFrom)
+}
+
+// decodePayload 解析消息体
+func decodePayload(request []byte, payload interface{}) error {
+	dec := gob.NewDecoder(bytes.NewReader(request[commandLength:]))
+	err := dec.Decode(payload)
+	util.Err(err)
+	return err
+}
+
+// HandleConnection 处理一个连接上的消息
+func HandleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// 多读一个字节，用于判断消息是否超过长度上限
+	request, err := ioutil.ReadAll(io.LimitReader(conn, util.MaxMessageSize+1))
+	if err != nil {
+		util.Err(err)
+		return
+	}
+	if len(request) > util.MaxMessageSize {
+		util.Err(fmt.Errorf("来自%s的消息超过%d字节", conn.RemoteAddr(), util.MaxMessageSize))
+		return
+	}
+	if len(request) < commandLength {
+		util.Err(errors.New("消息长度不足"))
+		return
+	}
+
+	command := BytesToCmd(request[:commandLength])
+	util.Info(fmt.Sprintf("收到%s命令", command))
+
+	switch command {
+	case "addr":
+		HandleAddr(request)
+	case "version":
+		HandleVersion(request)
+	case "getblocks":
+		HandleGetBlocks(request)
+	case "inv":
+		HandleInv(request)
+	case "getdata":
+		HandleGetData(request)
+	case "block":
+		HandleBlock(request)
+	case "trade":
+		HandleTrade(request)
+	default:
+		util.Info("未知命令")
+	}
+}
+
+// StartServer 启动节点，监听其他节点的消息
+// address为本节点地址(如localhost:3000)，peers为启动时连接的节点，chain为本地区块链
+func StartServer(address string, peers []string, chain *blockchain.SharedChain) error {
+	nodeAddress = address
+	localChain = chain
+	for _, peer := range peers {
+		addNode(peer)
+	}
+
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	util.Info(fmt.Sprintf("节点已启动: %s", nodeAddress))
+
+	height, err := bestHeight()
+	if err != nil {
+		return err
+	}
+	for _, peer := range KnownNodes() {
+		SendVersion(peer, height)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go HandleConnection(conn)
+	}
+}
@@ -0,0 +1,355 @@
+package network
+
+import (
+	"blockchain/blockchain"
+	"blockchain/trade"
+	"blockchain/util"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// openNode 在临时目录中打开一个节点的空区块链
+func openNode(t *testing.T) *blockchain.SharedChain {
+	paths := []*string{&util.TradePool, &util.BCPath, &util.BCFile, &util.Wallets, &util.WalletsRefList}
+	saved := make([]string, len(paths))
+	for i, p := range paths {
+		saved[i] = *p
+	}
+	defer func() {
+		for i, p := range paths {
+			*p = saved[i]
+		}
+	}()
+
+	if err := util.SetFilesDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := blockchain.OpenSharedChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Close() })
+	return chain
+}
+
+// pinGenesis 指定期望的创世区块哈希，测试结束后恢复为不指定
+func pinGenesis(t *testing.T, hash []byte) {
+	blockchain.SetGenesisHash(hash)
+	t.Cleanup(func() { blockchain.SetGenesisHash(nil) })
+}
+
+// createGenesis 创建创世区块，初始金额转给registrar
+func createGenesis(t *testing.T, chain *blockchain.SharedChain, registrar []byte) *blockchain.Block {
+	t.Helper()
+	var genesis *blockchain.Block
+	err := chain.Update(func(c *blockchain.BlockChain) error {
+		if err := c.CreateGenesis(registrar); err != nil {
+			return err
+		}
+		var err error
+		genesis, err = c.GetBlock(c.LastHash)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return genesis
+}
+
+// mine 在主链末端封装包含trades的区块，奖励转给miner
+func mine(t *testing.T, chain *blockchain.SharedChain, miner []byte, trades ...*trade.Trade) *blockchain.Block {
+	t.Helper()
+	var block *blockchain.Block
+	err := chain.Update(func(c *blockchain.BlockChain) error {
+		prev, err := c.GetBlock(c.LastHash)
+		if err != nil {
+			return err
+		}
+		height := prev.Height + 1
+		trades = append([]*trade.Trade{trade.Coinbase(miner, height, blockchain.BlockReward(height))}, trades...)
+		block, _, err = c.CreateBlock(context.Background(), prev.Hash, height, trades)
+		if err != nil {
+			return err
+		}
+		return c.AddBlock(block)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// tipOf 获取主链末端的区块哈希
+func tipOf(t *testing.T, chain *blockchain.SharedChain) []byte {
+	t.Helper()
+	var tip []byte
+	err := chain.View(func(c *blockchain.BlockChain) error {
+		tip = append([]byte{}, c.LastHash...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tip
+}
+
+// waitFor 在超时前反复检查cond，消息由连接各自的goroutine异步处理
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAddBlock(t *testing.T) {
+	_, registrarPub := util.GenNeKeyPair()
+	_, otherPub := util.GenNeKeyPair()
+	miner := bytes.Repeat([]byte{0x0a}, 20)
+
+	remote := openNode(t)
+	genesis := createGenesis(t, remote, util.PublicKeyHash(registrarPub))
+	b1 := mine(t, remote, miner)
+	b2 := mine(t, remote, miner)
+	foreign := createGenesis(t, openNode(t), util.PublicKeyHash(otherPub))
+	forged := *b1
+	forged.Nonce++
+
+	tests := []struct {
+		name   string
+		pinned []byte              // 期望的创世区块哈希
+		have   []*blockchain.Block // 本地已有的区块
+		block  *blockchain.Block
+		added  bool
+		action syncAction
+	}{
+		{"没有指定创世区块", nil, nil, genesis, false, syncAbort},
+		{"空链收到非创世区块", genesis.Hash, nil, b1, false, syncRestart},
+		{"同步指定的创世区块", genesis.Hash, nil, genesis, true, syncContinue},
+		{"创世区块与指定的不一致", foreign.Hash, nil, genesis, false, syncAbort},
+		{"按顺序同步", genesis.Hash, []*blockchain.Block{genesis}, b1, true, syncContinue},
+		{"已有的区块", genesis.Hash, []*blockchain.Block{genesis, b1}, b1, false, syncContinue},
+		{"前序区块未知", genesis.Hash, []*blockchain.Block{genesis}, b2, false, syncRestart},
+		{"其他链的创世区块", genesis.Hash, []*blockchain.Block{genesis}, foreign, false, syncAbort},
+		{"共识证明无效", genesis.Hash, []*blockchain.Block{genesis}, &forged, false, syncAbort},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pinGenesis(t, tt.pinned)
+			local := openNode(t)
+			var added bool
+			var action syncAction
+			err := local.Update(func(c *blockchain.BlockChain) error {
+				for _, b := range tt.have {
+					if err := c.AddBlock(b); err != nil {
+						return err
+					}
+				}
+				added, action = addBlock(c, tt.block, "127.0.0.1:1")
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added != tt.added || action != tt.action {
+				t.Fatalf("添加=%v、后续操作%d，期望%v、%d", added, action, tt.added, tt.action)
+			}
+			want := tt.block.Hash
+			if !tt.added {
+				want = nil
+				if len(tt.have) > 0 {
+					want = tt.have[len(tt.have)-1].Hash
+				}
+			}
+			if tip := tipOf(t, local); !bytes.Equal(tip, want) {
+				t.Fatalf("主链末端为%x，期望%x", tip, want)
+			}
+		})
+	}
+}
+
+// testPeer 按节点协议应答的远端节点，区块与交易取自另一条区块链
+// 包中的节点状态是全局的，一个进程只能运行一个真正的节点，远端由测试代为应答
+type testPeer struct {
+	address string
+	chain   *blockchain.SharedChain
+	trades  map[string]*trade.Trade // 可供下载的交易，以交易ID为键
+}
+
+// startPeer 启动远端节点
+func startPeer(t *testing.T, chain *blockchain.SharedChain) *testPeer {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &testPeer{address: ln.Addr().String(), chain: chain, trades: make(map[string]*trade.Trade)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+// send 向addr发送命令
+func (p *testPeer) send(addr, command string, payload interface{}) {
+	SendData(addr, append(CmdToBytes(command), GobEncode(payload)...))
+}
+
+// handle 应答区块列表和数据请求，其他消息忽略
+func (p *testPeer) handle(conn net.Conn) {
+	defer conn.Close()
+	request, err := ioutil.ReadAll(conn)
+	if err != nil || len(request) < commandLength {
+		return
+	}
+
+	switch BytesToCmd(request[:commandLength]) {
+	case "getblocks":
+		var payload GetBlocks
+		if decodePayload(request, &payload) != nil {
+			return
+		}
+		var hashes [][]byte
+		p.chain.View(func(c *blockchain.BlockChain) error {
+			hashes, err = c.GetBlockHashes()
+			return err
+		})
+		p.send(payload.AddrFrom, "inv", Inv{p.address, invBlock, hashes})
+
+	case "getdata":
+		var payload GetData
+		if decodePayload(request, &payload) != nil {
+			return
+		}
+		if payload.Type == invTrade {
+			if t, ok := p.trades[string(payload.ID)]; ok {
+				p.send(payload.AddrFrom, "trade", TradeMsg{p.address, t.Serialize()})
+			}
+			return
+		}
+		var block *blockchain.Block
+		p.chain.View(func(c *blockchain.BlockChain) error {
+			block, err = c.GetBlock(payload.ID)
+			return err
+		})
+		if block != nil {
+			p.send(payload.AddrFrom, "block", BlockMsg{p.address, block.Serialize()})
+		}
+	}
+}
+
+// serveNode 让本进程的节点在随机端口上处理消息，测试结束后停止并清空节点状态
+func serveNode(t *testing.T, chain *blockchain.SharedChain) {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeAddress, localChain = ln.Addr().String(), chain
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		nodeAddress, knownNodes, localChain = "", nil, nil
+		mu.Unlock()
+		transitMu.Lock()
+		blocksInTransit = make(map[string][][]byte)
+		transitMu.Unlock()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go HandleConnection(conn)
+		}
+	}()
+}
+
+// 空链节点与远端握手后下载全部区块，再接收远端公告的交易和新区块
+func TestSyncFromPeer(t *testing.T) {
+	registrarKey, registrarPub := util.GenNeKeyPair()
+	registrar := util.PublicKeyHash(registrarPub)
+	dealer := bytes.Repeat([]byte{0x03}, 20)
+	miner := bytes.Repeat([]byte{0x0a}, 20)
+
+	remote := openNode(t)
+	genesis := createGenesis(t, remote, registrar)
+	for i := 0; i < 3; i++ {
+		mine(t, remote, miner)
+	}
+	pinGenesis(t, genesis.Hash)
+
+	local := openNode(t)
+	serveNode(t, local)
+	peer := startPeer(t, remote)
+
+	var tx *trade.Trade
+	err := remote.View(func(c *blockchain.BlockChain) error {
+		var err error
+		tx, err = c.CreateTrade([]blockchain.TradeLeg{{
+			From:      registrarPub,
+			Transfers: []blockchain.Transfer{{To: dealer, Amount: 10}},
+			Key:       &registrarKey,
+		}}, "", nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.trades[string(tx.ID)] = tx
+	t.Cleanup(func() { blockchain.GetMempool().Remove([]*trade.Trade{tx}) })
+	inPool := func() bool { return blockchain.GetMempool().Has(tx.ID) }
+
+	steps := []struct {
+		name     string
+		announce func() []byte // 远端发出消息，返回期望的本地主链末端
+		pooled   bool          // 交易是否在交易池中
+	}{
+		{"握手后下载全部区块", func() []byte {
+			peer.send(nodeAddress, "version", Version{nodeVersion, 3, peer.address})
+			return tipOf(t, remote)
+		}, false},
+		{"公告交易", func() []byte {
+			peer.send(nodeAddress, "inv", Inv{peer.address, invTrade, [][]byte{tx.ID}})
+			waitFor(t, "交易加入交易池", inPool)
+			return tipOf(t, remote)
+		}, true},
+		{"公告包含该交易的新区块", func() []byte {
+			block := mine(t, remote, miner, tx)
+			peer.send(nodeAddress, "inv", Inv{peer.address, invBlock, [][]byte{block.Hash}})
+			return block.Hash
+		}, false},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			want := step.announce()
+			waitFor(t, "同步到远端的末端", func() bool { return bytes.Equal(tipOf(t, local), want) })
+			if pooled := inPool(); pooled != step.pooled {
+				t.Errorf("交易在交易池中=%v，期望%v", pooled, step.pooled)
+			}
+			if nodes := KnownNodes(); len(nodes) != 1 || nodes[0] != peer.address {
+				t.Errorf("已知节点为%v，期望只有%s", nodes, peer.address)
+			}
+			err := local.View(func(c *blockchain.BlockChain) error {
+				_, err := c.VerifyChain()
+				return err
+			})
+			if err != nil {
+				t.Errorf("同步后的主链校验失败: %v", err)
+			}
+		})
+	}
+}
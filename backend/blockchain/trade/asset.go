@@ -0,0 +1,76 @@
+package trade
+
+import (
+	"blockchain/codec"
+	"blockchain/util"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidAsset 资产编号格式错误
+var ErrInvalidAsset = errors.New("资产编号无效")
+
+// NativeAsset 原生商品的资产编号，初始订单、挖矿奖励和手续费都使用原生商品
+const NativeAsset = ""
+
+// assetSeparator 资产编号中发行方地址与资产代号的分隔符，base58地址中不会出现
+const assetSeparator = ":"
+
+// AssetID 生成资产编号，格式为“发行方地址:资产代号”
+// 资产编号中包含发行方，验证发行权限时无需额外的链上状态
+func AssetID(issuerPubKeyHash []byte, symbol string) string {
+	return string(util.PublicHashToAddress(issuerPubKeyHash)) + assetSeparator + symbol
+}
+
+// ParseAssetID 解析资产编号，返回发行方的公钥哈希和资产代号
+func ParseAssetID(asset string) ([]byte, string, error) {
+	address, symbol, ok := strings.Cut(asset, assetSeparator)
+	if !ok || !util.ValidateAddress([]byte(address)) {
+		return nil, "", fmt.Errorf("%w: %s", ErrInvalidAsset, asset)
+	}
+	if err := ValidateSymbol(symbol); err != nil {
+		return nil, "", err
+	}
+	return util.AddressToPublicHash([]byte(address)), symbol, nil
+}
+
+// ValidateSymbol 检查资产代号，长度为1到util.MaxAssetSymbolLength字节，不含空白和控制字符
+func ValidateSymbol(symbol string) error {
+	if symbol == "" || len(symbol) > util.MaxAssetSymbolLength {
+		return fmt.Errorf("%w: 资产代号长度应为1到%d字节", ErrInvalidAsset, util.MaxAssetSymbolLength)
+	}
+	for _, r := range symbol {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return fmt.Errorf("%w: 资产代号%q包含空白或控制字符", ErrInvalidAsset, symbol)
+		}
+	}
+	return nil
+}
+
+// ValidateAsset 检查输出中的资产编号，原生商品总是有效
+func ValidateAsset(asset string) error {
+	if asset == NativeAsset {
+		return nil
+	}
+	_, _, err := ParseAssetID(asset)
+	return err
+}
+
+// hasAssets 判断交易中是否有原生商品以外的输出
+func (t *Trade) hasAssets() bool {
+	for _, out := range t.Outputs {
+		if out.Asset != NativeAsset {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeAssets 按输出顺序写入各输出的资产编号
+func (t *Trade) encodeAssets(w *codec.Writer) {
+	for _, out := range t.Outputs {
+		w.WriteString(out.Asset)
+	}
+}
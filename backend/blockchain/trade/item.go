@@ -0,0 +1,48 @@
+package trade
+
+import (
+	"blockchain/codec"
+	"blockchain/util"
+	"errors"
+	"fmt"
+	"unicode"
+)
+
+// ErrInvalidSerial 单品序列号格式错误
+var ErrInvalidSerial = errors.New("单品序列号无效")
+
+// IsItem 判断输出是否为带序列号的单品
+// 单品是数量为1的资产，只能整体花费，且必须原样转入同一交易中序列号相同的一个输出
+func (out TradeOut) IsItem() bool {
+	return out.Serial != ""
+}
+
+// ValidateSerial 检查单品序列号，长度为1到util.MaxSerialLength字节，不含空白和控制字符
+func ValidateSerial(serial string) error {
+	if serial == "" || len(serial) > util.MaxSerialLength {
+		return fmt.Errorf("%w: 序列号长度应为1到%d字节", ErrInvalidSerial, util.MaxSerialLength)
+	}
+	for _, r := range serial {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return fmt.Errorf("%w: 序列号%q包含空白或控制字符", ErrInvalidSerial, serial)
+		}
+	}
+	return nil
+}
+
+// hasSerials 判断交易中是否有单品输出
+func (t *Trade) hasSerials() bool {
+	for _, out := range t.Outputs {
+		if out.IsItem() {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeSerials 按输出顺序写入各输出的序列号
+func (t *Trade) encodeSerials(w *codec.Writer) {
+	for _, out := range t.Outputs {
+		w.WriteString(out.Serial)
+	}
+}
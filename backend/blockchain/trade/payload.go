@@ -0,0 +1,97 @@
+package trade
+
+import (
+	"blockchain/codec"
+	"blockchain/util"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrInvalidPayload 交易载荷的内容无效
+var ErrInvalidPayload = errors.New("交易载荷无效")
+
+// PayloadVersion 载荷结构的版本号，字段变化时递增
+const PayloadVersion byte = 1
+
+// Payload 交易携带的产品信息，与交易一起计入交易哈希并被签名
+// 时间均为Unix秒，0表示未填写
+type Payload struct {
+	Schema     byte              // 载荷结构的版本号，解析时保留原值
+	ProductID  string            // 产品编号，如SKU
+	Batch      string            // 批次号
+	Unit       string            // 计量单位，如箱、千克
+	Origin     string            // 产地
+	ProducedAt int64             // 生产时间
+	ExpiresAt  int64             // 有效期至
+	Attributes map[string]string // 其他属性，如质检证书编号
+}
+
+// Encode 写入载荷的规范编码，属性按键排序
+func (p *Payload) Encode(w *codec.Writer) {
+	w.WriteVersion(p.Schema)
+	w.WriteString(p.ProductID)
+	w.WriteString(p.Batch)
+	w.WriteString(p.Unit)
+	w.WriteString(p.Origin)
+	w.WriteInt(p.ProducedAt)
+	w.WriteInt(p.ExpiresAt)
+	keys := make([]string, 0, len(p.Attributes))
+	for k := range p.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.WriteInt(int64(len(keys)))
+	for _, k := range keys {
+		w.WriteString(k)
+		w.WriteString(p.Attributes[k])
+	}
+}
+
+// DecodePayload 读取载荷
+func DecodePayload(r *codec.Reader) *Payload {
+	p := Payload{
+		Schema:     r.ReadVersionUpTo(PayloadVersion),
+		ProductID:  r.ReadString(),
+		Batch:      r.ReadString(),
+		Unit:       r.ReadString(),
+		Origin:     r.ReadString(),
+		ProducedAt: r.ReadInt(),
+		ExpiresAt:  r.ReadInt(),
+	}
+	if n := r.ReadCount(2 * 8); n > 0 {
+		p.Attributes = make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			k := r.ReadString()
+			p.Attributes[k] = r.ReadString()
+		}
+	}
+	return &p
+}
+
+// Validate 检查载荷的版本、必填字段和大小
+func (p *Payload) Validate() error {
+	if p.Schema == 0 || p.Schema > PayloadVersion {
+		return fmt.Errorf("%w: 不支持的版本%d", ErrInvalidPayload, p.Schema)
+	}
+	if p.ProductID == "" {
+		return fmt.Errorf("%w: 缺少产品编号", ErrInvalidPayload)
+	}
+	if p.ProducedAt < 0 || p.ExpiresAt < 0 || (p.ExpiresAt != 0 && p.ExpiresAt < p.ProducedAt) {
+		return fmt.Errorf("%w: 生产时间或有效期错误", ErrInvalidPayload)
+	}
+	if len(p.Attributes) > util.MaxPayloadAttributes {
+		return fmt.Errorf("%w: 属性超过%d个", ErrInvalidPayload, util.MaxPayloadAttributes)
+	}
+	for k := range p.Attributes {
+		if k == "" {
+			return fmt.Errorf("%w: 属性名为空", ErrInvalidPayload)
+		}
+	}
+	var w codec.Writer
+	p.Encode(&w)
+	if len(w.Bytes()) > util.MaxPayloadSize {
+		return fmt.Errorf("%w: 超过%d字节", ErrInvalidPayload, util.MaxPayloadSize)
+	}
+	return nil
+}
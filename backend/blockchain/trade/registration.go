@@ -0,0 +1,94 @@
+package trade
+
+import (
+	"blockchain/codec"
+	"blockchain/util"
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidRegistration 身份登记的内容或签名无效
+var ErrInvalidRegistration = errors.New("身份登记无效")
+
+// Registration 身份登记，将一个地址登记为供应链中的某个角色
+// 登记交易不引用也不产生输出，由签名者对交易ID签名；同一地址再次登记时以最后一次为准
+// 签名者是登记员，或是把未登记地址登记为自己身份的已登记地址
+type Registration struct {
+	PubKeyHash []byte        // 被登记地址的公钥哈希
+	Identity   util.Identity // 登记的身份
+	Name       string        // 显示名称
+	Time       int64         // 登记时间，使内容相同的重复登记ID不同
+	Registrar  []byte        // 签名者的公钥
+	Signature  []byte        // 签名者对交易ID的签名
+}
+
+// Encode 写入身份登记的规范编码
+func (reg *Registration) Encode(w *codec.Writer) {
+	w.WriteBytes(reg.PubKeyHash)
+	w.WriteString(string(reg.Identity))
+	w.WriteString(reg.Name)
+	w.WriteInt(reg.Time)
+	w.WriteBytes(reg.Registrar)
+	w.WriteBytes(reg.Signature)
+}
+
+// DecodeRegistration 读取身份登记
+func DecodeRegistration(r *codec.Reader) *Registration {
+	return &Registration{
+		PubKeyHash: r.ReadBytes(),
+		Identity:   util.Identity(r.ReadString()),
+		Name:       r.ReadString(),
+		Time:       r.ReadInt(),
+		Registrar:  r.ReadBytes(),
+		Signature:  r.ReadBytes(),
+	}
+}
+
+// NewRegistration 创建由registrarKey签名的身份登记交易，签名者为登记员或继承身份的已登记地址
+func NewRegistration(pubKeyHash []byte, identity util.Identity, name string, registrarKey ecdsa.PrivateKey) (*Trade, error) {
+	reg := Registration{
+		PubKeyHash: pubKeyHash,
+		Identity:   identity,
+		Name:       name,
+		Time:       time.Now().UnixNano(),
+		Registrar:  util.PublicKeyBytes(&registrarKey.PublicKey),
+	}
+	t := Trade{Description: "register " + string(identity), Registration: &reg}
+	t.SetID()
+	signature, err := Sign(t.ID, registrarKey)
+	if err != nil {
+		return nil, err
+	}
+	reg.Signature = signature
+	return &t, nil
+}
+
+// IsRegistration 判断是否为身份登记交易
+func (t *Trade) IsRegistration() bool {
+	return t.Registration != nil
+}
+
+// VerifyRegistration 验证登记交易的结构和签名，签名者是否有权登记由调用方检查
+func (t *Trade) VerifyRegistration() error {
+	reg := t.Registration
+	if len(t.Inputs) != 0 || len(t.Outputs) != 0 {
+		return fmt.Errorf("%w: 登记交易不能引用或产生输出", ErrInvalidRegistration)
+	}
+	if !reg.Identity.Valid() {
+		return fmt.Errorf("%w: 未知的身份%s", ErrInvalidRegistration, reg.Identity)
+	}
+	if len(reg.PubKeyHash) == 0 {
+		return fmt.Errorf("%w: 缺少被登记的地址", ErrInvalidRegistration)
+	}
+
+	if !bytes.Equal(t.ComputeID(), t.ID) {
+		return fmt.Errorf("%w: 交易ID与登记内容不一致", ErrInvalidRegistration)
+	}
+	if len(reg.Registrar) == 0 || len(reg.Signature) == 0 || !Verify(t.ID, reg.Registrar, reg.Signature) {
+		return fmt.Errorf("%w: 登记员签名无效", ErrInvalidRegistration)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package trade
+
+import (
+	"blockchain/codec"
+	"blockchain/util"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidToken 防伪凭证无法解析
+var ErrInvalidToken = errors.New("防伪凭证无法解析")
+
+// TokenVersion 防伪凭证编码的版本号，格式变化时递增
+const TokenVersion byte = 1
+
+// tokenDomain 签名内容的前缀，使凭证签名不能被当作交易或登记的签名使用
+const tokenDomain = "product-token"
+
+// ProductToken 防伪凭证，由签发方对主链上的一个交易输出签名，编码后印在商品的二维码中
+// 凭证只证明签发方为该输出签发过凭证，是否为正品还需对照主链上的输出和签发方的身份
+type ProductToken struct {
+	TradeID   []byte
+	OutID     int
+	PublicKey []byte // 签发方公钥
+	Signature []byte
+}
+
+// NewProductToken 签发交易tradeID第outID个输出的防伪凭证
+func NewProductToken(tradeID []byte, outID int, privKey ecdsa.PrivateKey) (*ProductToken, error) {
+	token := ProductToken{TradeID: tradeID, OutID: outID, PublicKey: util.PublicKeyBytes(&privKey.PublicKey)}
+	signature, err := Sign(token.hash(), privKey)
+	if err != nil {
+		return nil, err
+	}
+	token.Signature = signature
+	return &token, nil
+}
+
+// hash 计算签名内容的哈希，不含签名
+func (t *ProductToken) hash() []byte {
+	var w codec.Writer
+	w.WriteString(tokenDomain)
+	w.WriteVersion(TokenVersion)
+	w.WriteBytes(t.TradeID)
+	w.WriteInt(int64(t.OutID))
+	w.WriteBytes(t.PublicKey)
+	hash := sha256.Sum256(w.Bytes())
+	return hash[:]
+}
+
+// Verify 验证签发方的签名
+func (t *ProductToken) Verify() bool {
+	if len(t.PublicKey) == 0 || len(t.Signature) == 0 {
+		return false
+	}
+	return Verify(t.hash(), t.PublicKey, t.Signature)
+}
+
+// String 将凭证编码为URL安全的base64字符串，作为二维码的内容
+func (t *ProductToken) String() string {
+	var w codec.Writer
+	w.WriteVersion(TokenVersion)
+	w.WriteBytes(t.TradeID)
+	w.WriteInt(int64(t.OutID))
+	w.WriteBytes(t.PublicKey)
+	w.WriteBytes(t.Signature)
+	return base64.RawURLEncoding.EncodeToString(w.Bytes())
+}
+
+// ParseProductToken 解析二维码中的凭证字符串
+func ParseProductToken(s string) (*ProductToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	r := codec.NewReader(data)
+	r.ReadVersion(TokenVersion)
+	token := ProductToken{
+		TradeID:   r.ReadBytes(),
+		OutID:     int(r.ReadInt()),
+		PublicKey: r.ReadBytes(),
+		Signature: r.ReadBytes(),
+	}
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return &token, nil
+}
@@ -1,16 +1,22 @@
 package trade
 
 import (
+	"blockchain/codec"
 	"blockchain/util"
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/big"
 )
 
+// ErrCorruptTrade 交易数据无法解析
+var ErrCorruptTrade = errors.New("交易数据无法解析")
+
 // TradeIn 首先定义转入转出结构体
 type TradeIn struct {
 	TradeID   []byte // 订单标识
@@ -22,46 +28,250 @@ type TradeIn struct {
 type TradeOut struct {
 	Num           int    // 转出值
 	HashPublicKey []byte // 公钥哈希
+	Asset         string // 资产编号，为空时为原生商品
+	Serial        string // 单品序列号，为空时为可分割的数量
+}
+
+// TradeVersion 交易编码的版本号，编码格式变化时递增
+// 版本2在交易末尾增加了可选的身份登记，版本3在其后增加了可选的产品载荷，
+// 版本4在其后增加了各输出的资产编号，版本5在最后增加了各输出的单品序列号，旧版本的交易仍可解析
+const TradeVersion byte = 5
+
+// minTradeInSize、minTradeOutSize 输入和输出编码的最小字节数，用于校验元素个数
+const (
+	minTradeInSize  = 4 * 8
+	minTradeOutSize = 2 * 8
+)
+
+// Encode 写入交易输入的规范编码
+func (in *TradeIn) Encode(w *codec.Writer) {
+	w.WriteBytes(in.TradeID)
+	w.WriteInt(int64(in.OutID))
+	w.WriteBytes(in.PublicKey)
+	w.WriteBytes(in.Sign)
+}
+
+// DecodeTradeIn 读取交易输入
+func DecodeTradeIn(r *codec.Reader) TradeIn {
+	return TradeIn{
+		TradeID:   r.ReadBytes(),
+		OutID:     int(r.ReadInt()),
+		PublicKey: r.ReadBytes(),
+		Sign:      r.ReadBytes(),
+	}
+}
+
+// Encode 写入交易输出的规范编码，不含资产编号和序列号
+// 交易中各输出的资产编号和序列号统一写在交易编码的末尾，没有其他资产和单品的交易无需写入
+func (out TradeOut) Encode(w *codec.Writer) {
+	w.WriteInt(int64(out.Num))
+	w.WriteBytes(out.HashPublicKey)
+}
+
+// DecodeTradeOut 读取交易输出
+func DecodeTradeOut(r *codec.Reader) TradeOut {
+	return TradeOut{Num: int(r.ReadInt()), HashPublicKey: r.ReadBytes()}
+}
+
+// Serialize 序列化交易输出，UTXO集合中保存的格式，资产编号和序列号在最后
+func (out TradeOut) Serialize() []byte {
+	var w codec.Writer
+	w.WriteVersion(TradeVersion)
+	out.Encode(&w)
+	w.WriteString(out.Asset)
+	w.WriteString(out.Serial)
+	return w.Bytes()
+}
+
+// ParseTradeOut 解析序列化的交易输出
+func ParseTradeOut(data []byte) (TradeOut, error) {
+	r := codec.NewReader(data)
+	version := r.ReadVersionUpTo(TradeVersion)
+	out := DecodeTradeOut(r)
+	if version >= 4 {
+		out.Asset = r.ReadString()
+	}
+	if version >= 5 {
+		out.Serial = r.ReadString()
+	}
+	if err := r.Finish(); err != nil {
+		return TradeOut{}, fmt.Errorf("%w: 交易输出%v", ErrCorruptTrade, err)
+	}
+	return out, nil
 }
 
 // Trade 交易结构体
 type Trade struct {
-	ID          []byte // ID，哈希值表示
-	Inputs      []TradeIn
-	Outputs     []TradeOut
-	Description string
+	ID           []byte // ID，哈希值表示
+	Inputs       []TradeIn
+	Outputs      []TradeOut
+	Description  string
+	Registration *Registration // 身份登记交易的登记内容，普通交易为nil
+	Payload      *Payload      // 交易携带的产品信息，可以为nil
+}
+
+// encodeBody 写入交易内容的规范编码，不含版本号
+func (t *Trade) encodeBody(w *codec.Writer) {
+	w.WriteBytes(t.ID)
+	w.WriteInt(int64(len(t.Inputs)))
+	for i := range t.Inputs {
+		t.Inputs[i].Encode(w)
+	}
+	w.WriteInt(int64(len(t.Outputs)))
+	for _, out := range t.Outputs {
+		out.Encode(w)
+	}
+	w.WriteString(t.Description)
 }
 
 // GetTradeHash 计算交易哈希值
+// 哈希的输入即交易的规范编码去掉版本号，登记内容、载荷、资产编号和序列号前都有是否存在的标记，
+// 不同的交易不会得到相同的哈希输入
 func (t *Trade) GetTradeHash() []byte {
-	var encoded bytes.Buffer
-	var hash [32]byte
-	// 用gob序列化一下结构体
-	encoder := gob.NewEncoder(&encoded)
-	if err := encoder.Encode(t); err != nil {
-		return nil
-	}
-	hash = sha256.Sum256(encoded.Bytes())
+	var w codec.Writer
+	t.encodeBody(&w)
+	t.encodeExtensions(&w)
+	hash := sha256.Sum256(w.Bytes())
 	return hash[:]
 }
 
+// Encode 写入交易的规范编码，区块编码中的每笔交易使用该格式
+func (t *Trade) Encode(w *codec.Writer) {
+	w.WriteVersion(TradeVersion)
+	t.encodeBody(w)
+	t.encodeExtensions(w)
+}
+
+// encodeExtensions 写入交易内容之后的可选部分，每部分前先写入是否存在
+func (t *Trade) encodeExtensions(w *codec.Writer) {
+	w.WriteBool(t.Registration != nil)
+	if t.Registration != nil {
+		t.Registration.Encode(w)
+	}
+	w.WriteBool(t.Payload != nil)
+	if t.Payload != nil {
+		t.Payload.Encode(w)
+	}
+	w.WriteBool(t.hasAssets())
+	if t.hasAssets() {
+		t.encodeAssets(w)
+	}
+	w.WriteBool(t.hasSerials())
+	if t.hasSerials() {
+		t.encodeSerials(w)
+	}
+}
+
+// DecodeTrade 读取交易
+func DecodeTrade(r *codec.Reader) *Trade {
+	var t Trade
+	version := r.ReadVersionUpTo(TradeVersion)
+	t.ID = r.ReadBytes()
+	if n := r.ReadCount(minTradeInSize); n > 0 {
+		t.Inputs = make([]TradeIn, n)
+		for i := range t.Inputs {
+			t.Inputs[i] = DecodeTradeIn(r)
+		}
+	}
+	if n := r.ReadCount(minTradeOutSize); n > 0 {
+		t.Outputs = make([]TradeOut, n)
+		for i := range t.Outputs {
+			t.Outputs[i] = DecodeTradeOut(r)
+		}
+	}
+	t.Description = r.ReadString()
+	if version >= 2 && r.ReadBool() {
+		t.Registration = DecodeRegistration(r)
+	}
+	if version >= 3 && r.ReadBool() {
+		t.Payload = DecodePayload(r)
+	}
+	if version >= 4 && r.ReadBool() {
+		for i := range t.Outputs {
+			t.Outputs[i].Asset = r.ReadString()
+		}
+	}
+	if version >= 5 && r.ReadBool() {
+		for i := range t.Outputs {
+			t.Outputs[i].Serial = r.ReadString()
+		}
+	}
+	return &t
+}
+
+// Serialize 序列化交易
+func (t *Trade) Serialize() []byte {
+	var w codec.Writer
+	t.Encode(&w)
+	return w.Bytes()
+}
+
+// ParseTrade 解析序列化的交易，数据不完整或格式错误时返回ErrCorruptTrade
+func ParseTrade(data []byte) (*Trade, error) {
+	r := codec.NewReader(data)
+	t := DecodeTrade(r)
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptTrade, err)
+	}
+	return t, nil
+}
+
 func (t *Trade) SetID() {
 	t.ID = t.GetTradeHash()
 }
 
+// ComputeID 重新计算交易ID，用于校验交易ID与内容是否一致
+// 交易ID在签名之前计算，即ID、各输入的签名和登记员签名置空后交易内容的哈希
+func (t *Trade) ComputeID() []byte {
+	tradeCopy := *t
+	tradeCopy.ID = nil
+	tradeCopy.Inputs = make([]TradeIn, len(t.Inputs))
+	for i, in := range t.Inputs {
+		tradeCopy.Inputs[i] = TradeIn{TradeID: in.TradeID, OutID: in.OutID, PublicKey: in.PublicKey}
+	}
+	if t.Registration != nil {
+		unsigned := *t.Registration
+		unsigned.Signature = nil
+		tradeCopy.Registration = &unsigned
+	}
+	return tradeCopy.GetTradeHash()
+}
+
 // FirstTrade 创建初始订单，将InitNum商品转入用户
+// 初始订单的ID为其内容的哈希，使创世区块哈希经默克尔根确定初始商品的接收者
 func FirstTrade(toaddress []byte) *Trade {
 	In := TradeIn{[]byte{}, -1, []byte{}, nil}
-	Out := TradeOut{util.InitNum, toaddress}
-	tx := Trade{[]byte("The First Trade!"), []TradeIn{In}, []TradeOut{Out}, "first trade"}
+	Out := TradeOut{Num: util.InitNum, HashPublicKey: toaddress}
+	tx := Trade{Inputs: []TradeIn{In}, Outputs: []TradeOut{Out}, Description: "first trade"}
+	tx.SetID()
+	return &tx
+}
+
+// Coinbase 创建挖矿奖励交易，将reward商品转入矿工
+// 输入不引用任何输出，PublicKey字段存放区块高度，使不同区块中的奖励交易ID互不相同
+func Coinbase(toaddress []byte, height int64, reward int) *Trade {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], uint64(height))
+	In := TradeIn{[]byte{}, -1, data[:], nil}
+	Out := TradeOut{Num: reward, HashPublicKey: toaddress}
+	tx := Trade{Inputs: []TradeIn{In}, Outputs: []TradeOut{Out}, Description: "coinbase"}
+	tx.SetID()
 	return &tx
 }
 
-// IsFirstTrade 判断是否为初始订单
+// IsFirstTrade 判断是否为初始订单或挖矿奖励交易，二者都不引用已有的输出
 func (t *Trade) IsFirstTrade() bool {
 	return len(t.Inputs) == 1 && t.Inputs[0].OutID == -1
 }
 
+// CoinbaseHeight 获取挖矿奖励交易输入中记录的区块高度
+func (t *Trade) CoinbaseHeight() (int64, bool) {
+	if !t.IsFirstTrade() || len(t.Inputs[0].PublicKey) != 8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(t.Inputs[0].PublicKey)), true
+}
+
 // IsFromAddressRight 判断源地址是否正确
 func (in *TradeIn) IsFromAddressRight(address []byte) bool {
 	return bytes.Equal(in.PublicKey, address)
@@ -73,11 +283,17 @@ func (out *TradeOut) IsToAddressRight(address []byte) bool {
 }
 
 // Sign 构造签名
-func Sign(msg []byte, privKey ecdsa.PrivateKey) []byte {
+func Sign(msg []byte, privKey ecdsa.PrivateKey) ([]byte, error) {
 	r, s, err := ecdsa.Sign(rand.Reader, &privKey, msg)
-	util.Err(err)
-	signature := append(r.Bytes(), s.Bytes()...)
-	return signature
+	if err != nil {
+		return nil, err
+	}
+	// r和s按定长拼接，验证时才能从中间切分
+	size := (privKey.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return signature, nil
 }
 
 // Verify 验证签名是否合法
@@ -95,7 +311,7 @@ func Verify(msg []byte, pubkey []byte, signature []byte) bool {
 	x.SetBytes(pubkey[:(keyLen / 2)])
 	y.SetBytes(pubkey[(keyLen / 2):])
 
-	rawPubKey := ecdsa.PublicKey{curve, &x, &y}
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 	return ecdsa.Verify(&rawPubKey, msg, &r, &s)
 }
 
@@ -109,27 +325,35 @@ func (t *Trade) PlainCopy() Trade {
 	}
 
 	for _, tout := range t.Outputs {
-		outputs = append(outputs, TradeOut{tout.Num, tout.HashPublicKey})
+		outputs = append(outputs, TradeOut{Num: tout.Num, HashPublicKey: tout.HashPublicKey, Asset: tout.Asset, Serial: tout.Serial})
 	}
 
-	tradeCopy := Trade{t.ID, inputs, outputs, t.Description}
+	tradeCopy := Trade{t.ID, inputs, outputs, t.Description, t.Registration, t.Payload}
 
 	return tradeCopy
 }
 
-// Sign 对交易信息进行签名
-func (t *Trade) Sign(privKey ecdsa.PrivateKey) {
+// Sign 对交易信息进行签名，只签名公钥与privKey对应的输入
+// 多方参与的交易由各方分别调用Sign签名自己的输入
+func (t *Trade) Sign(privKey ecdsa.PrivateKey) error {
 	if t.IsFirstTrade() {
-		return
+		return nil
 	}
 	for i, input := range t.Inputs {
+		if !util.MatchPublicKey(input.PublicKey, &privKey.PublicKey) {
+			continue
+		}
 
 		tradeCopy := t.PlainCopy()
 		tradeCopy.Inputs[i].PublicKey = input.PublicKey
 		plainhash := tradeCopy.GetTradeHash()
-		signature := Sign(plainhash, privKey)
+		signature, err := Sign(plainhash, privKey)
+		if err != nil {
+			return err
+		}
 		t.Inputs[i].Sign = signature
 	}
+	return nil
 }
 
 // Verify 验证整个交易是否合法
@@ -0,0 +1,109 @@
+package trade
+
+import (
+	"blockchain/codec"
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// 以下编码是规范编码的固定样例，编码格式或哈希规则变化时这些测试会失败
+// 确需修改格式时应递增对应的版本号，并在迁移说明中注明
+
+const (
+	tradeOutGolden = "0500000000000000030000000000000014060606060606060606060606060606060606060600000000000000037465610000000000000006542d30303032"
+	payloadGolden  = "010000000000000005534b552d31000000000000000242310000000000000003e7aeb10000000000000006e4ba91e58d97000000006553f1000000000065ec87800000000000000002000000000000000463657274000000000000000451432d3900000000000000056772616465000000000000000141"
+	tradeGolden    = "050000000000000020aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa00000000000000010000000000000020010101010101010101010101010101010101010101010101010101010101010100000000000000010000000000000040020202020202020202020202020202020202020202020202020202020202020202020202020202020202020202020202020202020202020202020202020202020000000000000040030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030303030000000000000002000000000000000a000000000000001404040404040404040404040404040404040404040000000000000001000000000000001405050505050505050505050505050505050505050000000000000006e58f91e8b4a70001010000000000000005534b552d31000000000000000242310000000000000003e7aeb10000000000000006e4ba91e58d97000000006553f1000000000065ec87800000000000000002000000000000000463657274000000000000000451432d390000000000000005677261646500000000000000014101000000000000000000000000000000037465610100000000000000000000000000000006542d30303031"
+	tradeIDGolden  = "608e1df5686594a91fd675470642fb6d05ac6f9732d480ddf782eff68eee06e5"
+)
+
+func testPayload() *Payload {
+	return &Payload{
+		Schema:     PayloadVersion,
+		ProductID:  "SKU-1",
+		Batch:      "B1",
+		Unit:       "箱",
+		Origin:     "云南",
+		ProducedAt: 1700000000,
+		ExpiresAt:  1710000000,
+		Attributes: map[string]string{"cert": "QC-9", "grade": "A"},
+	}
+}
+
+func testTrade() *Trade {
+	return &Trade{
+		ID: bytes.Repeat([]byte{0xaa}, 32),
+		Inputs: []TradeIn{{
+			TradeID:   bytes.Repeat([]byte{0x01}, 32),
+			OutID:     1,
+			PublicKey: bytes.Repeat([]byte{0x02}, 64),
+			Sign:      bytes.Repeat([]byte{0x03}, 64),
+		}},
+		Outputs: []TradeOut{
+			{Num: 10, HashPublicKey: bytes.Repeat([]byte{0x04}, 20)},
+			{Num: 1, HashPublicKey: bytes.Repeat([]byte{0x05}, 20), Asset: "tea", Serial: "T-0001"},
+		},
+		Description: "发货",
+		Payload:     testPayload(),
+	}
+}
+
+func checkGolden(t *testing.T, name string, got []byte, golden string) {
+	t.Helper()
+	if hex.EncodeToString(got) != golden {
+		t.Fatalf("%s的编码与固定样例不一致:\n得到 %x\n期望 %s", name, got, golden)
+	}
+}
+
+func TestTradeOutEncoding(t *testing.T) {
+	out := TradeOut{Num: 3, HashPublicKey: bytes.Repeat([]byte{0x06}, 20), Asset: "tea", Serial: "T-0002"}
+	data := out.Serialize()
+	checkGolden(t, "TradeOut", data, tradeOutGolden)
+
+	parsed, err := ParseTradeOut(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Num != out.Num || !bytes.Equal(parsed.HashPublicKey, out.HashPublicKey) || parsed.Asset != out.Asset || parsed.Serial != out.Serial {
+		t.Fatalf("解析结果%+v与原输出%+v不一致", parsed, out)
+	}
+}
+
+func TestPayloadEncoding(t *testing.T) {
+	var w codec.Writer
+	testPayload().Encode(&w)
+	data := w.Bytes()
+	checkGolden(t, "Payload", data, payloadGolden)
+
+	r := codec.NewReader(data)
+	parsed := DecodePayload(r)
+	if err := r.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	var again codec.Writer
+	parsed.Encode(&again)
+	checkGolden(t, "解析后的Payload", again.Bytes(), payloadGolden)
+}
+
+func TestTradeEncoding(t *testing.T) {
+	tr := testTrade()
+	data := tr.Serialize()
+	checkGolden(t, "Trade", data, tradeGolden)
+	checkGolden(t, "交易ID", tr.ComputeID(), tradeIDGolden)
+
+	parsed, err := ParseTrade(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "解析后的Trade", parsed.Serialize(), tradeGolden)
+	if parsed.Outputs[1].Asset != "tea" || parsed.Outputs[1].Serial != "T-0001" || parsed.Payload.Attributes["cert"] != "QC-9" {
+		t.Fatalf("解析结果丢失了资产、单品或载荷字段: %+v", parsed)
+	}
+}
+
+func TestParseTradeRejectsTruncated(t *testing.T) {
+	data := testTrade().Serialize()
+	if _, err := ParseTrade(data[:len(data)-1]); err == nil {
+		t.Fatal("截断的交易应当解析失败")
+	}
+}
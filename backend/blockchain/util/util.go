@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -12,21 +13,101 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 // blockchain相关
 const (
-	Difficulty     = 12                        // 区块链挖掘的难度
-	InitNum        = 1000                      // 初始币数量
-	TradePool      = "./files/tradePool.data"  // 交易池数据存储文件的路径
+	Difficulty     = 12         // 创世区块及第一个调整周期的挖掘难度
+	InitNum        = 1000       // 初始币数量
+	ChecksumLength = 4          // 用于验证数据完整性的校验和长度
+	NetworkVersion = byte(0x00) // 网络版本号，用于版本控制
+	FilesDir       = "./files"  // 默认的数据文件目录
+)
+
+// 难度调整相关
+// 每RetargetInterval个区块根据实际出块时间调整一次目标值，使平均出块间隔接近TargetBlockTime
+const (
+	RetargetInterval   = 10  // 难度调整周期的区块数，至少为2
+	TargetBlockTime    = 10  // 期望的出块间隔，单位为秒
+	MaxRetargetFactor  = 4   // 单次调整时目标值最多放大或缩小的倍数
+	MinDifficulty      = 8   // 难度下限，目标值不会超过该难度对应的值
+	MaxFutureBlockTime = 120 // 收到的区块时间戳最多超前本地时间的秒数
+)
+
+// 挖矿奖励相关
+// 第h个区块的奖励为 BlockReward >> (h / HalvingInterval)，减半到0后不再产生新的商品
+const (
+	BlockReward     = 50  // 初始的区块奖励
+	HalvingInterval = 210 // 奖励减半的周期，单位为区块数
+)
+
+// MaxBlockSize 一个区块中除挖矿奖励交易以外的交易的最大总字节数，打包时超出的交易留在交易池中，收到超出的区块时拒绝
+const MaxBlockSize = 64 * 1024
+
+// MaxMessageSize 节点间单条消息的最大字节数，超出时丢弃该消息，足够容纳数十万个区块哈希的公告
+const MaxMessageSize = 8 * 1024 * 1024
+
+// 交易池相关
+const (
+	MempoolSize   = 5000           // 交易池最多保存的交易数，满时淘汰手续费率最低的交易
+	MempoolExpiry = 72 * time.Hour // 交易在交易池中的最长保存时间，超过后被移除
+)
+
+// HDLookahead 从助记词恢复分层确定性钱包时，收款链和找零链各派生的地址数
+const HDLookahead = 20
+
+// ShutdownTimeout 服务退出时等待进行中的HTTP请求结束的最长时间
+const ShutdownTimeout = 10 * time.Second
+
+// MinerPollInterval 后台挖矿在交易池为空或挖矿出错时等待的间隔
+const MinerPollInterval = time.Second
+
+// MaxProvenanceNodes 一次溯源查询最多包含的交易数，超出部分不再展开
+const MaxProvenanceNodes = 1000
+
+// MaxAssetSymbolLength 资产代号的最大字节数
+const MaxAssetSymbolLength = 32
+
+// MaxSerialLength 单品序列号的最大字节数
+const MaxSerialLength = 64
+
+// MaxTradeOutputs 创建交易时输出的最大个数，即一次拆分最多的批次数
+const MaxTradeOutputs = 256
+
+// 交易载荷相关
+const (
+	MaxPayloadAttributes = 32   // 载荷中自定义属性的最大个数
+	MaxPayloadSize       = 4096 // 载荷编码后的最大字节数
+)
+
+// 数据文件路径
+// 同一台机器上运行多个节点时，通过SetFilesDir为每个节点指定独立的目录
+var (
+	TradePool      = "./files/tradePool.data"  // 节点退出时保存交易池的文件路径
 	BCPath         = "./files/blocks"          // 存放区块链数据的目录路径
 	BCFile         = "./files/blocks/MANIFEST" // 区块链的清单文件路径
-	ChecksumLength = 4                         // 用于验证数据完整性的校验和长度
-	NetworkVersion = byte(0x00)                // 网络版本号，用于版本控制
 	Wallets        = "./files/wallets/"        // 钱包文件存储目录的路径
 	WalletsRefList = "./files/ref_list/"       // 钱包引用列表文件存储的目录路径
 )
 
+// SetFilesDir 设置数据文件目录，并创建所需的子目录
+func SetFilesDir(dir string) error {
+	dir = filepath.Clean(dir)
+	TradePool = filepath.Join(dir, "tradePool.data")
+	BCPath = filepath.Join(dir, "blocks")
+	BCFile = filepath.Join(BCPath, "MANIFEST")
+	Wallets = filepath.Join(dir, "wallets") + string(filepath.Separator)
+	WalletsRefList = filepath.Join(dir, "ref_list") + string(filepath.Separator)
+
+	for _, path := range []string{BCPath, Wallets, WalletsRefList} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Identity 枚举身份角色
 type Identity string
 
@@ -37,6 +118,19 @@ const (
 	User     Identity = "User"
 )
 
+// Valid 判断是否为已定义的身份角色
+func (id Identity) Valid() bool {
+	switch id {
+	case Raw, Producer, Dealer, User:
+		return true
+	}
+	return false
+}
+
+// DefaultFlowPolicy 默认的供应链流转规则：原料厂→生产商→经销商→用户
+// 格式为以逗号分隔的“付款方身份>收款方身份”
+const DefaultFlowPolicy = "Raw>Producer,Producer>Dealer,Dealer>User"
+
 // 日志相关
 // 使用ANSI颜色代码来区分不同级别的日志
 const (
@@ -93,8 +187,23 @@ func GenNeKeyPair() (ecdsa.PrivateKey, []byte) {
 	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	Err(err)
 	// 公钥为点坐标，需要拼接起来保存
-	publicKey := append(privateKey.PublicKey.X.Bytes(), privateKey.PublicKey.Y.Bytes()...)
-	return *privateKey, publicKey
+	return *privateKey, PublicKeyBytes(&privateKey.PublicKey)
+}
+
+// PublicKeyBytes 将公钥的点坐标按定长拼接
+// 坐标不足定长时需要在前面补零，否则无法从中间切分还原
+func PublicKeyBytes(publicKey *ecdsa.PublicKey) []byte {
+	size := (publicKey.Curve.Params().BitSize + 7) / 8
+	buf := make([]byte, 2*size)
+	publicKey.X.FillBytes(buf[:size])
+	publicKey.Y.FillBytes(buf[size:])
+	return buf
+}
+
+// MatchPublicKey 判断保存的公钥字节是否为key
+// 旧版本的钱包按X.Bytes()||Y.Bytes()拼接公钥，坐标不足定长时没有补零，两种格式都需要接受
+func MatchPublicKey(pubkey []byte, key *ecdsa.PublicKey) bool {
+	return bytes.Equal(pubkey, PublicKeyBytes(key)) || bytes.Equal(pubkey, append(key.X.Bytes(), key.Y.Bytes()...))
 }
 
 // CheckSum 检查位生成函数
@@ -133,11 +242,23 @@ func AddressToPublicHash(address []byte) []byte {
 	return pubKeyHash
 }
 
+// ValidateAddress 检查钱包地址的格式和校验和
+func ValidateAddress(address []byte) bool {
+	decoded, err := base58.Decode(string(address))
+	if err != nil || len(decoded) <= 1+ChecksumLength {
+		return false
+	}
+	versionedHash := decoded[:len(decoded)-ChecksumLength]
+	checkSum := decoded[len(decoded)-ChecksumLength:]
+	return versionedHash[0] == NetworkVersion && bytes.Equal(CheckSum(versionedHash), checkSum)
+}
+
 // CleanData 清空数据
 func CleanData() {
 	emptyDir(BCPath + "/")
 	emptyDir(Wallets)
 	emptyDir(WalletsRefList)
+	os.Remove(TradePool)
 }
 
 func emptyDir(dirPath string) error {
@@ -0,0 +1,118 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// 分层确定性密钥派生，按SLIP-0010在P-256曲线上实现BIP32
+// 私钥派生不合法（IL >= n或子私钥为0）时按SLIP-0010的规则重新计算，而不是跳过该序号
+
+// HardenedOffset 强化派生的序号起点，强化派生的子密钥无法由父公钥推出
+const HardenedOffset uint32 = 1 << 31
+
+// 派生路径 m/44'/0'/0'/chain/index
+const (
+	hdPurpose  = 44
+	hdCoinType = 0
+	hdAccount  = 0
+
+	ChainReceive uint32 = 0 // 收款地址链
+	ChainChange  uint32 = 1 // 找零地址链
+)
+
+var masterKeySeed = []byte("Nist256p1 seed")
+
+var ErrInvalidSeed = errors.New("种子长度应为16到64字节")
+
+// ExtendedKey 扩展私钥，由私钥和链码组成
+type ExtendedKey struct {
+	Key       []byte // 32字节私钥
+	ChainCode []byte // 32字节链码
+	Depth     byte
+	Index     uint32
+}
+
+// NewMasterKey 由种子生成主扩展私钥
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, ErrInvalidSeed
+	}
+	data := seed
+	for {
+		mac := hmac.New(sha512.New, masterKeySeed)
+		mac.Write(data)
+		sum := mac.Sum(nil)
+		il := new(big.Int).SetBytes(sum[:32])
+		if il.Sign() != 0 && il.Cmp(curveOrder()) < 0 {
+			return &ExtendedKey{Key: sum[:32], ChainCode: sum[32:]}, nil
+		}
+		data = sum
+	}
+}
+
+// Child 派生第index个子扩展私钥，index >= HardenedOffset时为强化派生
+func (k *ExtendedKey) Child(index uint32) *ExtendedKey {
+	var data []byte
+	if index >= HardenedOffset {
+		data = append([]byte{0x00}, k.Key...)
+	} else {
+		privKey := privateKeyFromBytes(k.Key)
+		data = elliptic.MarshalCompressed(privKey.Curve, privKey.X, privKey.Y)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	n := curveOrder()
+	for {
+		mac := hmac.New(sha512.New, k.ChainCode)
+		mac.Write(data)
+		sum := mac.Sum(nil)
+
+		il := new(big.Int).SetBytes(sum[:32])
+		child := new(big.Int).Add(il, new(big.Int).SetBytes(k.Key))
+		child.Mod(child, n)
+		if il.Cmp(n) < 0 && child.Sign() != 0 {
+			return &ExtendedKey{
+				Key:       child.FillBytes(make([]byte, privKeySize)),
+				ChainCode: sum[32:],
+				Depth:     k.Depth + 1,
+				Index:     index,
+			}
+		}
+		data = binary.BigEndian.AppendUint32(append([]byte{0x01}, sum[32:]...), index)
+	}
+}
+
+// Derive 依次按路径中的序号派生
+func (k *ExtendedKey) Derive(path ...uint32) *ExtendedKey {
+	key := k
+	for _, index := range path {
+		key = key.Child(index)
+	}
+	return key
+}
+
+// PrivateKey 获取扩展私钥对应的私钥
+func (k *ExtendedKey) PrivateKey() *ecdsa.PrivateKey {
+	return privateKeyFromBytes(k.Key)
+}
+
+// addressPath 收款或找零链上第index个地址的派生路径
+func addressPath(chain, index uint32) []uint32 {
+	return []uint32{
+		HardenedOffset + hdPurpose,
+		HardenedOffset + hdCoinType,
+		HardenedOffset + hdAccount,
+		chain,
+		index,
+	}
+}
+
+func curveOrder() *big.Int {
+	return elliptic.P256().Params().N
+}
@@ -0,0 +1,267 @@
+package wallet
+
+import (
+	"blockchain/util"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/tyler-smith/go-bip39"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 分层确定性钱包
+// 助记词生成种子，收款和找零地址都由种子派生，备份助记词即可恢复全部地址
+// 派生出的每个地址仍保存为普通的加密钱包文件，查询余额、转账等操作与普通钱包相同
+// 种子用与钱包相同的格式加密保存在.hdw文件中，文件名为第一个收款地址
+
+// mnemonicEntropyBits 助记词熵的位数，128位对应12个单词
+const mnemonicEntropyBits = 128
+
+var (
+	ErrInvalidMnemonic = errors.New("助记词无效")
+	ErrNotHDWallet     = errors.New("该地址不属于分层确定性钱包")
+)
+
+// HDWallet 分层确定性钱包
+type HDWallet struct {
+	ID       string        // 第一个收款地址
+	Identity util.Identity // 派生出的所有地址共用的身份
+	Receive  []string      // 已派生的收款地址
+	Change   []string      // 已派生的找零地址
+	Seed     []byte        // 加密的种子，格式与加密钱包文件相同
+}
+
+// NewMnemonic 生成新的助记词
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// hdWalletFile 分层确定性钱包文件路径
+func hdWalletFile(id string) string {
+	return util.Wallets + id + ".hdw"
+}
+
+// CreateHDWallet 由助记词创建分层确定性钱包，派生并保存lookahead个收款地址和找零地址
+// 新建钱包时lookahead为1；从助记词恢复时应派生足够多的地址以找回已使用过的地址
+func CreateHDWallet(mnemonic string, identity util.Identity, passphrase string, lookahead int) (*HDWallet, error) {
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return nil, ErrInvalidMnemonic
+	}
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	first := newDerivedWallet(master, ChainReceive, 0, identity)
+	k, err := sealKeyFile(seed, first.PublicKey, string(identity), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	hd := HDWallet{ID: string(first.Address()), Identity: identity, Seed: k.encode()}
+
+	if lookahead < 1 {
+		lookahead = 1
+	}
+	for i := 0; i < lookahead; i++ {
+		if _, err := hd.derive(master, ChainReceive, passphrase); err != nil {
+			return nil, err
+		}
+		if _, err := hd.derive(master, ChainChange, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	return &hd, hd.Save()
+}
+
+// newDerivedWallet 派生chain链上第index个地址的钱包
+func newDerivedWallet(master *ExtendedKey, chain, index uint32, identity util.Identity) *Wallet {
+	privKey := master.Derive(addressPath(chain, index)...).PrivateKey()
+	return &Wallet{PrivateKey: *privKey, PublicKey: util.PublicKeyBytes(&privKey.PublicKey), Identity: identity}
+}
+
+// derive 派生下一个收款或找零地址并保存其钱包文件，调用方负责保存HDWallet
+func (hd *HDWallet) derive(master *ExtendedKey, chain uint32, passphrase string) (*Wallet, error) {
+	addresses := &hd.Receive
+	if chain == ChainChange {
+		addresses = &hd.Change
+	}
+	w := newDerivedWallet(master, chain, uint32(len(*addresses)), hd.Identity)
+	if err := w.SaveWallet(passphrase); err != nil {
+		return nil, err
+	}
+	*addresses = append(*addresses, string(w.Address()))
+	return w, nil
+}
+
+// masterKey 用口令解密种子并生成主扩展私钥
+func (hd *HDWallet) masterKey(passphrase string) (*ExtendedKey, error) {
+	k, err := decodeKeyFile(hd.Seed)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := k.open(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(newDerivedWallet(master, ChainReceive, 0, hd.Identity).PublicKey, k.PublicKey) {
+		return nil, ErrWrongPassphrase
+	}
+	return master, nil
+}
+
+// NewAddress 派生新的收款地址或找零地址
+func (hd *HDWallet) NewAddress(chain uint32, passphrase string) (*Wallet, error) {
+	master, err := hd.masterKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	w, err := hd.derive(master, chain, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return w, hd.Save()
+}
+
+// Addresses 获取已派生的全部地址
+func (hd *HDWallet) Addresses() []string {
+	return append(append([]string{}, hd.Receive...), hd.Change...)
+}
+
+// Owns 判断地址是否由该钱包派生
+func (hd *HDWallet) Owns(address string) bool {
+	for _, a := range hd.Addresses() {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Save 保存分层确定性钱包
+func (hd *HDWallet) Save() error {
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(hd); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(hdWalletFile(hd.ID), content.Bytes(), 0600)
+}
+
+// LoadHDWallet 根据ID加载分层确定性钱包
+func LoadHDWallet(id string) (*HDWallet, error) {
+	filename := hdWalletFile(id)
+	if !util.FileExists(filename) {
+		return nil, ErrNotHDWallet
+	}
+	fileContent, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var hd HDWallet
+	if err := gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&hd); err != nil {
+		return nil, err
+	}
+	return &hd, nil
+}
+
+// FindHDWallet 查找派生出该地址的分层确定性钱包
+func FindHDWallet(address string) (*HDWallet, error) {
+	var found *HDWallet
+	err := filepath.Walk(util.Wallets, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() || !strings.HasSuffix(f.Name(), ".hdw") || found != nil {
+			return err
+		}
+		hd, err := LoadHDWallet(strings.TrimSuffix(f.Name(), ".hdw"))
+		if err != nil {
+			return fmt.Errorf("加载%s失败: %v", f.Name(), err)
+		}
+		if hd.Owns(address) {
+			found = hd
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrNotHDWallet
+	}
+	return found, nil
+}
+
+// ChangeAddress 为付款地址选择找零地址的公钥哈希，付款地址不属于分层确定性钱包时找零给付款地址本身
+// unregistered为尚未登记身份的找零地址，调用方应为其登记与付款地址相同的身份，没有时为nil
+// registered为nil时每次找零到新派生的地址；否则找零地址必须已在链上登记：
+// 最近派生的找零地址已登记时找零到该地址并派生下一个，尚未登记时找零给付款地址，等待其登记
+func ChangeAddress(from, passphrase string, registered func(pubKeyHash []byte) (bool, error)) (change, unregistered []byte, err error) {
+	change = util.AddressToPublicHash([]byte(from))
+	hd, err := FindHDWallet(from)
+	if err == ErrNotHDWallet {
+		return change, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if registered != nil && len(hd.Change) > 0 {
+		last := util.AddressToPublicHash([]byte(hd.Change[len(hd.Change)-1]))
+		ok, err := registered(last)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return change, last, nil
+		}
+		change = last
+	}
+	w, err := hd.NewAddress(ChainChange, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	next := util.PublicKeyHash(w.PublicKey)
+	if registered == nil {
+		change = next
+	}
+	return change, next, nil
+}
+
+// OtherWallets 解锁付款地址所属分层确定性钱包中的其他地址，付款地址的余额不足时可以从这些地址付款
+// 付款地址不属于分层确定性钱包时返回nil
+func OtherWallets(from, passphrase string) ([]*Wallet, error) {
+	hd, err := FindHDWallet(from)
+	if err == ErrNotHDWallet {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	master, err := hd.masterKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var wallets []*Wallet
+	for _, chain := range []uint32{ChainReceive, ChainChange} {
+		addresses := hd.Receive
+		if chain == ChainChange {
+			addresses = hd.Change
+		}
+		for i, address := range addresses {
+			if address != from {
+				wallets = append(wallets, newDerivedWallet(master, chain, uint32(i), hd.Identity))
+			}
+		}
+	}
+	return wallets, nil
+}
@@ -0,0 +1,176 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 钱包文件格式
+// magic(4) | version(1) | kdf(1) | logN(1) | r(1) | p(1) | salt(16) | nonce(12) |
+// len(1) + 公钥 | len(1) + 身份 | 私钥D的密文
+// 公钥和身份以明文保存，查询余额等操作无需口令；二者作为附加数据参与认证，被篡改时无法解密
+var walletMagic = []byte("GBWL")
+
+const (
+	walletVersion = 1 // 当前的钱包文件版本
+	kdfScrypt     = 1 // 使用scrypt从口令派生密钥
+
+	scryptLogN = 15 // scrypt参数N = 2^15
+	scryptR    = 8
+	scryptP    = 1
+
+	// 钱包文件中scrypt参数的上限，scrypt占用的内存约为128*r*N字节，上限对应256MiB
+	maxScryptLogN = 18
+	maxScryptR    = 8
+	maxScryptP    = 4
+
+	saltLength  = 16
+	nonceLength = 12
+	keyLength   = 32 // AES-256
+	privKeySize = 32 // P-256私钥D的字节数
+)
+
+var (
+	ErrWrongPassphrase = errors.New("口令错误或钱包文件已损坏")
+	ErrWalletFormat    = errors.New("无法识别的钱包文件格式")
+	ErrEmptyPassphrase = errors.New("加密钱包的口令不能为空")
+)
+
+// keyFile 加密钱包文件的内容
+type keyFile struct {
+	LogN, R, P byte
+	Salt       []byte
+	Nonce      []byte
+	PublicKey  []byte
+	Identity   string
+	Ciphertext []byte
+}
+
+// isEncrypted 判断文件内容是否为加密钱包
+func isEncrypted(content []byte) bool {
+	return bytes.HasPrefix(content, walletMagic)
+}
+
+// deriveKey 用scrypt从口令派生对称密钥
+// 参数来自钱包文件，超出上限时返回ErrWalletFormat，避免构造的文件耗尽内存
+func deriveKey(passphrase string, salt []byte, logN, r, p byte) ([]byte, error) {
+	if logN < 1 || logN > maxScryptLogN || r < 1 || r > maxScryptR || p < 1 || p > maxScryptP {
+		return nil, ErrWalletFormat
+	}
+	return scrypt.Key([]byte(passphrase), salt, 1<<logN, int(r), int(p), keyLength)
+}
+
+// header 生成密文之前的全部内容，同时作为AEAD的附加数据
+func (k *keyFile) header() []byte {
+	var buf bytes.Buffer
+	buf.Write(walletMagic)
+	buf.Write([]byte{walletVersion, kdfScrypt, k.LogN, k.R, k.P})
+	buf.Write(k.Salt)
+	buf.Write(k.Nonce)
+	buf.WriteByte(byte(len(k.PublicKey)))
+	buf.Write(k.PublicKey)
+	buf.WriteByte(byte(len(k.Identity)))
+	buf.WriteString(k.Identity)
+	return buf.Bytes()
+}
+
+// encode 编码为文件内容
+func (k *keyFile) encode() []byte {
+	return append(k.header(), k.Ciphertext...)
+}
+
+// decodeKeyFile 解析加密钱包文件
+func decodeKeyFile(content []byte) (*keyFile, error) {
+	fixed := len(walletMagic) + 5 + saltLength + nonceLength
+	if !isEncrypted(content) || len(content) < fixed+1 {
+		return nil, ErrWalletFormat
+	}
+	pos := len(walletMagic)
+	if content[pos] != walletVersion || content[pos+1] != kdfScrypt {
+		return nil, ErrWalletFormat
+	}
+	k := keyFile{LogN: content[pos+2], R: content[pos+3], P: content[pos+4]}
+	pos += 5
+	k.Salt = content[pos : pos+saltLength]
+	pos += saltLength
+	k.Nonce = content[pos : pos+nonceLength]
+	pos += nonceLength
+
+	readField := func() ([]byte, error) {
+		if pos >= len(content) || pos+1+int(content[pos]) > len(content) {
+			return nil, ErrWalletFormat
+		}
+		field := content[pos+1 : pos+1+int(content[pos])]
+		pos += 1 + len(field)
+		return field, nil
+	}
+	pubKey, err := readField()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := readField()
+	if err != nil {
+		return nil, err
+	}
+	k.PublicKey = pubKey
+	k.Identity = string(identity)
+	k.Ciphertext = content[pos:]
+	return &k, nil
+}
+
+// sealKeyFile 用口令加密私钥，口令为空时返回ErrEmptyPassphrase
+func sealKeyFile(d, publicKey []byte, identity, passphrase string) (*keyFile, error) {
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	k := keyFile{
+		LogN:      scryptLogN,
+		R:         scryptR,
+		P:         scryptP,
+		Salt:      make([]byte, saltLength),
+		Nonce:     make([]byte, nonceLength),
+		PublicKey: publicKey,
+		Identity:  identity,
+	}
+	if _, err := rand.Read(k.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(k.Nonce); err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	k.Ciphertext = aead.Seal(nil, k.Nonce, d, k.header())
+	return &k, nil
+}
+
+// open 用口令解密私钥
+func (k *keyFile) open(passphrase string) ([]byte, error) {
+	aead, err := k.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	d, err := aead.Open(nil, k.Nonce, k.Ciphertext, k.header())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return d, nil
+}
+
+func (k *keyFile) aead(passphrase string) (cipher.AEAD, error) {
+	key, err := deriveKey(passphrase, k.Salt, k.LogN, k.R, k.P)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
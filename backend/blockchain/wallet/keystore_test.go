@@ -0,0 +1,60 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	d := bytes.Repeat([]byte{0x07}, privKeySize)
+	k, err := sealKeyFile(d, []byte("pub"), "User", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeKeyFile(k.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := decoded.open("pw")
+	if err != nil || !bytes.Equal(opened, d) {
+		t.Fatalf("解密结果不一致: %x, %v", opened, err)
+	}
+	if _, err := decoded.open("wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("错误的口令应返回ErrWrongPassphrase，得到%v", err)
+	}
+	if _, err := sealKeyFile(d, []byte("pub"), "User", ""); !errors.Is(err, ErrEmptyPassphrase) {
+		t.Fatalf("空口令应返回ErrEmptyPassphrase，得到%v", err)
+	}
+}
+
+func TestKeyFileRejectsScryptParams(t *testing.T) {
+	k, err := sealKeyFile(bytes.Repeat([]byte{0x07}, privKeySize), []byte("pub"), "User", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		logN, r, p byte
+	}{
+		{"N过大", 64, scryptR, scryptP},
+		{"N超过上限", maxScryptLogN + 1, scryptR, scryptP},
+		{"N为0", 0, scryptR, scryptP},
+		{"r过大", scryptLogN, 255, scryptP},
+		{"p过大", scryptLogN, scryptR, 255},
+		{"r为0", scryptLogN, 0, scryptP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crafted := *k
+			crafted.LogN, crafted.R, crafted.P = tt.logN, tt.r, tt.p
+			decoded, err := decodeKeyFile(crafted.encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decoded.open("pw"); !errors.Is(err, ErrWalletFormat) {
+				t.Fatalf("应返回ErrWalletFormat，得到%v", err)
+			}
+		})
+	}
+}
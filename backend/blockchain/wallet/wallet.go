@@ -2,15 +2,18 @@ package wallet
 
 import (
 	"blockchain/util"
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
+	"strings"
 )
 
+// ErrWalletNotFound 该地址没有对应的钱包文件
+var ErrWalletNotFound = errors.New("该地址无法载入钱包")
+
 // Wallet 钱包结构体
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
@@ -31,66 +34,172 @@ func (w *Wallet) Address() []byte {
 	return util.PublicHashToAddress(publicHash)
 }
 
-// SaveWallet 保存钱包
-func (w *Wallet) SaveWallet() {
-	filename := util.Wallets + string(w.Address()) + ".wlt"
-	var content bytes.Buffer
+// walletFile 钱包文件路径
+func walletFile(address string) string {
+	return util.Wallets + address + ".wlt"
+}
+
+// SaveWallet 用口令加密私钥后保存钱包，口令为空时返回ErrEmptyPassphrase
+func (w *Wallet) SaveWallet(passphrase string) error {
+	d := w.PrivateKey.D.FillBytes(make([]byte, privKeySize))
+	k, err := sealKeyFile(d, w.PublicKey, string(w.Identity), passphrase)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(walletFile(string(w.Address())), k.encode(), 0600)
+}
+
+// readWalletFile 读取钱包文件
+func readWalletFile(address string) ([]byte, error) {
+	filename := walletFile(address)
+	if !util.FileExists(filename) {
+		return nil, ErrWalletNotFound
+	}
+	return ioutil.ReadFile(filename)
+}
 
-	// 序列化私钥
-	privKeyBytes := w.PrivateKey.D.Bytes() // 获取D值的字节表示
-	lenPrivBytes := len(privKeyBytes)
-	content.Write([]byte{byte(lenPrivBytes)}) // 首先写入D的长度
-	content.Write(privKeyBytes)               // 写入D的值
+// LoadWallet 加载钱包的公钥和身份，不解密私钥
+// 查询余额、地址等不需要签名的操作使用；需要签名时使用UnlockWallet
+func LoadWallet(address string) (*Wallet, error) {
+	fileContent, err := readWalletFile(address)
+	if err != nil {
+		return nil, err
+	}
 
-	// 写入公钥
-	pubKeyBytes := w.PublicKey
-	lenPubBytes := len(pubKeyBytes)
-	content.Write([]byte{byte(lenPubBytes)}) // 首先写入D的长度
-	content.Write(pubKeyBytes)               // 写入D的值
+	var w *Wallet
+	if isEncrypted(fileContent) {
+		var k *keyFile
+		if k, err = decodeKeyFile(fileContent); err == nil {
+			w = &Wallet{PublicKey: k.PublicKey, Identity: util.Identity(k.Identity)}
+		}
+	} else {
+		w, err = parseLegacyWallet(fileContent)
+		if w != nil {
+			w.PrivateKey = ecdsa.PrivateKey{}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	util.Info(fmt.Sprintf("my identity is %s", w.Identity))
+	return w, nil
+}
 
-	//content.Write(w.PublicKey)
+// UnlockWallet 用口令解密并加载完整的钱包
+// 旧版本的明文钱包不需要口令，照原样载入而不改写文件，由MigrateWallet显式加密
+func UnlockWallet(address, passphrase string) (*Wallet, error) {
+	fileContent, err := readWalletFile(address)
+	if err != nil {
+		return nil, err
+	}
 
-	// 写入角色
-	content.Write([]byte(w.Identity))
+	if !isEncrypted(fileContent) {
+		util.Info(fmt.Sprintf("钱包%s仍为明文格式，请使用migratewallets加密", address))
+		return parseLegacyWallet(fileContent)
+	}
 
-	err := ioutil.WriteFile(filename, content.Bytes(), 0644)
-	util.Err(err)
+	k, err := decodeKeyFile(fileContent)
+	if err != nil {
+		return nil, err
+	}
+	d, err := k.open(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	privKey := privateKeyFromBytes(d)
+	if !util.MatchPublicKey(k.PublicKey, &privKey.PublicKey) {
+		return nil, ErrWrongPassphrase
+	}
+	return &Wallet{PrivateKey: *privKey, PublicKey: k.PublicKey, Identity: util.Identity(k.Identity)}, nil
 }
 
-// LoadWallet 加载钱包
-func LoadWallet(address string) *Wallet {
-	filename := util.Wallets + address + ".wlt"
-	if !util.FileExists(filename) {
-		util.Err(errors.New("该地址无法载入钱包！"))
+// MigrateWallet 将旧版本的明文钱包文件用口令加密，返回是否进行了迁移，已加密的钱包不做修改
+// 口令为空时返回ErrEmptyPassphrase，避免钱包被空口令锁定
+func MigrateWallet(address, passphrase string) (bool, error) {
+	if passphrase == "" {
+		return false, ErrEmptyPassphrase
+	}
+	fileContent, err := readWalletFile(address)
+	if err != nil {
+		return false, err
 	}
+	if isEncrypted(fileContent) {
+		return false, nil
+	}
+	w, err := parseLegacyWallet(fileContent)
+	if err != nil {
+		return false, err
+	}
+	if err := w.SaveWallet(passphrase); err != nil {
+		return false, err
+	}
+	util.Info(fmt.Sprintf("钱包%s已升级为加密格式", address))
+	return true, nil
+}
 
-	fileContent, err := ioutil.ReadFile(filename)
-	util.Err(err)
+// MigrateWallets 用同一个口令加密钱包目录中全部旧版本的明文钱包，返回迁移的数量
+func MigrateWallets(passphrase string) (int, error) {
+	if passphrase == "" {
+		return 0, ErrEmptyPassphrase
+	}
+	files, err := ioutil.ReadDir(util.Wallets)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".wlt") {
+			continue
+		}
+		ok, err := MigrateWallet(strings.TrimSuffix(f.Name(), ".wlt"), passphrase)
+		if err != nil {
+			return migrated, fmt.Errorf("迁移钱包%s失败: %v", f.Name(), err)
+		}
+		if ok {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
 
-	// 读取私钥
-	lenPrivBytes := int(fileContent[0])
-	d := new(big.Int).SetBytes(fileContent[1 : 1+lenPrivBytes])
+// ChangePassphrase 修改钱包口令
+func ChangePassphrase(address, oldPassphrase, newPassphrase string) error {
+	w, err := UnlockWallet(address, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	return w.SaveWallet(newPassphrase)
+}
+
+// privateKeyFromBytes 由私钥D恢复私钥
+func privateKeyFromBytes(d []byte) *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(d)
 	privKey := ecdsa.PrivateKey{
-		D: d,
-		PublicKey: ecdsa.PublicKey{
-			Curve: elliptic.P256(),
-			X:     new(big.Int),
-			Y:     new(big.Int),
-		},
+		D:         new(big.Int).SetBytes(d),
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
 	}
+	return &privKey
+}
 
-	// 读取公钥
+// parseLegacyWallet 解析旧版本的明文钱包文件
+// len(1) + 私钥D | len(1) + 公钥 | 身份
+func parseLegacyWallet(fileContent []byte) (*Wallet, error) {
+	if len(fileContent) < 1 {
+		return nil, ErrWalletFormat
+	}
+	lenPrivBytes := int(fileContent[0])
+	if len(fileContent) < 2+lenPrivBytes {
+		return nil, ErrWalletFormat
+	}
 	lenPubKeyBytes := int(fileContent[1+lenPrivBytes])
-	pubKeyBytes := fileContent[2+lenPrivBytes : 2+lenPrivBytes+lenPubKeyBytes]
-	privKey.PublicKey.X.SetBytes(pubKeyBytes[:len(pubKeyBytes)/2])
-	privKey.PublicKey.Y.SetBytes(pubKeyBytes[len(pubKeyBytes)/2:])
-	//pubKeyBytes := fileContent[1+lenPrivBytes:]
-	//privKey.PublicKey.X.SetBytes(pubKeyBytes[:len(pubKeyBytes)/2])
-	//privKey.PublicKey.Y.SetBytes(pubKeyBytes[len(pubKeyBytes)/2:])
+	if len(fileContent) < 2+lenPrivBytes+lenPubKeyBytes {
+		return nil, ErrWalletFormat
+	}
 
-	// 读取身份信息
+	d := fileContent[1 : 1+lenPrivBytes]
+	pubKeyBytes := fileContent[2+lenPrivBytes : 2+lenPrivBytes+lenPubKeyBytes]
+	privKey := privateKeyFromBytes(d)
 	identity := string(fileContent[2+lenPrivBytes+lenPubKeyBytes:])
-	util.Info(fmt.Sprintf("my identity is %s", identity))
-
-	return &Wallet{PrivateKey: privKey, PublicKey: pubKeyBytes, Identity: util.Identity(identity)}
+	return &Wallet{PrivateKey: *privKey, PublicKey: pubKeyBytes, Identity: util.Identity(identity)}, nil
 }
@@ -11,6 +11,9 @@ import (
 	"strings"
 )
 
+// ErrRefNotFound 没有钱包使用该别名
+var ErrRefNotFound = errors.New("通过别名未找到钱包")
+
 // RefList 记录钱包信息
 // 从地址到别名的映射
 type RefList map[string]string
@@ -30,26 +33,25 @@ func (r *RefList) FindRef(refname string) (string, error) {
 		}
 	}
 	if temp == "" {
-		err := errors.New("通过别名未找到钱包...")
-		return temp, err
+		return temp, ErrRefNotFound
 	}
 	return temp, nil
 }
 
 // Save 保存RefList
-func (r *RefList) Save() {
+func (r *RefList) Save() error {
 	filename := util.WalletsRefList + "ref_list"
 	var content bytes.Buffer
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(r)
-	util.Err(err)
-	err = ioutil.WriteFile(filename, content.Bytes(), 0644)
-	util.Err(err)
+	if err := encoder.Encode(r); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, content.Bytes(), 0644)
 }
 
 // Update 扫描所有保存的钱包文件
-func (r *RefList) Update() {
-	err := filepath.Walk(util.Wallets, func(path string, f os.FileInfo, err error) error {
+func (r *RefList) Update() error {
+	return filepath.Walk(util.Wallets, func(path string, f os.FileInfo, err error) error {
 		if f == nil {
 			return err
 		}
@@ -65,22 +67,26 @@ func (r *RefList) Update() {
 		}
 		return nil
 	})
-	util.Err(err)
 }
 
 // LoadRefList 加载RefList信息
-func LoadRefList() *RefList {
+func LoadRefList() (*RefList, error) {
 	filename := util.WalletsRefList + "ref_list"
 	var reflist RefList
 	if util.FileExists(filename) {
 		fileContent, err := ioutil.ReadFile(filename)
-		util.Err(err)
+		if err != nil {
+			return nil, err
+		}
 		decoder := gob.NewDecoder(bytes.NewBuffer(fileContent))
-		err = decoder.Decode(&reflist)
-		util.Err(err)
+		if err := decoder.Decode(&reflist); err != nil {
+			return nil, err
+		}
 	} else {
 		reflist = make(RefList)
-		reflist.Update()
+		if err := reflist.Update(); err != nil {
+			return nil, err
+		}
 	}
-	return &reflist
+	return &reflist, nil
 }